@@ -1,18 +1,70 @@
 package main
 
 import (
-	"irc"
+	"bufio"
+	"flag"
 	"fmt"
+	"github.com/jessta/goirc/irc"
 	"os"
-	"bufio"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
 )
 
+var dryrun = flag.Bool("dry-run", false, "Don't send anything but PONGs, JOINs, NICKs, QUITs and queries once connected")
+var replay = flag.String("replay", "", "Replay a log of raw IRC lines instead of connecting, then dump state")
+
 func main() {
+	flag.Parse()
+
 	// create new IRC connection
 	c := irc.New("GoTest", "gotest", "GoBot")
-	c.AddHandler("connected",
-		func(conn *irc.Conn, line *irc.Line) { conn.Join("#go-nuts") })
+	c.DryRun = *dryrun
+	c.AddHandler("connected", func(conn *irc.Conn, line *irc.Line) {
+		results := conn.JoinAll([]string{"#go-nuts"}, 30*time.Second)
+		go func() {
+			for _, r := range <-results {
+				if r.Reason != "" {
+					fmt.Printf("Couldn't join %s: %s %s\n", r.Channel, r.Reason, r.Text)
+				}
+			}
+		}()
+	})
+
+	if *replay != "" {
+		f, err := os.Open(*replay)
+		if err != nil {
+			fmt.Printf("Replay error: %s\n", err)
+			return
+		}
+		defer f.Close()
+		go func() {
+			for err := range c.Err {
+				fmt.Printf("goirc error: %s\n", err)
+			}
+		}()
+		if err := c.Replay(f); err != nil {
+			fmt.Printf("Replay error: %s\n", err)
+		}
+		fmt.Print(c.String())
+		return
+	}
+
+	// tell systemd when we're up, and keep its watchdog happy for as long
+	// as the server keeps PINGing us and we keep seeing it
+	var lastping atomic.Int64
+	c.AddHandler("connected", func(conn *irc.Conn, line *irc.Line) {
+		lastping.Store(time.Now().Unix())
+		sdNotify("READY=1")
+	})
+	c.AddHandler("PING", func(conn *irc.Conn, line *irc.Line) {
+		lastping.Store(time.Now().Unix())
+	})
+	go sdWatchdog(func() bool {
+		return !c.Connected() || time.Now().Unix()-lastping.Load() < 600
+	})
 
 	// connect to server
 	if err := c.Connect("irc.freenode.net", ""); err != nil {
@@ -20,9 +72,27 @@ func main() {
 		return
 	}
 
+	// QUIT properly when we're asked to stop, giving the server a chance to
+	// see everything we've queued up before it
+	var reallyquit atomic.Bool
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		<-sigs
+		sdNotify("STOPPING=1")
+		reallyquit.Store(true)
+		if c.Connected() {
+			c.Quit("Terminated")
+			select {
+			case <-c.Disconnected():
+			case <-time.After(10 * time.Second):
+			}
+		}
+		os.Exit(0)
+	}()
+
 	// set up a goroutine to read commands from stdin
 	in := make(chan string, 4)
-	reallyquit := false
 	go func() {
 		con := bufio.NewReader(os.Stdin)
 		for {
@@ -34,7 +104,7 @@ func main() {
 			}
 			// no point in sending empty lines down the channel
 			if len(s) > 2 {
-				in <- s[0:len(s)-1]
+				in <- s[0 : len(s)-1]
 			}
 		}
 	}()
@@ -45,7 +115,7 @@ func main() {
 			if cmd[0] == ':' {
 				switch idx := strings.Index(cmd, " "); {
 				case cmd[1] == 'd':
-					fmt.Printf(c.String())
+					fmt.Print(c.String())
 				case cmd[1] == 'f':
 					if len(cmd) > 2 && cmd[2] == 'e' {
 						// enable flooding
@@ -57,15 +127,22 @@ func main() {
 					for i := 0; i < 20; i++ {
 						c.Privmsg("#", "flood test!")
 					}
+				case cmd[1] == 'r':
+					// ":r file" records traffic to file, ":r" stops
+					if idx == -1 {
+						c.Record(nil)
+					} else {
+						c.Record(irc.NewRecorder(cmd[idx+1:], 10<<20, 5))
+					}
 				case idx == -1:
 					continue
 				case cmd[1] == 'q':
-					reallyquit = true
-					c.Quit(cmd[idx+1 : len(cmd)])
+					reallyquit.Store(true)
+					c.Quit(cmd[idx+1:])
 				case cmd[1] == 'j':
-					c.Join(cmd[idx+1 : len(cmd)])
+					c.Join(cmd[idx+1:])
 				case cmd[1] == 'p':
-					c.Part(cmd[idx+1 : len(cmd)])
+					c.Part(cmd[idx+1:], "")
 				}
 			} else {
 				c.Raw(cmd)
@@ -74,13 +151,34 @@ func main() {
 	}()
 
 	// stall here waiting for asplode on error channel
+	wait := time.Duration(0)
 	for {
 		for err := range c.Err {
 			fmt.Printf("goirc error: %s\n", err)
 		}
-		if reallyquit {
+		if reallyquit.Load() {
+			break
+		}
+		// reconnecting won't help if we've been banned, and the server
+		// won't thank us for hammering it if it's throttling us
+		r := c.DisconnectReason()
+		if r.Banned() {
+			fmt.Printf("Banned from the server, not reconnecting: %s\n", r.Text)
 			break
 		}
+		if r != nil && r.Kind == "THROTTLED" {
+			if wait *= 2; wait < time.Minute {
+				wait = time.Minute
+			} else if wait > 30*time.Minute {
+				wait = 30 * time.Minute
+			}
+		} else {
+			wait = 0
+		}
+		if wait > 0 {
+			fmt.Printf("Throttled by the server, waiting %s\n", wait)
+			time.Sleep(wait)
+		}
 		fmt.Println("Reconnecting...")
 		if err := c.Connect("irc.freenode.net", ""); err != nil {
 			fmt.Printf("Connection error: %s\n", err)
@@ -0,0 +1,3 @@
+module github.com/jessta/goirc
+
+go 1.21
@@ -0,0 +1,98 @@
+package irc
+
+// Here you'll find support for IRCv3 batches, which group related lines
+// together, and the chathistory extension that delivers its results in them.
+
+import (
+	"strings"
+)
+
+// A struct representing an open IRCv3 batch
+type batch struct {
+	Ref, Type, Label string
+	Params           []string
+	Lines            []*Line
+}
+
+// Keeps track of BATCH start and end lines, and collects lines tagged as being
+// part of a batch. Returns true if the line is part of a batch that shouldn't
+// be dispatched to the usual event handlers, like chathistory playback.
+// Called from dispatchEvent() so that batches are collected in order.
+func (conn *Conn) batchLine(line *Line) bool {
+	if line.Cmd == "BATCH" && len(line.Args) > 0 && len(line.Args[0]) > 1 {
+		ref := line.Args[0][1:len(line.Args[0])]
+		switch line.Args[0][0] {
+		case '+':
+			b := &batch{Ref: ref, Label: line.Tags["label"]}
+			if len(line.Args) > 1 {
+				b.Type = line.Args[1]
+				b.Params = line.Args[2:len(line.Args)]
+			}
+			conn.batches[ref] = b
+		case '-':
+			if b, ok := conn.batches[ref]; ok {
+				delete(conn.batches, ref)
+				conn.endBatch(b)
+			}
+		}
+		return false
+	}
+	ref, ok := line.Tags["batch"]
+	if !ok {
+		return false
+	}
+	b, ok := conn.batches[ref]
+	if !ok {
+		return false
+	}
+	b.Lines = append(b.Lines, line)
+	return b.Type == "chathistory" || b.Type == "draft/chathistory"
+}
+
+// Hands the lines of a finished batch to whoever asked for them
+func (conn *Conn) endBatch(b *batch) {
+	if b.Type == "labeled-response" && b.Label != "" {
+		// see labels.go
+		conn.deliverLabeled(b.Label, b.Lines)
+		return
+	}
+	if (b.Type != "chathistory" && b.Type != "draft/chathistory") || len(b.Params) == 0 {
+		return
+	}
+	t := conn.Fold(b.Params[0])
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if w, ok := conn.history[t]; ok && len(w) > 0 {
+		w[0] <- b.Lines
+		if len(w) == 1 {
+			delete(conn.history, t)
+		} else {
+			conn.history[t] = w[1:]
+		}
+	}
+}
+
+// ChatHistory() sends a CHATHISTORY command to the server, asking for the
+// history of target within bounds, e.g.
+//
+//	ChatHistory("#moo", "LATEST * 50")
+//	ChatHistory("#moo", "BEFORE timestamp=2011-01-01T00:00:00.000Z 100")
+//
+// The lines from the resulting batch are sent down the returned channel, in
+// order, without being dispatched to event handlers. If the server doesn't
+// support chathistory nothing will ever be sent, so don't wait forever.
+func (conn *Conn) ChatHistory(target, bounds string) <-chan []*Line {
+	c := make(chan []*Line, 1)
+	t := conn.Fold(target)
+	conn.mu.Lock()
+	conn.history[t] = append(conn.history[t], c)
+	conn.mu.Unlock()
+
+	b := strings.Fields(bounds)
+	if len(b) == 0 {
+		conn.error("irc.ChatHistory(): buh? no subcommand in %q", bounds)
+		return c
+	}
+	conn.writeMessage(NewMessage("CHATHISTORY", append([]string{b[0], target}, b[1:]...)...))
+	return c
+}
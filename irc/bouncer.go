@@ -0,0 +1,263 @@
+package irc
+
+// Here you'll find a minimal bouncer, which lets ordinary IRC clients attach
+// to a *Conn, see what it sees and talk through it, and catch up on what they
+// missed while they were detached.
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"sync"
+)
+
+// A struct representing a bouncer relaying between an upstream *Conn and any
+// number of attached clients
+type Bouncer struct {
+	// If set, clients have to send this with PASS to attach
+	Password string
+
+	// How many PRIVMSGs and NOTICEs to keep while no clients are attached
+	BufferSize int
+
+	conn    *Conn
+	clients map[*bouncerClient]bool
+	buffer  []string
+	// How many lines have been dropped from the start of buffer, so that
+	// positions in it can be told apart as it moves, see delivered()
+	trimmed int
+	mu      sync.Mutex
+}
+
+// An attached client, with a queue of lines for it so that a slow client
+// can't hold up the upstream connection
+type bouncerClient struct {
+	sock net.Conn
+	out  chan string
+}
+
+// Creates a new *irc.Bouncer relaying for conn. Only one bouncer can relay
+// for a connection.
+func NewBouncer(conn *Conn) *Bouncer {
+	b := &Bouncer{BufferSize: 500, conn: conn, clients: make(map[*bouncerClient]bool)}
+	conn.tap = b.upstream
+	return b
+}
+
+// Serve() accepts clients on l until it returns an error, e.g.
+//
+//	l, err := net.Listen("tcp", "localhost:6667")
+//	...
+//	go b.Serve(l)
+func (b *Bouncer) Serve(l net.Listener) error {
+	for {
+		sock, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go b.serveClient(sock)
+	}
+}
+
+// Relays a line from upstream to attached clients, or buffers it if there
+// aren't any. Called for every line received, in order, see runLoop().
+func (b *Bouncer) upstream(line *Line) {
+	if line.Raw == "" || line.Cmd == "PING" {
+		return
+	}
+	// clients haven't negotiated any capabilities with us, so no tags
+	raw := line.Raw
+	if raw[0] == '@' {
+		if idx := strings.Index(raw, " "); idx != -1 {
+			raw = raw[idx+1:]
+		}
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.clients) > 0 {
+		for c := range b.clients {
+			b.send(c, raw)
+		}
+		return
+	}
+	switch line.Cmd {
+	case "PRIVMSG", "NOTICE":
+		if b.buffer = append(b.buffer, raw); len(b.buffer) > b.BufferSize {
+			b.trim(len(b.buffer) - b.BufferSize)
+		}
+	}
+}
+
+// Throws away the first n buffered lines. Called with b.mu held.
+func (b *Bouncer) trim(n int) {
+	if n > len(b.buffer) {
+		n = len(b.buffer)
+	}
+	b.buffer = b.buffer[n:]
+	b.trimmed += n
+}
+
+// Queues s for c, detaching c if it has fallen too far behind. Returns false
+// if c isn't attached, or has just been detached. Called with b.mu held.
+func (b *Bouncer) send(c *bouncerClient, s string) bool {
+	if !b.clients[c] {
+		return false
+	}
+	select {
+	case c.out <- s:
+		return true
+	default:
+		delete(b.clients, c)
+		close(c.out)
+		return false
+	}
+}
+
+// Talks to one client, from registration until it goes away
+func (b *Bouncer) serveClient(sock net.Conn) {
+	r := bufio.NewReader(sock)
+
+	// wait for the client to register, ignoring anything else
+	var pass, nick string
+	user := false
+	for nick == "" || !user {
+		s, err := r.ReadString('\n')
+		if err != nil {
+			sock.Close()
+			return
+		}
+		line, err := ParseLine(strings.TrimRight(s, "\r\n"))
+		if err != nil {
+			continue
+		}
+		switch line.Cmd {
+		case "PASS":
+			pass = strings.Join(params(line, 0), " ")
+		case "NICK":
+			if p := params(line, 0); len(p) > 0 {
+				nick = p[0]
+			}
+		case "USER":
+			user = true
+		}
+	}
+	if b.Password != "" && pass != b.Password {
+		sock.Write([]byte(":goirc 464 " + nick + " :Password incorrect\r\n"))
+		sock.Close()
+		return
+	}
+
+	b.mu.Lock()
+	c, burst, upto := b.attach(sock, nick)
+	b.mu.Unlock()
+	// the socket is closed once everything queued for it has been written,
+	// so closing c.out is how to get rid of a client. Buffered lines are
+	// only forgotten once they've all been written.
+	go func() {
+		ok := true
+		for s := range c.out {
+			if !ok {
+				continue
+			}
+			if _, err := sock.Write([]byte(s + "\r\n")); err != nil {
+				ok = false
+				sock.Close()
+				continue
+			}
+			if burst--; burst == 0 {
+				b.delivered(upto)
+			}
+		}
+		sock.Close()
+	}()
+
+	for {
+		s, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		s = strings.TrimRight(s, "\r\n")
+		line, err := ParseLine(s)
+		if err != nil {
+			continue
+		}
+		switch line.Cmd {
+		case "QUIT":
+			// this detaches the client, rather than quitting upstream
+		case "PING":
+			// clients don't all put their token in the trailing parameter
+			token := ""
+			if p := params(line, 0); len(p) > 0 {
+				token = p[len(p)-1]
+			}
+			b.mu.Lock()
+			b.send(c, ":goirc PONG goirc :"+token)
+			b.mu.Unlock()
+			continue
+		case "PONG", "PASS", "USER", "CAP":
+			continue
+		default:
+			b.conn.Raw(s)
+			continue
+		}
+		break
+	}
+
+	b.mu.Lock()
+	if b.clients[c] {
+		delete(b.clients, c)
+		close(c.out)
+	}
+	b.mu.Unlock()
+}
+
+// Attaches a client on sock, queueing everything it needs to catch up with
+// the upstream connection: a welcome, the channels we're on and whatever we
+// buffered while there were no clients attached. The queue is made big
+// enough for all of this, with room to spare for what's relayed after it.
+// Returns the client, how many lines were queued, and where in the buffer
+// they went up to, for delivered(). Called with b.mu held, so that nothing
+// is relayed to the client until this is done.
+func (b *Bouncer) attach(sock net.Conn, nick string) (*bouncerClient, int, int) {
+	conn := b.conn
+	me := conn.Me
+	burst := []string{":goirc 001 " + me.Nick + " :Welcome to the goirc bouncer, " + me.Nick}
+	if nick != me.Nick {
+		burst = append(burst, ":"+nick+" NICK "+me.Nick)
+	}
+	src := ":" + me.Nick + "!" + me.Ident + "@" + me.Host
+	conn.state.RLock()
+	for _, ch := range me.channelList() {
+		burst = append(burst, src+" JOIN "+ch.Name)
+		if ch.Topic != "" {
+			burst = append(burst, ":goirc 332 "+me.Nick+" "+ch.Name+" :"+ch.Topic)
+		}
+		names := []string{}
+		for _, n := range ch.nickList() {
+			names = append(names, ch.Nicks[n].prefix()+n.Nick)
+		}
+		burst = append(burst, ":goirc 353 "+me.Nick+" = "+ch.Name+" :"+strings.Join(names, " "),
+			":goirc 366 "+me.Nick+" "+ch.Name+" :End of /NAMES list.")
+	}
+	conn.state.RUnlock()
+	burst = append(burst, b.buffer...)
+
+	c := &bouncerClient{sock: sock, out: make(chan string, len(burst)+256)}
+	b.clients[c] = true
+	for _, s := range burst {
+		if !b.send(c, s) {
+			break
+		}
+	}
+	return c, len(burst), b.trimmed + len(b.buffer)
+}
+
+// Forgets buffered lines up to upto, counting from the first line ever
+// buffered, once a client has been sent them.
+func (b *Bouncer) delivered(upto int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if upto > b.trimmed {
+		b.trim(upto - b.trimmed)
+	}
+}
@@ -0,0 +1,67 @@
+package irc
+
+// Here you'll find case-insensitive comparison of nicks and channel names,
+// which on IRC depends on the server's CASEMAPPING: with the traditional
+// "rfc1459" casemapping, "[]\~" are the upper case versions of "{}|^".
+
+import (
+	"strings"
+)
+
+var (
+	asciiFolder   = strings.NewReplacer(foldPairs("ABCDEFGHIJKLMNOPQRSTUVWXYZ", "abcdefghijklmnopqrstuvwxyz")...)
+	strictFolder  = strings.NewReplacer(foldPairs("ABCDEFGHIJKLMNOPQRSTUVWXYZ[]\\", "abcdefghijklmnopqrstuvwxyz{}|")...)
+	rfc1459Folder = strings.NewReplacer(foldPairs("ABCDEFGHIJKLMNOPQRSTUVWXYZ[]\\~", "abcdefghijklmnopqrstuvwxyz{}|^")...)
+)
+
+// turns "AB", "ab" into "A", "a", "B", "b" for strings.NewReplacer()
+func foldPairs(upper, lower string) []string {
+	p := make([]string, 0, 2*len(upper))
+	for i := 0; i < len(upper); i++ {
+		p = append(p, upper[i:i+1], lower[i:i+1])
+	}
+	return p
+}
+
+// CaseFold() returns s in lower case according to casemapping, which is one
+// of "ascii", "strict-rfc1459" or "rfc1459". Anything else is treated as
+// "rfc1459", as servers that don't send CASEMAPPING use that.
+func CaseFold(casemapping, s string) string {
+	switch casemapping {
+	case "ascii":
+		return asciiFolder.Replace(s)
+	case "strict-rfc1459":
+		return strictFolder.Replace(s)
+	}
+	return rfc1459Folder.Replace(s)
+}
+
+// Fold() returns s in lower case according to the server's CASEMAPPING, so
+// that nicks and channel names that the server thinks are the same compare
+// equal, e.g. "Nick[away]" and "nick{away}".
+func (conn *Conn) Fold(s string) string {
+	casemapping, _ := conn.ISupport("CASEMAPPING")
+	return CaseFold(casemapping, s)
+}
+
+// EqualFold() returns true if a and b are the same nick or channel name,
+// going by the server's CASEMAPPING. See Fold().
+func (conn *Conn) EqualFold(a, b string) bool {
+	return conn.Fold(a) == conn.Fold(b)
+}
+
+// Re-files the nicks and channels we're tracking under their names as folded
+// with the current CASEMAPPING, which may have changed since they were added.
+func (conn *Conn) refold() {
+	conn.state.Lock()
+	defer conn.state.Unlock()
+	nicks := make(map[string]*Nick, len(conn.nicks))
+	for _, n := range conn.nicks {
+		nicks[conn.Fold(n.Nick)] = n
+	}
+	chans := make(map[string]*Channel, len(conn.chans))
+	for _, ch := range conn.chans {
+		chans[conn.Fold(ch.Name)] = ch
+	}
+	conn.nicks, conn.chans = nicks, chans
+}
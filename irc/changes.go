@@ -0,0 +1,160 @@
+package irc
+
+// Here you'll find a stream of the changes to channels we're on, for things
+// like web dashboards and loggers that want to follow what's happening from
+// their own goroutines without writing handlers for half a dozen events and
+// worrying about what order they run in.
+
+import (
+	"strings"
+	"time"
+)
+
+// A struct representing something that happened on a channel
+type ChannelChange struct {
+	// The channel it happened on, and what happened: "JOIN", "PART",
+	// "KICK", "QUIT", "NICK", "TOPIC" or "MODE"
+	Channel, Kind string
+
+	// Who it happened to, for JOIN, PART, KICK, QUIT and NICK, and who did
+	// it, for KICK, TOPIC and MODE: a nick, or the server's name if it was
+	// the server or services
+	Nick, By string
+
+	// The new nick for NICK, the topic for TOPIC, the modes and their
+	// arguments for MODE, and the message for PART, KICK and QUIT
+	Arg string
+
+	// When we found out about it
+	Time time.Time
+
+	// How many changes were dropped before this one because the receiver
+	// wasn't keeping up
+	Missed int
+}
+
+// Someone receiving ChannelChanges
+type watcher struct {
+	channel string
+	c       chan ChannelChange
+	missed  int
+}
+
+// ChannelChanges() returns a channel that every change to channel, or to all
+// channels if channel is "", is sent down in the order it happened, and a
+// function to call to stop them and close it. Up to buffer changes are
+// queued for the receiver; if it falls further behind than that, changes are
+// dropped and the next one it gets says how many in Missed. Changes carry on
+// across reconnections.
+func (conn *Conn) ChannelChanges(channel string, buffer int) (<-chan ChannelChange, func()) {
+	w := &watcher{channel: conn.Fold(channel), c: make(chan ChannelChange, buffer)}
+	conn.mu.Lock()
+	conn.watchers = append(conn.watchers, w)
+	conn.mu.Unlock()
+	return w.c, func() {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		for i, o := range conn.watchers {
+			if o == w {
+				conn.watchers = append(conn.watchers[:i], conn.watchers[i+1:]...)
+				close(w.c)
+				return
+			}
+		}
+	}
+}
+
+// Works out the changes line makes to channels and sends them to whoever is
+// receiving them. Called from dispatchEvent(), so that lines from the server
+// are seen in the order they came in, and before handlers have had a chance
+// to update the state tracking. Handlers are changing that state from their
+// own goroutines all the while, so it's only read with conn.state held.
+func (conn *Conn) channelChanges(line *Line) {
+	conn.mu.Lock()
+	n := len(conn.watchers)
+	conn.mu.Unlock()
+	if n == 0 {
+		return
+	}
+	// servers and services change modes and topics too, but only nicks
+	// join, leave and change nick
+	by := line.Nick
+	if by == "" {
+		switch line.Cmd {
+		case "KICK", "TOPIC", "MODE":
+			by = line.Src
+		default:
+			return
+		}
+	}
+	changes := []ChannelChange{}
+	add := func(channel, nick, by, arg string) {
+		changes = append(changes, ChannelChange{Channel: channel, Kind: line.Cmd,
+			Nick: nick, By: by, Arg: arg, Time: time.Now()})
+	}
+	// lines for nicks on all their channels, from before they've gone
+	everywhere := func(arg string) {
+		conn.state.RLock()
+		names := []string{}
+		if nick, ok := conn.nicks[conn.Fold(line.Nick)]; ok {
+			for _, ch := range nick.channelList() {
+				names = append(names, ch.Name)
+			}
+		}
+		conn.state.RUnlock()
+		for _, name := range names {
+			add(name, line.Nick, "", arg)
+		}
+	}
+	switch line.Cmd {
+	case "JOIN":
+		if len(line.Args) > 0 {
+			add(line.Args[0], line.Nick, "", "")
+		} else {
+			add(line.Text, line.Nick, "", "")
+		}
+	case "PART":
+		if len(line.Args) > 0 {
+			add(line.Args[0], line.Nick, "", line.Text)
+		} else {
+			add(line.Text, line.Nick, "", "")
+		}
+	case "KICK":
+		if len(line.Args) > 1 {
+			add(line.Args[0], line.Args[1], by, line.Text)
+		}
+	case "QUIT":
+		everywhere(line.Text)
+	case "NICK":
+		if p := params(line, 0); len(p) > 0 {
+			everywhere(p[0])
+		}
+	case "TOPIC":
+		if len(line.Args) > 0 {
+			add(line.Args[0], "", by, line.Text)
+		}
+	case "MODE":
+		if len(line.Args) > 0 && conn.IsChannel(line.Args[0]) {
+			add(line.Args[0], "", by, strings.Join(params(line, 1), " "))
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for _, w := range conn.watchers {
+		for _, c := range changes {
+			if w.channel != "" && w.channel != conn.Fold(c.Channel) {
+				continue
+			}
+			c.Missed = w.missed
+			select {
+			case w.c <- c:
+				w.missed = 0
+			default:
+				w.missed++
+			}
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package irc
+
+// Here you'll find the grouping of bursts of JOINs, PARTs and QUITs, like
+// those after a netsplit, into single events, so that loggers and the like
+// can say "bob, alice and 40 others joined" instead of 42 separate things.
+//
+// With conn.CoalesceWindow set, other people's JOINs, PARTs and QUITs are
+// collected for that long after the first of a burst, then dispatched as:
+//   - "JOINS" with the channel in Args[0] and the nicks in Args[1:]
+//   - "PARTS" with the channel in Args[0] and the nicks in Args[1:]
+//   - "QUITS" with the nicks in Args and the quit message, e.g. the two
+//     servers for a netsplit, in Text
+//
+// The usual per-nick events are still dispatched as well, so state tracking
+// isn't affected; handle these instead of them if you'd rather. Bursts are
+// dispatched with the first line we get after their window is up, which on
+// a quiet connection may not be until the server next PINGs us.
+
+import (
+	"time"
+)
+
+// A burst of nicks doing the same thing, waiting to be dispatched
+type coalesced struct {
+	line  *Line
+	nicks []string
+	start time.Time
+}
+
+// Adds JOINs, PARTs and QUITs from other people to the bursts they're part
+// of, and dispatches the bursts whose windows are up. Called from
+// dispatchEvent(), so that there's no need for a goroutine of our own.
+// Handlers call that too, for the events they trigger, so the bursts are
+// only touched with conn.mu held, and dispatched once it's been let go.
+func (conn *Conn) coalesceLine(line *Line) {
+	if conn.CoalesceWindow <= 0 {
+		return
+	}
+	now := time.Now()
+	switch line.Cmd {
+	case "JOIN", "PART":
+		name := line.Text
+		if len(line.Args) > 0 {
+			name = line.Args[0]
+		}
+		conn.coalesce(line.Cmd+"S", name, line, now)
+	case "QUIT":
+		conn.coalesce("QUITS", "", line, now)
+	}
+	done := []*Line{}
+	conn.mu.Lock()
+	for key, c := range conn.bursts {
+		if now.Sub(c.start) >= conn.CoalesceWindow {
+			c.line.Args = append(c.line.Args, c.nicks...)
+			done = append(done, c.line)
+			delete(conn.bursts, key)
+		}
+	}
+	conn.mu.Unlock()
+	for _, l := range done {
+		conn.dispatchEvent(l)
+	}
+}
+
+// Adds line's nick to the burst of cmd on channel (or with the same quit
+// message, for QUITS), starting the burst if there isn't one.
+func (conn *Conn) coalesce(cmd, channel string, line *Line, now time.Time) {
+	if line.Nick == "" || conn.EqualFold(line.Nick, conn.Me.Nick) {
+		return
+	}
+	key := cmd + " " + conn.Fold(channel)
+	if cmd == "QUITS" {
+		key = cmd + " " + line.Text
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if c, ok := conn.bursts[key]; ok {
+		c.nicks = append(c.nicks, line.Nick)
+		return
+	}
+	c := &coalesced{line: &Line{Cmd: cmd}, nicks: []string{line.Nick}, start: now}
+	if cmd == "QUITS" {
+		c.line.Text = line.Text
+	} else {
+		c.line.Args = []string{channel}
+	}
+	conn.bursts[key] = c
+}
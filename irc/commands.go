@@ -3,45 +3,107 @@ package irc
 // this file contains the various commands you can
 // send to the server using an Conn connection
 
-
 // This could be a lot less ugly with the ability to manipulate
 // the symbol table and add methods/functions on the fly
 // [ CMD, FMT, FMTARGS ] etc.
 
-// Raw() sends a raw line to the server, should really only be used for 
+import "strings"
+
+// Raw() sends a raw line to the server, should really only be used for
 // debugging purposes but may well come in handy.
-func (conn *Conn) Raw(rawline string) { conn.out <- rawline }
+func (conn *Conn) Raw(rawline string) { conn.write(rawline) }
 
 // Pass() sends a PASS command to the server
-func (conn *Conn) Pass(password string) { conn.out <- "PASS "+password }
+func (conn *Conn) Pass(password string) {
+	conn.AddSecret(password)
+	conn.writeMessage(NewMessage("PASS", password))
+}
 
-// Nick() sends a NICK command to the server
-func (conn *Conn) Nick(nick string) { conn.out <- "NICK "+nick }
+// Nick() sends a NICK command to the server. If nick is longer than the
+// server's NICKLEN, it returns a *LimitError without sending anything, see
+// conn.TruncateToLimits.
+func (conn *Conn) Nick(nick string) error {
+	nick, err := conn.fitLimit("NICK", "NICKLEN", nick)
+	if err != nil {
+		return err
+	}
+	conn.writeMessage(NewMessage("NICK", nick))
+	return nil
+}
 
 // User() sends a USER command to the server
 func (conn *Conn) User(ident, name string) {
-	conn.out <- "USER "+ident+" 12 * :"+name
+	conn.writeMessage(NewMessage("USER", ident, "12", "*").WithText(name))
+}
+
+// Cap() sends a CAP subcommand to the server, e.g. Cap("REQ", ":sasl")
+func (conn *Conn) Cap(subcmd string, args string) {
+	conn.writeMessage(NewMessage("CAP", subcmd).withRaw(args))
 }
 
 // Join() sends a JOIN command to the server
-func (conn *Conn) Join(channel string) { conn.out <- "JOIN "+channel }
+func (conn *Conn) Join(channel string) { conn.JoinKey(channel, "") }
+
+// JoinKey() sends a JOIN command for a channel with a key (+k) set. channel
+// and key can be comma-separated lists, as in the JOIN command itself. For
+// any channel we can tell we'd fail to join, a "JOINERROR" event is
+// dispatched instead; see the handlers for this in handlers.go.
+func (conn *Conn) JoinKey(channel, key string) {
+	// "JOIN 0" leaves all our channels, rather than joining one
+	if channel == "0" {
+		conn.writeMessage(NewMessage("JOIN", channel))
+		return
+	}
+	var chans, keys []string
+	allKeys := strings.Split(key, ",")
+	for i, c := range strings.Split(channel, ",") {
+		if reason := conn.cantJoin(c); reason != "" {
+			conn.dispatchEvent(&Line{Cmd: "JOINERROR", Args: []string{c, reason}})
+			continue
+		}
+		chans = append(chans, c)
+		if i < len(allKeys) {
+			keys = append(keys, allKeys[i])
+		}
+	}
+	if len(chans) == 0 {
+		return
+	}
+	m := NewMessage("JOIN", strings.Join(chans, ","))
+	if key = strings.TrimRight(strings.Join(keys, ","), ","); key != "" {
+		for _, k := range keys {
+			if k != "" {
+				conn.AddSecret(k)
+			}
+		}
+		m.Args = append(m.Args, key)
+	}
+	conn.writeMessage(m)
+}
 
 // Part() sends a PART command to the server with an optional part message
 func (conn *Conn) Part(channel string, message string) {
-	msg := message
-	if msg != "" {
-		msg = " :" + msg
+	m := NewMessage("PART", channel)
+	if message != "" {
+		m.WithText(message)
 	}
-	conn.out <- "PART "+channel+msg
+	conn.writeMessage(m)
 }
 
-// Kick() sends a KICK command to remove a nick from a channel
-func (conn *Conn) Kick(channel, nick string, message string) {
-	msg := message
-	if msg != "" {
-		msg = " :" + msg
+// Kick() sends a KICK command to remove a nick from a channel. If message is
+// longer than the server's KICKLEN, it returns a *LimitError without sending
+// anything, see conn.TruncateToLimits.
+func (conn *Conn) Kick(channel, nick string, message string) error {
+	message, err := conn.fitLimit("KICK", "KICKLEN", message)
+	if err != nil {
+		return err
 	}
-	conn.out <- "KICK "+channel+" "+nick+msg
+	m := NewMessage("KICK", channel, nick)
+	if message != "" {
+		m.WithText(message)
+	}
+	conn.writeMessage(m)
+	return nil
 }
 
 // Quit() sends a QUIT command to the server with an optional quit message
@@ -50,24 +112,72 @@ func (conn *Conn) Quit(message string) {
 	if msg == "" {
 		msg = "GoBye!"
 	}
-	conn.out <- "QUIT :"+msg
+	conn.writeMessage(NewMessage("QUIT").WithText(msg))
 }
 
 // Whois() sends a WHOIS command to the server
-func (conn *Conn) Whois(nick string) { conn.out <- "WHOIS "+nick }
+func (conn *Conn) Whois(nick string) { conn.writeMessage(NewMessage("WHOIS", nick)) }
 
-//Who() sends a WHO command to the server
-func (conn *Conn) Who(nick string) { conn.out <- "WHO "+nick }
+// Who() sends a WHO command to the server
+func (conn *Conn) Who(nick string) { conn.writeMessage(NewMessage("WHO", nick)) }
 
 // Privmsg() sends a PRIVMSG to the target t
-func (conn *Conn) Privmsg(t, msg string) { conn.out <- "PRIVMSG "+t+" :"+msg }
+func (conn *Conn) Privmsg(t, msg string) {
+	conn.writeMessage(NewMessage("PRIVMSG", t).WithText(msg))
+}
+
+// TextRoom() returns how many bytes of text will fit in a cmd, like PRIVMSG
+// or NOTICE, to the target t, allowing for the nick!user@host the server
+// adds when passing it on. Use it with Wrap() to split up long messages:
+//
+//	for _, l := range Wrap(msg, conn.TextRoom("PRIVMSG", "#moo")) {
+//		conn.Privmsg("#moo", l)
+//	}
+func (conn *Conn) TextRoom(cmd, t string) int {
+	// hosts can be up to 63 bytes, and idents may get a ~ added
+	host := len(conn.Me.Host)
+	if host == 0 {
+		host = 63
+	}
+	src := len(":"+conn.Me.Nick+"!~"+conn.Me.Ident+"@") + host
+	return maxMessageLength - src - len(" "+cmd+" "+t+" :")
+}
+
+// PrivmsgTags() sends a PRIVMSG to the target t with IRCv3 message tags,
+// e.g. {"+draft/reply": msgid}. If the server hasn't acknowledged the
+// message-tags capability, the tags are left off.
+func (conn *Conn) PrivmsgTags(t, msg string, tags map[string]string) {
+	if len(tags) == 0 || !conn.HasCap("message-tags") {
+		conn.Privmsg(t, msg)
+		return
+	}
+	conn.writeMessage(NewMessage("PRIVMSG", t).WithText(msg).WithTags(tags))
+}
+
+// TagMsg() sends a TAGMSG with the client-only tags to the target t, for
+// things like typing notifications and reactions. This does nothing if the
+// server hasn't acknowledged the message-tags capability.
+func (conn *Conn) TagMsg(t string, tags map[string]string) {
+	if len(tags) == 0 || !conn.HasCap("message-tags") {
+		return
+	}
+	conn.writeMessage(NewMessage("TAGMSG", t).WithTags(tags))
+}
 
 // Notice() sends a NOTICE to the target t
-func (conn *Conn) Notice(t, msg string) { conn.out <- "NOTICE "+t+" :"+msg }
+func (conn *Conn) Notice(t, msg string) {
+	conn.writeMessage(NewMessage("NOTICE", t).WithText(msg))
+}
+
+// PrivmsgTo() sends a PRIVMSG to the Target t (a *Channel, *Nick etc.)
+func (conn *Conn) PrivmsgTo(t Target, msg string) { conn.Privmsg(t.Target(), msg) }
+
+// NoticeTo() sends a NOTICE to the Target t
+func (conn *Conn) NoticeTo(t Target, msg string) { conn.Notice(t.Target(), msg) }
 
 // Ctcp() sends a (generic) CTCP message to the target t
 // with an optional argument
-func (conn *Conn) Ctcp(t, ctcp,arg string) {
+func (conn *Conn) Ctcp(t, ctcp, arg string) {
 	msg := arg
 	if msg != "" {
 		msg = " " + msg
@@ -86,55 +196,128 @@ func (conn *Conn) CtcpReply(t, ctcp string, arg string) {
 }
 
 // Version() sends a CTCP "VERSION" to the target t
-func (conn *Conn) Version(t string) { conn.Ctcp(t, "VERSION","") }
+func (conn *Conn) Version(t string) { conn.Ctcp(t, "VERSION", "") }
 
 // Action() sends a CTCP "ACTION" to the target t
 func (conn *Conn) Action(t, msg string) { conn.Ctcp(t, "ACTION", msg) }
 
+// ActionTo() sends a CTCP "ACTION" to the Target t
+func (conn *Conn) ActionTo(t Target, msg string) { conn.Action(t.Target(), msg) }
+
 // Topic() sends a TOPIC command to the channel
-//   Topic(channel) retrieves the current channel topic (see "332" handler)
-//   Topic(channel, topic) sets the topic for the channel
-func (conn *Conn) Topic(channel string, topic string) {
-	t := topic
-	if t != "" {
-		t = " :" + t
+//
+//	Topic(channel) retrieves the current channel topic (see "332" handler)
+//	Topic(channel, topic) sets the topic for the channel
+//
+// If topic is longer than the server's TOPICLEN, it returns a *LimitError
+// without sending anything, see conn.TruncateToLimits.
+func (conn *Conn) Topic(channel string, topic string) error {
+	topic, err := conn.fitLimit("TOPIC", "TOPICLEN", topic)
+	if err != nil {
+		return err
+	}
+	m := NewMessage("TOPIC", channel)
+	if topic != "" {
+		m.WithText(topic)
 	}
-	conn.out <- "TOPIC "+channel+t
+	conn.writeMessage(m)
+	return nil
 }
 
 // Mode() sends a MODE command to the server. This one can get complicated if
 // we try to be too clever, so it's deliberately simple:
-//   Mode(t) retrieves the user or channel modes for target t
-//   Mode(t, "modestring") sets user or channel modes for target t, where...
-//     modestring == e.g. "+o <nick>" or "+ntk <key>" or "-is"
+//
+//	Mode(t) retrieves the user or channel modes for target t
+//	Mode(t, "modestring") sets user or channel modes for target t, where...
+//	  modestring == e.g. "+o <nick>" or "+ntk <key>" or "-is"
+//
 // This means you'll need to do your own mode work. It may be linked in with
 // the state tracking and ChanMode/NickMode/ChanPrivs objects later...
 func (conn *Conn) Mode(t string, modestring string) {
-	mode := modestring
-	if mode != "" {
-		mode = " " + mode
-	}
-	conn.out <- "MODE "+t+mode
+	conn.writeMessage(NewMessage("MODE", t).withRaw(modestring))
 }
 
 // Away() sends an AWAY command to the server
-//   Away() resets away status
-//   Away(message) sets away with the given message
-func (conn *Conn) Away(message string) {
-	msg := message
-	if msg != "" {
-		msg = " :"+msg
+//
+//	Away() resets away status
+//	Away(message) sets away with the given message
+//
+// The server confirms this with a "NOWAWAY" or "UNAWAY" event, after which
+// conn.Me.Away says whether we're away. If message is longer than the
+// server's AWAYLEN, it returns a *LimitError without sending anything, see
+// conn.TruncateToLimits.
+func (conn *Conn) Away(message string) error {
+	message, err := conn.fitLimit("AWAY", "AWAYLEN", message)
+	if err != nil {
+		return err
 	}
-	conn.out <- "AWAY"+msg
+	m := NewMessage("AWAY")
+	if message != "" {
+		m.WithText(message)
+	}
+	conn.writeMessage(m)
+	return nil
 }
 
+// Back() sends an AWAY command with no message, to say we're back
+func (conn *Conn) Back() { conn.Away("") }
+
 // Invite() sends an INVITE command to the server
 func (conn *Conn) Invite(nick, channel string) {
-	conn.out <- "INVITE "+nick+" "+channel
+	conn.writeMessage(NewMessage("INVITE", nick, channel))
+}
+
+// Knock() sends a KNOCK command to ask the ops of an invite-only channel for
+// an invite, with an optional message
+func (conn *Conn) Knock(channel string, message string) {
+	m := NewMessage("KNOCK", channel)
+	if message != "" {
+		m.WithText(message)
+	}
+	conn.writeMessage(m)
 }
 
 // Oper() sends an OPER command to the server
+//
+//	On success, an "OPERED" event is dispatched; on failure "OPERFAILED"
 func (conn *Conn) Oper(user, pass string) {
-	conn.out <- "OPER "+user+" "+pass
+	conn.AddSecret(pass)
+	conn.writeMessage(NewMessage("OPER", user, pass))
+}
+
+// Kill() sends a KILL command to disconnect nick from the network
+func (conn *Conn) Kill(nick, reason string) {
+	conn.writeMessage(NewMessage("KILL", nick).WithText(reason))
+}
+
+// Rehash() sends a REHASH command to make the server reload its config
+//
+//	On success, a "REHASHING" event is dispatched
+func (conn *Conn) Rehash() { conn.writeMessage(NewMessage("REHASH")) }
+
+// Wallops() sends a WALLOPS message to all users with user mode +w
+func (conn *Conn) Wallops(msg string) {
+	conn.writeMessage(NewMessage("WALLOPS").WithText(msg))
+}
+
+// Globops() sends a GLOBOPS message to all IRC operators
+func (conn *Conn) Globops(msg string) {
+	conn.writeMessage(NewMessage("GLOBOPS").WithText(msg))
+}
+
+// Silence() sends a SILENCE command to the server, adding mask to the
+// server-side ignore list. The mask is also ignored client-side so that this
+// still works on servers that don't support SILENCE.
+func (conn *Conn) Silence(mask string) {
+	conn.setSilenced(mask, true)
+	conn.writeMessage(NewMessage("SILENCE", "+"+mask))
+}
+
+// Unsilence() sends a SILENCE command to remove mask from the ignore list
+func (conn *Conn) Unsilence(mask string) {
+	conn.setSilenced(mask, false)
+	conn.writeMessage(NewMessage("SILENCE", "-"+mask))
 }
 
+// SilenceList() asks the server for the current SILENCE list (see "271")
+func (conn *Conn) SilenceList() { conn.writeMessage(NewMessage("SILENCE")) }
@@ -2,11 +2,15 @@ package irc
 
 import (
 	"bufio"
-	"os"
-	"net"
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"net"
+	"sort"
 	"strings"
+	"sync"
 	"time"
+	"unicode/utf8"
 )
 
 // An IRC connection is represented by this struct. Once connected, any errors
@@ -17,210 +21,1039 @@ type Conn struct {
 	Me   *Nick
 
 	// I/O stuff to server
-	sock      *net.TCPConn
+	sock      net.Conn
 	io        *bufio.ReadWriter
 	in        chan *Line
-	out       chan string
+	out       *sendQueue
 	connected bool
+	inline    bool
+	announced bool
+	done      chan bool
+
+	// Called with every line received, in order, see bouncer.go
+	tap func(*Line)
 
 	// Error channel to transmit any fail back to the user
-	Err chan os.Error
+	Err chan error
+
+	// Set this to true to connect using SSL, optionally with SSLConfig. If
+	// SSLConfig doesn't give a ServerName, the host we connect to is used.
+	SSL       bool
+	SSLConfig *tls.Config
+
+	// How long to wait after starting to connect to one of the host's
+	// addresses before also trying the next. See dial().
+	DialStagger time.Duration
+
+	// Where to save IRCv3 STS policies between runs, see sts.go. The
+	// policies themselves are guarded by mu.
+	STSFile   string
+	sts       map[string]*STSPolicy
+	stsLoaded bool
+
+	// Whether the connection we're on uses SSL, which it can without
+	// conn.SSL being set if an STS policy told us to
+	secure bool
 
 	// Set this to true to disable flood protection and false to re-enable
-	Flood bool;
+	Flood bool
+
+	// Set this to true to only print what would be sent once we're connected,
+	// apart from the commands in DryRunAllowed and MODE queries, which keep
+	// the connection going and let state tracking work as normal
+	DryRun bool
+
+	// Replies to CTCP requests, by CTCP type. New() sets up "VERSION" and
+	// "SOURCE"; change them, delete them or add others like "USERINFO" as you
+	// see fit. CTCP PINGs are always answered, unless NoCtcpReplies is true,
+	// which turns off all automatic CTCP replies.
+	CtcpReplies   map[string]string
+	NoCtcpReplies bool
+
+	// Limits on CTCP requests, so we can't be used to flood anyone. Hosts
+	// that send more than CtcpLimit in a minute are ignored for CtcpCooldown,
+	// and no more than CtcpGlobalLimit automatic replies are sent a minute in
+	// total. If more than CtcpSweep hosts send them in a minute, automatic
+	// replies stop for CtcpCooldown. Zero turns a limit off. See
+	// ctcpflood.go.
+	CtcpLimit       int
+	CtcpGlobalLimit int
+	CtcpSweep       int
+	CtcpCooldown    time.Duration
+	ctcps           map[string]*ctcpCount
+	ctcpPruned      time.Time
+	ctcpReplies     ctcpCount
+	ctcpQuiet       time.Time
+
+	// Set this to true to join channels we're INVITEd to. If InviteMasks is
+	// not empty, only invites from a nick!user@host matching one of the masks
+	// will be followed.
+	AutoJoinInvites bool
+	InviteMasks     []string
+
+	// Which channels we'll join, e.g. when invited. If JoinMasks is not
+	// empty, only channels matching one of them can be joined, and channels
+	// matching one of NoJoinMasks never can be. MaxChannels, if not zero,
+	// limits how many we'll be on at once. Joins refused by these give a
+	// "JOINERROR" event with "NOTALLOWED" or "TOOMANY" as the reason.
+	JoinMasks   []string
+	NoJoinMasks []string
+	MaxChannels int
 
-	// Event handler mapping
-	events map[string][]func(*Conn, *Line)
+	// Nicks, topics, kick messages and away messages longer than the
+	// server's NICKLEN, TOPICLEN, KICKLEN or AWAYLEN aren't sent, and
+	// Nick(), Topic(), Kick() and Away() return a *LimitError instead. Set
+	// this to true to cut them short and send them anyway. See limits.go.
+	TruncateToLimits bool
+
+	// Set this to true to join channels again when the server tells us we're
+	// not on them when we thought we were. See desync.go.
+	RejoinDesynced bool
+	resyncs        map[string][]string
+
+	// Set this to true to tell a channel's ops when someone KNOCKs on it, if
+	// we're one of them. See the "KNOCK" event.
+	RelayKnocks bool
+
+	// IRCv3 capabilities: the ones we want, the ones the server offers (with
+	// their values, if any) and the ones the server has acknowledged.
+	capsWanted map[string]bool
+	capsAvail  map[string]string
+	caps       map[string]bool
+
+	// Lines with a msgid we've seen in the last DedupWindow are not
+	// dispatched again, e.g. when a bouncer replays them on reattach.
+	DedupWindow time.Duration
+	msgids      map[string]time.Time
+	pruned      time.Time
+
+	// Things that shouldn't be in debug output, see AddSecret()
+	secrets  []string
+	redactor *strings.Replacer
+
+	// Event handler mapping, and counts of handlers that took too long
+	events map[string][]*handler
+	slow   map[string]int
+
+	// Lines sent to the server are queued up to SendQueue deep, after which
+	// SendOverflow decides whether to block the caller, drop the new line or
+	// drop the oldest line queued for the busiest target; messages to each
+	// target are sent in turn. A write that takes longer than WriteTimeout (30
+	// seconds by default, 0 for none) disconnects us. See write() and
+	// queue.go. NOTE: with OverflowBlock, the default, Privmsg() and friends
+	// block while the queue is full, for as long as it takes the server to
+	// accept a line or WriteTimeout to disconnect us. Use TrySend() or
+	// SendContext(), or another SendOverflow, where that matters.
+	SendQueue    int
+	SendOverflow Overflow
+	WriteTimeout time.Duration
+
+	// Set Workers to run event handlers on a fixed pool of goroutines rather
+	// than one per handler. Lines for the same channel or nick always go to
+	// the same worker, so their handlers run in the order the lines arrived.
+	// Each worker queues up to QueueSize lines, after which Overflow decides
+	// what happens. These must be set before Connect(). NOTE: with
+	// OverflowBlock, handlers that dispatch further events can deadlock if
+	// they fill up their own worker's queue.
+	Workers   int
+	QueueSize int
+	Overflow  Overflow
+	workers   []chan *job
+
+	// If handlers finish with a line more than SlowDispatch after it was
+	// read, a "SLOWDISPATCH" event is triggered. See instrument.go.
+	SlowDispatch time.Duration
+	slowWarned   time.Time
+	latency      time.Duration
 
 	// Map of channels we're on
 	chans map[string]*Channel
 
+	// How long to wait between sending the queries that find out about each
+	// channel we join, so joining lots at once doesn't flood us off. Zero
+	// sends them straight away. This must be set before Connect(), see sync.go
+	SyncDelay time.Duration
+	syncq     []*Channel
+
+	// If set, the Text of PRIVMSGs, NOTICEs and ACTIONs is passed through
+	// Sanitize before being dispatched, with the original kept in RawText,
+	// so handlers don't have to cope with people hiding things in control
+	// characters and the like. See SanitizeText() and sanitize.go.
+	Sanitize func(string) string
+
+	// Set this to have bursts of JOINs, PARTs and QUITs grouped together
+	// into "JOINS", "PARTS" and "QUITS" events too. See coalesce.go.
+	CoalesceWindow time.Duration
+	bursts         map[string]*coalesced
+
+	// Where to write everything sent and received, see Record()
+	recorder *Recorder
+
+	// Why the server last disconnected us, see disconnect.go
+	disconnect *DisconnectReason
+
+	// Receivers of ChannelChanges(), see changes.go
+	watchers []*watcher
+
+	// Set IdleTimeout to be told about channels nobody has said anything in
+	// for that long with an "IDLECHANNEL" event, and IdlePart as well to
+	// leave them. See idle.go.
+	IdleTimeout time.Duration
+	IdlePart    bool
+	idleChecked time.Time
+
 	// Map of nicks we know about
 	nicks map[string]*Nick
+
+	// Guards nicks and chans, and the Nicks, Channels and list modes of the
+	// nicks and channels in them, which the state tracking handlers change
+	// while other goroutines may be reading them. See nickchan.go.
+	state sync.RWMutex
+
+	// Network services helpers, see services.go
+	Services *Services
+
+	// Tokens from the server's 005 messages, see ISupport()
+	isupport   map[string]string
+	isupportMu sync.RWMutex
+
+	// Map of masks we're ignoring, see Silence(). Guarded by mu.
+	silence map[string]bool
+
+	// Open IRCv3 batches, and callers waiting for chathistory, see batch.go
+	batches map[string]*batch
+	history map[string][]chan []*Line
+
+	// Messages waiting for the server to confirm delivery, see delivery.go
+	pending map[string][]*pending
+
+	// Callers waiting for the response to labeled commands, see labels.go
+	labels map[string]func([]*Line, error)
+	label  int
+
+	// Callers waiting for ISON, USERHOST and WHOWAS replies, see query.go
+	ison     []chan []string
+	userhost []chan []*UserHostReply
+	whowas   map[string][]*whowas
+	mu       sync.Mutex
 }
 
+// What to do when a queue is full
+type Overflow int
+
+const (
+	// Wait for there to be space in the queue, however long that takes
+	OverflowBlock Overflow = iota
+	// Throw the new item away, and send an error down conn.Err
+	OverflowDrop
+	// Throw the oldest item in the queue away to make room for the new one.
+	// The send queue never throws away lines that aren't messages, like
+	// PONGs, and waits for space if that's all it holds.
+	OverflowDropOldest
+)
+
 // We parse an incoming line into this struct. Line.Cmd is used as the trigger
 // name for incoming event handlers, see *Conn.recv() for details.
-//   Raw =~ ":nick!user@host cmd args[] :text"
-//   Src == "nick!user@host"
-//   Cmd == e.g. PRIVMSG, 332
+//
+//	Raw =~ "@tags :nick!user@host cmd args[] :text"
+//	Src == "nick!user@host"
+//	Cmd == e.g. PRIVMSG, 332
+//
+// Tags are only sent by servers supporting the IRCv3 message-tags capability.
+// MsgId is the line's "msgid" tag, if the server gave it one. If Text has
+// been cleaned up by Conn.Sanitize, RawText is what it was before.
 type Line struct {
 	Nick, Ident, Host, Src string
 	Cmd, Text, Raw         string
 	Args                   []string
+	Tags                   map[string]string
+	MsgId                  string
+	RawText                string
+	read                   time.Time
+
+	// whether there was a trailing parameter, even an empty one, so that
+	// e.g. "TOPIC #moo :" clearing the topic isn't taken for a query
+	trailing bool
 }
 
 // Creates a new IRC connection object, but doesn't connect to anything so
 // that you can add event handlers to it. See AddHandler() for details.
 func New(nick, user, name string) *Conn {
 	conn := new(Conn)
+	conn.capsWanted = make(map[string]bool)
+	conn.slow = make(map[string]int)
+	conn.msgids = make(map[string]time.Time)
+	conn.DedupWindow = 15 * time.Minute
+	conn.QueueSize = 32
+	conn.SendQueue = 32
+	conn.WriteTimeout = 30 * time.Second
+	conn.DialStagger = 250 * time.Millisecond
+	conn.SyncDelay = 2 * time.Second
+	conn.SlowDispatch = 10 * time.Second
+	conn.CtcpReplies = map[string]string{
+		"VERSION": "powered by goirc...",
+		"SOURCE":  "https://github.com/jessta/goirc",
+	}
+	conn.CtcpLimit = 5
+	conn.CtcpGlobalLimit = 20
+	conn.CtcpSweep = 10
+	conn.CtcpCooldown = 5 * time.Minute
 	conn.initialise()
-	conn.Me = conn.NewNick(nick, user, name, "")
+	conn.Me = conn.newNick(nick, user, name, "")
 	conn.setupEvents()
+	conn.setupServices()
+	conn.setupSTS()
+	conn.setupQueries()
+	conn.setupDelivery()
+	conn.setupLabels()
+	conn.setupSync()
+	conn.setupDesync()
+	conn.setupSnomasks()
 	return conn
 }
 
 func (conn *Conn) initialise() {
 	// allocate meh some memoraaaahh
+	conn.state.Lock()
 	conn.nicks = make(map[string]*Nick)
 	conn.chans = make(map[string]*Channel)
+	conn.state.Unlock()
+	conn.isupportMu.Lock()
+	conn.isupport = make(map[string]string)
+	conn.isupportMu.Unlock()
+	conn.batches = make(map[string]*batch)
+	conn.history = make(map[string][]chan []*Line)
+	conn.pending = make(map[string][]*pending)
+	conn.resyncs = make(map[string][]string)
+	conn.ctcps = make(map[string]*ctcpCount)
+	conn.ctcpReplies = ctcpCount{}
+	conn.ctcpQuiet = time.Time{}
+	conn.labels = make(map[string]func([]*Line, error))
+	conn.ison = nil
+	conn.userhost = nil
+	conn.whowas = make(map[string][]*whowas)
+	conn.capsAvail = make(map[string]string)
+	conn.caps = make(map[string]bool)
 	conn.in = make(chan *Line, 32)
-	conn.out = make(chan string, 32)
-	conn.Err = make(chan os.Error, 4)
+	conn.out = newSendQueue()
+	conn.Err = make(chan error, 4)
+	conn.announced = false
+	conn.mu.Lock()
 	conn.io = nil
 	conn.sock = nil
+	conn.silence = make(map[string]bool)
+	conn.bursts = make(map[string]*coalesced)
+	conn.done = make(chan bool)
+	conn.syncq = nil
+	conn.mu.Unlock()
 
 	// if this is being called because we are reconnecting, conn.Me
 	// will still have all the old channels referenced -- nuke them!
 	if conn.Me != nil {
-		conn.Me = conn.NewNick(conn.Me.Nick, conn.Me.Ident, conn.Me.Name, "")
+		conn.Me = conn.newNick(conn.Me.Nick, conn.Me.Ident, conn.Me.Name, "")
 	}
 }
 
 // Connect the IRC connection object to "host[:port]" which should be either
-// a hostname or an IP address, with an optional port defaulting to 6667.
-// You can also provide an optional connect password.
-func (conn *Conn) Connect(host string, pass string) os.Error {
+// a hostname or an IP address, with an optional port defaulting to 6667, or
+// 6697 if conn.SSL is true. You can also provide an optional connect password.
+//
+// If we have a valid STS policy for the host, we'll connect using SSL on the
+// port it gives regardless of conn.SSL or the port you ask for.
+func (conn *Conn) Connect(host string, pass string) error {
 	if conn.connected {
-		return os.NewError(fmt.Sprintf("irc.Connect(): already connected to %s, cannot connect to %s", conn.Host, host))
+		return fmt.Errorf("irc.Connect(): already connected to %s, cannot connect to %s", conn.Host, host)
+	}
+	conn.mu.Lock()
+	conn.disconnect = nil
+	conn.mu.Unlock()
+	ssl := conn.SSL
+	h, _ := splitHost(host)
+	if p := conn.stsPolicy(h); p != nil {
+		ssl = true
+		host = h + ":" + p.Port
 	}
 	if !hasPort(host) {
-		host += ":6667"
+		if ssl {
+			host += ":6697"
+		} else {
+			host += ":6667"
+		}
 	}
 
-	if addr, err := net.ResolveTCPAddr(host); err != nil {
-		return err
-	} else if conn.sock, err = net.DialTCP("tcp", nil, addr); err != nil {
+	tcp, err := conn.dial(host)
+	if err != nil {
 		return err
 	}
-	conn.Host = host
+	var sock net.Conn = tcp
+	if ssl {
+		// tls.Client() needs to know who it's talking to, to check the
+		// server's certificate
+		config := &tls.Config{}
+		if conn.SSLConfig != nil {
+			config = conn.SSLConfig.Clone()
+		}
+		if config.ServerName == "" {
+			config.ServerName, _ = splitHost(host)
+		}
+		s := tls.Client(tcp, config)
+		if err = s.Handshake(); err != nil {
+			tcp.Close()
+			return err
+		}
+		sock = s
+	}
+	conn.Host, conn.secure = host, ssl
 
-	conn.io = bufio.NewReadWriter(
-		bufio.NewReader(conn.sock),
-		bufio.NewWriter(conn.sock))
-	go conn.send()
-	go conn.recv()
+	rw := bufio.NewReadWriter(bufio.NewReader(sock), bufio.NewWriter(sock))
+	conn.mu.Lock()
+	conn.sock, conn.io = sock, rw
+	conn.mu.Unlock()
+	in := conn.in
+	go conn.send(sock, rw.Writer)
+	go conn.recv(sock, rw.Reader)
+	if conn.SyncDelay > 0 {
+		go conn.syncLoop(conn.Disconnected())
+	}
+	if conn.Workers > 0 {
+		conn.workers = make([]chan *job, conn.Workers)
+		for i := 0; i < conn.Workers; i++ {
+			conn.workers[i] = make(chan *job, conn.QueueSize)
+			go conn.worker(conn.workers[i])
+		}
+	}
 
 	// see getStringMsg() in commands.go for what this does
 	if pass != "" {
 		conn.Pass(pass)
 	}
+	// servers that support IRCv3 capabilities will hold registration until we
+	// send CAP END, see the "CAP" handler. Those that don't will ignore this.
+	conn.Cap("LS", "302")
 	conn.Nick(conn.Me.Nick)
 	conn.User(conn.Me.Ident, conn.Me.Name)
 
-	go conn.runLoop()
+	go conn.runLoop(in)
 	return nil
 }
 
-// dispatch a nicely formatted os.Error to the error channel
-func (conn *Conn) error(s string, a ...interface{}) { conn.Err <- os.NewError(fmt.Sprintf(s, a)) }
+// Returns the value of the token from the server's 005 (RPL_ISUPPORT)
+// messages, and whether the server sent it at all.
+func (conn *Conn) ISupport(token string) (string, bool) {
+	conn.isupportMu.RLock()
+	defer conn.isupportMu.RUnlock()
+	v, ok := conn.isupport[token]
+	return v, ok
+}
+
+// Returns true if name is a channel name, going by the server's CHANTYPES
+func (conn *Conn) IsChannel(name string) bool {
+	chantypes, ok := conn.ISupport("CHANTYPES")
+	if !ok {
+		chantypes = "#&"
+	}
+	return len(name) > 0 && strings.IndexRune(chantypes, rune(name[0])) != -1
+}
+
+// Asks for the IRCv3 capability cap to be requested when connecting. This
+// must be called before Connect() to have any effect.
+func (conn *Conn) RequestCap(cap string) { conn.capsWanted[cap] = true }
+
+// Returns true if the server has acknowledged the IRCv3 capability cap.
+func (conn *Conn) HasCap(cap string) bool {
+	_, ok := conn.caps[cap]
+	return ok
+}
+
+// Dials "host:port", trying every address the host resolves to. Rather than
+// waiting for each attempt to fail before trying the next address, attempts
+// are started conn.DialStagger apart and the first to succeed wins. This stops
+// us getting stuck on e.g. unreachable IPv6 addresses ("happy eyeballs").
+func (conn *Conn) dial(host string) (*net.TCPConn, error) {
+	h, port := splitHost(host)
+	addrs, err := net.LookupHost(h)
+	if err != nil {
+		return nil, err
+	}
+
+	type attempt struct {
+		sock *net.TCPConn
+		err  error
+	}
+	results := make(chan *attempt, len(addrs))
+	done := make(chan bool)
+	for i, a := range addrs {
+		go func(i int, a string) {
+			if i > 0 {
+				select {
+				case <-done:
+					results <- &attempt{nil, errors.New("not needed")}
+					return
+				case <-time.After(time.Duration(i) * conn.DialStagger):
+				}
+			}
+			if strings.Index(a, ":") != -1 {
+				a = "[" + a + "]"
+			}
+			addr, err := net.ResolveTCPAddr("tcp", a+":"+port)
+			if err != nil {
+				results <- &attempt{nil, err}
+				return
+			}
+			sock, err := net.DialTCP("tcp", nil, addr)
+			results <- &attempt{sock, err}
+		}(i, a)
+	}
+
+	for i := 0; i < len(addrs); i++ {
+		r := <-results
+		if r.err != nil {
+			err = r.err
+			continue
+		}
+		// we have a winner, so call off any attempts that haven't started
+		// and close any that succeed after this one
+		close(done)
+		go func(n int) {
+			for ; n > 0; n-- {
+				if r := <-results; r.sock != nil {
+					r.sock.Close()
+				}
+			}
+		}(len(addrs) - i - 1)
+		return r.sock, nil
+	}
+	if err == nil {
+		err = fmt.Errorf("irc.dial(): no addresses found for %s", h)
+	}
+	return nil, err
+}
+
+// dispatch a nicely formatted error to the error channel
+func (conn *Conn) error(s string, a ...interface{}) {
+	conn.Err <- errors.New(conn.redact(fmt.Sprintf(s, a...)))
+}
+
+// returns true if we've dispatched a line with msgid recently. Called from
+// dispatchEvent(), which handlers also call for the events they trigger, so
+// this holds conn.mu.
+func (conn *Conn) duplicate(msgid string) bool {
+	now := time.Now()
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if now.Sub(conn.pruned) > conn.DedupWindow {
+		for id, t := range conn.msgids {
+			if now.Sub(t) > conn.DedupWindow {
+				delete(conn.msgids, id)
+			}
+		}
+		conn.pruned = now
+	}
+	if t, ok := conn.msgids[msgid]; ok && now.Sub(t) <= conn.DedupWindow {
+		return true
+	}
+	conn.msgids[msgid] = now
+	return false
+}
+
+// AddSecret() registers a string that should never appear in our debug output
+// or errors, like an API key. Passwords and channel keys given to the Conn's
+// own methods are added automatically.
+func (conn *Conn) AddSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for _, s := range conn.secrets {
+		if s == secret {
+			return
+		}
+	}
+	conn.secrets = append(conn.secrets, secret)
+	r := make([]string, 0, 2*len(conn.secrets))
+	for _, s := range conn.secrets {
+		r = append(r, s, "*****")
+	}
+	conn.redactor = strings.NewReplacer(r...)
+}
+
+// masks any secrets in s, see AddSecret()
+func (conn *Conn) redact(s string) string {
+	conn.mu.Lock()
+	r := conn.redactor
+	conn.mu.Unlock()
+	if r == nil {
+		return s
+	}
+	return r.Replace(s)
+}
 
 // copied from http.client for great justice
 func hasPort(s string) bool { return strings.LastIndex(s, ":") > strings.LastIndex(s, "]") }
 
+// returns true if src (nick!user@host) matches a mask we've silenced
+func (conn *Conn) silenced(src string) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for mask := range conn.silence {
+		if matchMask(conn.Fold(mask), conn.Fold(src)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Adds mask to or removes it from the masks we're ignoring client-side
+func (conn *Conn) setSilenced(mask string, on bool) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if on {
+		conn.silence[mask] = true
+	} else {
+		delete(conn.silence, mask)
+	}
+}
+
+// glob-style matching of IRC masks: '*' matches any number of characters
+// and '?' matches exactly one.
+func matchMask(mask, s string) bool {
+	for len(mask) > 0 {
+		switch mask[0] {
+		case '*':
+			for i := len(s); i >= 0; i-- {
+				if matchMask(mask[1:], s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		default:
+			if len(s) == 0 || mask[0] != s[0] {
+				return false
+			}
+		}
+		mask, s = mask[1:], s[1:]
+	}
+	return len(s) == 0
+}
+
+// queue a line to be sent to the server by send(), so that callers don't have
+// to wait for flood protection or the network. Messages to each target are
+// queued separately, see queue.go. What happens when the queue is full
+// depends on conn.SendOverflow.
+func (conn *Conn) write(line string) {
+	if !conn.out.push(conn.lineTarget(line), line, conn.SendQueue, conn.SendOverflow) &&
+		conn.SendOverflow == OverflowDrop {
+		// the whole point of dropping lines is not to block, so don't
+		// wait for someone to read conn.Err either
+		select {
+		case conn.Err <- errors.New(conn.redact("irc.write(): send queue full, dropping line: " + line)):
+		default:
+		}
+	}
+}
+
+// Commands that are still sent when conn.DryRun is true. QUIT is, so that we
+// can still disconnect cleanly, and NICK, so that we can get a nick the
+// server will accept when ours is in use.
+var DryRunAllowed = map[string]bool{
+	"PONG":  true,
+	"CAP":   true,
+	"JOIN":  true,
+	"NICK":  true,
+	"QUIT":  true,
+	"WHO":   true,
+	"WHOIS": true,
+}
+
+func dryRunAllowed(line string) bool {
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return false
+	}
+	if DryRunAllowed[strings.ToUpper(f[0])] {
+		return true
+	}
+	// MODE with only a target asks for modes rather than changing them, as
+	// does asking for a list mode without a mask, like "MODE #moo +b"
+	if strings.ToUpper(f[0]) != "MODE" {
+		return false
+	}
+	return len(f) == 2 || (len(f) == 3 && len(strings.TrimPrefix(f[2], "+")) == 1 &&
+		strings.Contains("beIq", strings.TrimPrefix(f[2], "+")))
+}
+
 // dispatch input from channel as \r\n terminated line to peer
-// flood controlled using hybrid's algorithm if conn.Flood is true
-func (conn *Conn) send() {
-	lastsent := time.Nanoseconds()
-	var badness, linetime, second int64 = 0, 0, 1000000000;
-	for line := range conn.out {
+// flood controlled using hybrid's algorithm if conn.Flood is true. sock and w
+// are the connection this was started for, so that nothing queued for it
+// gets written to the next one.
+func (conn *Conn) send(sock net.Conn, w *bufio.Writer) {
+	lastsent := time.Now()
+	var badness, linetime time.Duration
+	// conn.out is replaced when we disconnect, so hang on to this one
+	out := conn.out
+	for {
+		line, ok := out.pop()
+		if !ok {
+			break
+		}
+		if conn.DryRun && conn.connected && !dryRunAllowed(line) {
+			fmt.Println("-> (dry run) " + conn.redact(line))
+			continue
+		}
 		// Hybrid's algorithm allows for 2 seconds per line and an additional
 		// 1/120 of a second per character on that line.
-		linetime = 2*second + int64(len(line))*second/120
+		linetime = 2*time.Second + time.Duration(len(line))*time.Second/120
 		if !conn.Flood && conn.connected {
 			// No point in tallying up flood protection stuff until connected
-			if badness += linetime + lastsent - time.Nanoseconds(); badness < 0 {
+			if badness += linetime + lastsent.Sub(time.Now()); badness < 0 {
 				// negative badness times are badness...
-				badness = int64(0)
+				badness = 0
 			}
 		}
-		lastsent = time.Nanoseconds()
+		lastsent = time.Now()
 
 		// If we've sent more than 10 second's worth of lines according to the
 		// calculation above, then we're at risk of "Excess Flood".
-		if badness > 10*second && !conn.Flood {
+		if badness > 10*time.Second && !conn.Flood {
 			// so sleep for the current line's time value before sending it
 			time.Sleep(linetime)
 		}
-		if _,err := conn.io.WriteString(line + "\r\n"); err != nil {
-			conn.error("irc.send(): %s", err.String())
-			conn.shutdown()
+		if conn.WriteTimeout > 0 {
+			sock.SetWriteDeadline(time.Now().Add(conn.WriteTimeout))
+		}
+		if _, err := w.WriteString(line + "\r\n"); err != nil {
+			conn.shutdown(sock, "irc.send(): %s", err.Error())
 			break
 		}
-		conn.io.Flush()
-		fmt.Println("-> " + line)
+		w.Flush()
+		fmt.Println("-> " + conn.redact(line))
+		conn.record("->", line)
 	}
 }
 
-// receive one \r\n terminated line from peer, parse and dispatch it
-func (conn *Conn) recv() {
+// The longest line we'll accept from the server: up to 8191 bytes of IRCv3
+// message tags, plus the 512 bytes RFC1459 allows for everything else.
+const maxLineLength = 8191 + 512
+
+// receive one \r\n terminated line from peer, parse and dispatch it. Once
+// reading from sock fails, the connection is shut down and conn.in closed.
+func (conn *Conn) recv(sock net.Conn, r *bufio.Reader) {
+	// conn.in is replaced when we disconnect, and only closed here, so that
+	// send() shutting the connection down can't close it under us
+	in := conn.in
+	defer close(in)
 	for {
-		s, err := conn.io.ReadString('\n')
+		s, err := readLine(r)
 		if err != nil {
-			conn.error("irc.recv(): %s", err.String())
-			conn.shutdown()
+			conn.shutdown(sock, "irc.recv(): %s", err.Error())
 			break
 		}
-		// chop off \r\n
-		s = s[0 : len(s)-2]
-		fmt.Println("<- " + s)
-
-		line := &Line{Raw: s}
-		if s[0] == ':' {
-			// remove a source and parse it
-			if idx := strings.Index(s, " "); idx != -1 {
-				line.Src, s = s[1:idx], s[idx+1:len(s)]
-			} else {
-				// pretty sure we shouldn't get here ...
-				line.Src = s[1:len(s)]
-				conn.in <- line
-				continue
-			}
+		// chop off \r\n, or just \n from servers that don't bother with \r
+		if s = strings.TrimRight(s, "\r\n"); s == "" {
+			continue
+		}
+		fmt.Println("<- " + conn.redact(s))
+		conn.record("<-", s)
+		line := lineOrError(s)
+		line.read = time.Now()
+		conn.disconnectLine(line)
+		in <- line
+	}
+}
+
+// reads a line from the server, which may take more than one read. Lines
+// longer than maxLineLength are cut short, and make lineOrError() complain.
+func readLine(r *bufio.Reader) (string, error) {
+	var buf []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		if len(buf) <= maxLineLength {
+			buf = append(buf, b...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		return string(buf), nil
+	}
+}
+
+// Parses s, turning it into a "PARSEERROR" event with the reason in Text if
+// it's malformed, so that handlers can see what the server sent us.
+func lineOrError(s string) *Line {
+	line, err := ParseLine(s)
+	if err != nil {
+		return &Line{Cmd: "PARSEERROR", Raw: s, Text: err.Error()}
+	}
+	return line
+}
+
+// The parameter that is the message text for some commands, for servers that
+// leave the ':' off of it when it's a single word.
+var textParam = map[string]int{
+	"PRIVMSG": 1,
+	"NOTICE":  1,
+	"TOPIC":   1,
+	"QUIT":    0,
+	"PART":    1,
+	"KICK":    2,
+	"AWAY":    0,
+	"WALLOPS": 0,
+	"302":     1,
+	"303":     1,
+	"311":     5,
+	"328":     2,
+	"332":     2,
+	"352":     7,
+	"353":     3,
+	"354":     8,
+}
 
-			// src can be the hostname of the irc server or a nick!user@host
-			line.Host = line.Src
-			nidx, uidx := strings.Index(line.Src, "!"), strings.Index(line.Src, "@")
-			if uidx != -1 && nidx != -1 {
-				line.Nick = line.Src[0:nidx]
-				line.Ident = line.Src[nidx+1 : uidx]
-				line.Host = line.Src[uidx+1 : len(line.Src)]
+// ParseLine() parses a raw IRC line (without the \r\n) into a *Line, in the
+// same way as lines from the server are, e.g. for reading logs. It returns an
+// error if s is malformed. Invalid UTF-8 is replaced with U+FFFD everywhere
+// but in line.Raw.
+func ParseLine(s string) (*Line, error) {
+	line := &Line{Raw: s}
+	if len(s) > maxLineLength {
+		return nil, errors.New("irc.ParseLine(): line too long")
+	}
+	if !utf8.ValidString(s) {
+		s = strings.ToValidUTF8(s, "\uFFFD")
+	}
+	if s != "" && s[0] == '@' {
+		// IRCv3 message tags come before everything else
+		if idx := strings.Index(s, " "); idx != -1 {
+			line.Tags, s = parseTags(s[1:idx]), s[idx+1:]
+			line.MsgId = line.Tags["msgid"]
+		} else {
+			return nil, errors.New("irc.ParseLine(): no command after tags")
+		}
+	}
+	if s != "" && s[0] == ':' {
+		// remove a source and parse it
+		if idx := strings.Index(s, " "); idx != -1 {
+			line.Src, s = s[1:idx], s[idx+1:]
+		} else {
+			return nil, errors.New("irc.ParseLine(): no command after source")
+		}
+
+		// src can be the hostname of the irc server or a nick!user@host
+		line.Host = line.Src
+		nidx, uidx := strings.Index(line.Src, "!"), strings.Index(line.Src, "@")
+		if uidx != -1 && nidx != -1 && nidx < uidx {
+			line.Nick = line.Src[0:nidx]
+			line.Ident = line.Src[nidx+1 : uidx]
+			line.Host = line.Src[uidx+1 : len(line.Src)]
+		}
+	}
+
+	// now we're here, we've parsed a :nick!user@host or :server off
+	// s should contain "cmd args[] :text"
+	args := strings.SplitN(s, " :", 2)
+	if len(args) > 1 {
+		line.Text, line.trailing = args[1], true
+	}
+	// some servers (and bouncers) are sloppy with their spaces
+	for _, a := range strings.Split(args[0], " ") {
+		if a == "" {
+			continue
+		} else if line.Cmd == "" {
+			line.Cmd = strings.ToUpper(a)
+		} else {
+			line.Args = append(line.Args, a)
+		}
+	}
+	if !validCommand(line.Cmd) {
+		return nil, fmt.Errorf("irc.ParseLine(): bad command %q", line.Cmd)
+	}
+	if i, ok := textParam[line.Cmd]; ok && len(args) == 1 && len(line.Args) == i+1 {
+		line.Text, line.Args = line.Args[i], line.Args[0:i]
+		line.trailing = true
+	}
+	return line, nil
+}
+
+// String() turns line back into a raw IRC line, without the \r\n. This
+// parses to the same Line, but isn't always byte-for-byte the same as
+// line.Raw: tags are sorted, spaces are tidied up and Text, if there is any,
+// is always sent as the trailing parameter, as is an empty trailing parameter
+// if the line had one.
+func (line *Line) String() string {
+	s := ""
+	if len(line.Tags) > 0 {
+		s = "@" + formatTags(line.Tags) + " "
+	}
+	if line.Src != "" {
+		s += ":" + line.Src + " "
+	}
+	s += line.Cmd
+	for _, a := range line.Args {
+		s += " " + a
+	}
+	if line.Text != "" || line.trailing {
+		s += " :" + line.Text
+	}
+	return s
+}
+
+// commands are either letters or a three digit numeric
+func validCommand(cmd string) bool {
+	if cmd == "" {
+		return false
+	}
+	if isNumeric(cmd) {
+		return true
+	}
+	for i := 0; i < len(cmd); i++ {
+		if cmd[i] < 'A' || cmd[i] > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// Escaping of message tag values, as per the IRCv3 message-tags spec
+var tagEscapes = map[byte]byte{
+	':':  ';',
+	's':  ' ',
+	'\\': '\\',
+	'r':  '\r',
+	'n':  '\n',
+}
+
+// parse "key=value;key2" into a map, unescaping the values
+func parseTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, tag := range strings.Split(s, ";") {
+		kv := strings.SplitN(tag, "=", 2)
+		if kv[0] == "" {
+			continue
+		}
+		if len(kv) == 1 {
+			tags[kv[0]] = ""
+			continue
+		}
+		v := make([]byte, 0, len(kv[1]))
+		for i := 0; i < len(kv[1]); i++ {
+			c := kv[1][i]
+			if c == '\\' && i+1 < len(kv[1]) {
+				i++
+				if e, ok := tagEscapes[kv[1][i]]; ok {
+					c = e
+				} else {
+					c = kv[1][i]
+				}
+			} else if c == '\\' {
+				// trailing lone backslash is dropped
+				continue
 			}
+			v = append(v, c)
 		}
+		tags[kv[0]] = string(v)
+	}
+	return tags
+}
 
-		// now we're here, we've parsed a :nick!user@host or :server off
-		// s should contain "cmd args[] :text"
-		args := strings.Split(s, " :", 2)
-		if len(args) > 1 {
-			line.Text = args[1]
+// the reverse of parseTags(), without the leading '@'
+func formatTags(tags map[string]string) string {
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	t := make([]string, 0, len(tags))
+	for _, k := range keys {
+		v := tags[k]
+		if v == "" {
+			t = append(t, k)
+			continue
 		}
-		args = strings.Split(args[0], " ", -1)
-		line.Cmd = strings.ToUpper(args[0])
-		if len(args) > 1 {
-			line.Args = args[1:len(args)]
+		e := make([]byte, 0, len(v))
+		for i := 0; i < len(v); i++ {
+			switch c := v[i]; c {
+			case ';':
+				e = append(e, '\\', ':')
+			case ' ':
+				e = append(e, '\\', 's')
+			case '\\':
+				e = append(e, '\\', '\\')
+			case '\r':
+				e = append(e, '\\', 'r')
+			case '\n':
+				e = append(e, '\\', 'n')
+			default:
+				e = append(e, c)
+			}
 		}
-		conn.in <- line
+		t = append(t, k+"="+string(e))
 	}
+	return strings.Join(t, ";")
 }
 
-func (conn *Conn) runLoop() {
-	for line := range conn.in {
-			conn.dispatchEvent(line)
+func (conn *Conn) runLoop(in chan *Line) {
+	for line := range in {
+		if conn.tap != nil {
+			conn.tap(line)
+		}
+		conn.dispatchEvent(line)
+	}
+	for _, w := range conn.workers {
+		close(w)
 	}
+	conn.workers = nil
 }
 
-func (conn *Conn) shutdown() {
-	close(conn.in)
-	close(conn.out)
+// Shuts the connection on sock down, saying why down conn.Err first. Both
+// send() and recv() call this when they fail, so only the first call for a
+// connection does anything; by the second, conn.sock is nil or a new one.
+func (conn *Conn) shutdown(sock net.Conn, why string, a ...interface{}) {
+	conn.mu.Lock()
+	if sock == nil || conn.sock != sock {
+		conn.mu.Unlock()
+		return
+	}
+	conn.sock = nil
+	conn.mu.Unlock()
+	conn.error(why, a...)
+	conn.out.close()
 	close(conn.Err)
 	conn.connected = false
-	conn.sock.Close()
+	sock.Close()
+	conn.failPending()
+	conn.failLabels()
+	conn.failQueries()
+	conn.mu.Lock()
+	close(conn.done)
+	conn.mu.Unlock()
 	// reinit datastructures ready for next connection
 	// do this here rather than after runLoop()'s for due to race
 	conn.initialise()
 }
 
+// Connected() returns true if we're connected to a server and registered
+func (conn *Conn) Connected() bool {
+	return conn.connected
+}
+
+// Disconnected() returns a channel that is closed when the current connection
+// to the server is, e.g. to wait for a QUIT to take effect. If we're not
+// connected, it won't be closed until after we next connect and disconnect.
+// DisconnectReason() says why the server disconnected us, if it did.
+func (conn *Conn) Disconnected() <-chan bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.done
+}
+
 // Dumps a load of information about the current state of the connection to a
-// string for debugging state tracking and other such things. 
+// string for debugging state tracking and other such things.
 func (conn *Conn) String() string {
 	str := "GoIRC Connection\n"
 	str += "----------------\n\n"
@@ -232,12 +1065,12 @@ func (conn *Conn) String() string {
 	str += conn.Me.String() + "\n"
 	str += "GoIRC Channels\n"
 	str += "--------------\n\n"
-	for _, ch := range conn.chans {
+	for _, ch := range conn.Channels() {
 		str += ch.String() + "\n"
 	}
 	str += "GoIRC NickNames\n"
 	str += "---------------\n\n"
-	for _, n := range conn.nicks {
+	for _, n := range conn.Nicks() {
 		if n != conn.Me {
 			str += n.String() + "\n"
 		}
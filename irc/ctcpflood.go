@@ -0,0 +1,108 @@
+package irc
+
+// Here you'll find the limits on how many CTCP requests we answer, so that
+// people can't use us to flood someone else with our replies, or flood us
+// off the network by making us send too much, whether they do it on their
+// own or as part of a sweep of the whole network.
+
+import (
+	"strconv"
+	"time"
+)
+
+// How many CTCP requests someone has sent us, since when, and when we'll
+// listen to them again if they've sent too many
+type ctcpCount struct {
+	start time.Time
+	n     int
+	until time.Time
+}
+
+// Returns true if line, a CTCP request, comes from a host that has sent more
+// than conn.CtcpLimit of them in the last minute. Hosts that do this are
+// ignored for conn.CtcpCooldown, and a "CTCPFLOOD" event is triggered with
+// the nick in Args[0] when they start to be. Called from dispatchEvent() so
+// that ignored requests aren't seen by any handlers.
+func (conn *Conn) ctcpFlooding(line *Line) bool {
+	if (conn.CtcpLimit <= 0 && conn.CtcpSweep <= 0) || line.Nick == "" {
+		return false
+	}
+	now := time.Now()
+	conn.mu.Lock()
+	if now.Sub(conn.ctcpPruned) > time.Minute+conn.CtcpCooldown {
+		for host, c := range conn.ctcps {
+			if now.Sub(c.start) > time.Minute && now.After(c.until) {
+				delete(conn.ctcps, host)
+			}
+		}
+		conn.ctcpPruned = now
+	}
+	c, ok := conn.ctcps[line.Host]
+	if !ok {
+		c = &ctcpCount{start: now}
+		conn.ctcps[line.Host] = c
+	} else if now.Sub(c.start) > time.Minute {
+		c.start, c.n = now, 0
+	}
+	if now.Before(c.until) {
+		conn.mu.Unlock()
+		return true
+	}
+	c.n++
+	flooding := conn.CtcpLimit > 0 && c.n > conn.CtcpLimit
+	if flooding {
+		c.until = now.Add(conn.CtcpCooldown)
+	}
+	sweep := conn.ctcpSweep(now)
+	conn.mu.Unlock()
+	if flooding {
+		conn.dispatchEvent(&Line{Cmd: "CTCPFLOOD", Nick: line.Nick, Ident: line.Ident,
+			Host: line.Host, Src: line.Src, Args: []string{line.Nick}})
+	}
+	if sweep > 0 {
+		conn.dispatchEvent(&Line{Cmd: "CTCPSWEEP", Args: []string{strconv.Itoa(sweep)}})
+	}
+	return flooding
+}
+
+// Works out whether we're being swept with CTCPs, like VERSION requests sent
+// to everyone on a network after a netsplit, by more than conn.CtcpSweep
+// hosts in the last minute. If so, automatic replies are turned off for
+// conn.CtcpCooldown, and the number of hosts is returned so that a
+// "CTCPSWEEP" event can be triggered with it in Args[0]. conn.mu must be held.
+func (conn *Conn) ctcpSweep(now time.Time) int {
+	if conn.CtcpSweep <= 0 || now.Before(conn.ctcpQuiet) {
+		return 0
+	}
+	n := 0
+	for _, c := range conn.ctcps {
+		if now.Sub(c.start) <= time.Minute {
+			n++
+		}
+	}
+	if n <= conn.CtcpSweep {
+		return 0
+	}
+	conn.ctcpQuiet = now.Add(conn.CtcpCooldown)
+	return n
+}
+
+// Returns true if we can send another automatic CTCP reply without going
+// over conn.CtcpGlobalLimit in the last minute, and counts it if so. No
+// replies are sent at all for a while after a sweep, see ctcpSweep().
+func (conn *Conn) ctcpReplyAllowed() bool {
+	now := time.Now()
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if now.Before(conn.ctcpQuiet) {
+		return false
+	}
+	if now.Sub(conn.ctcpReplies.start) > time.Minute {
+		conn.ctcpReplies = ctcpCount{start: now}
+	}
+	if conn.CtcpGlobalLimit > 0 && conn.ctcpReplies.n >= conn.CtcpGlobalLimit {
+		return false
+	}
+	conn.ctcpReplies.n++
+	return true
+}
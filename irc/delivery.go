@@ -0,0 +1,156 @@
+package irc
+
+// Here you'll find delivery confirmation for messages we send, using the
+// IRCv3 echo-message capability to find out when the server has accepted them.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors passed to delivery callbacks when we can't find out what happened
+var (
+	ErrUnconfirmed  = errors.New("irc: server can't confirm delivery")
+	ErrDisconnected = errors.New("irc: disconnected before delivery was confirmed")
+)
+
+// Numerics that mean a message we sent went nowhere. All of them have the
+// target of the message in Args[1].
+var DeliveryErrors = map[string]bool{
+	"401": true, // ERR_NOSUCHNICK
+	"404": true, // ERR_CANNOTSENDTOCHAN
+	"407": true, // ERR_TOOMANYTARGETS
+	"486": true, // ERR_NONONREG, on some ircds
+	"489": true, // ERR_SECUREONLYCHAN
+	"716": true, // ERR_TARGUMODEG
+}
+
+// A message waiting for the server to echo it back to us
+type pending struct {
+	cmd, text string
+	done      func(error)
+}
+
+func (conn *Conn) setupDelivery() {
+	conn.RequestCap("echo-message")
+
+	failed := func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			return
+		}
+		if p := conn.popPending(line.Args[1], "", ""); p != nil {
+			p.done(fmt.Errorf("irc: %s %s: %s", Numerics[line.Cmd], line.Args[1], line.Text))
+		}
+	}
+	for num := range DeliveryErrors {
+		conn.AddHandler(num, failed)
+	}
+}
+
+// PrivmsgConfirm() sends a PRIVMSG like Privmsg(), then calls done with nil
+// once the server has accepted it, or an error if the server tells us it
+// couldn't be delivered. done is called exactly once: right away with the
+// error from Message.Validate() if the message can't be sent at all, or with
+// ErrUnconfirmed if the server supports neither labeled-response nor
+// echo-message, or with ErrDisconnected if we disconnect before finding out.
+// It's called from the goroutine that handles incoming lines, so it mustn't
+// block.
+func (conn *Conn) PrivmsgConfirm(t, msg string, done func(error)) {
+	conn.sendConfirm("PRIVMSG", t, msg, done)
+}
+
+// NoticeConfirm() is to Notice() what PrivmsgConfirm() is to Privmsg()
+func (conn *Conn) NoticeConfirm(t, msg string, done func(error)) {
+	conn.sendConfirm("NOTICE", t, msg, done)
+}
+
+func (conn *Conn) sendConfirm(cmd, t, msg string, done func(error)) {
+	m := NewMessage(cmd, t).WithText(msg)
+	if err := m.Validate(); err != nil {
+		done(err)
+		return
+	}
+	// with labeled-response we can tell exactly which error is ours
+	if conn.sendLabeled(m, func(lines []*Line, err error) {
+		if err == nil {
+			err = deliveryError(lines)
+		}
+		done(err)
+	}) {
+		return
+	}
+	if !conn.HasCap("echo-message") {
+		conn.writeMessage(m)
+		done(ErrUnconfirmed)
+		return
+	}
+	target := conn.Fold(t)
+	conn.mu.Lock()
+	conn.pending[target] = append(conn.pending[target], &pending{cmd, msg, done})
+	conn.mu.Unlock()
+	conn.writeMessage(m)
+}
+
+// Returns an error if the response to a labeled message says it went nowhere
+func deliveryError(lines []*Line) error {
+	for _, l := range lines {
+		if DeliveryErrors[l.Cmd] && len(l.Args) > 1 {
+			return fmt.Errorf("irc: %s %s: %s", Numerics[l.Cmd], l.Args[1], l.Text)
+		}
+	}
+	return nil
+}
+
+// Removes and returns the oldest message waiting for confirmation sent to
+// target, matching cmd and text if they're not empty.
+func (conn *Conn) popPending(target, cmd, text string) *pending {
+	target = conn.Fold(target)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for i, p := range conn.pending[target] {
+		if (cmd == "" || p.cmd == cmd) && (text == "" || p.text == text) {
+			l := conn.pending[target]
+			if conn.pending[target] = append(l[0:i:i], l[i+1:]...); len(conn.pending[target]) == 0 {
+				delete(conn.pending, target)
+			}
+			return p
+		}
+	}
+	return nil
+}
+
+// Handles the echoes of messages we've sent, returning true if line is one.
+// Echoes aren't dispatched, or everything that responds to PRIVMSGs would
+// end up talking to itself.
+func (conn *Conn) echo(line *Line) bool {
+	switch line.Cmd {
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+	default:
+		return false
+	}
+	if line.Nick == "" || !conn.EqualFold(line.Nick, conn.Me.Nick) || len(line.Args) == 0 || !conn.HasCap("echo-message") {
+		return false
+	}
+	p := conn.popPending(line.Args[0], line.Cmd, line.Text)
+	if p == nil {
+		// the server may have mangled the text, e.g. by stripping colours
+		p = conn.popPending(line.Args[0], line.Cmd, "")
+	}
+	if p != nil {
+		p.done(nil)
+	}
+	return true
+}
+
+// Tells everyone still waiting for a confirmation that they won't get one
+func (conn *Conn) failPending() {
+	conn.mu.Lock()
+	all := conn.pending
+	conn.pending = make(map[string][]*pending)
+	conn.mu.Unlock()
+	for _, l := range all {
+		for _, p := range l {
+			p.done(ErrDisconnected)
+		}
+	}
+}
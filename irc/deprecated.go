@@ -0,0 +1,40 @@
+package irc
+
+// Here you'll find the methods that are on their way out of the public API,
+// kept for one more release so that code using them has time to move on.
+// They change the state tracking behind its back, which is how it gets out
+// of step with the server; let the handlers in handlers.go do it instead.
+
+// Deprecated: nicks are created by the state tracking handlers as they're
+// seen. NewNick() will be removed in the next release.
+func (conn *Conn) NewNick(nick, ident, name, host string) *Nick {
+	return conn.newNick(nick, ident, name, host)
+}
+
+// Deprecated: channels are created by the state tracking handlers when we
+// join them. NewChannel() will be removed in the next release.
+func (conn *Conn) NewChannel(c string) *Channel { return conn.newChannel(c) }
+
+// Deprecated: AddNick() will be removed in the next release.
+func (ch *Channel) AddNick(n *Nick) { ch.addNick(n) }
+
+// Deprecated: DelNick() will be removed in the next release.
+func (ch *Channel) DelNick(n *Nick) { ch.delNick(n) }
+
+// Deprecated: use conn.Part() and let the state tracking forget about the
+// channel once the server says we've left. Delete() will be removed in the
+// next release.
+func (ch *Channel) Delete() { ch.delete() }
+
+// Deprecated: AddChannel() will be removed in the next release.
+func (n *Nick) AddChannel(ch *Channel) { n.addChannel(ch) }
+
+// Deprecated: DelChannel() will be removed in the next release.
+func (n *Nick) DelChannel(ch *Channel) { n.delChannel(ch) }
+
+// Deprecated: use conn.Nick() and let the state tracking follow the change
+// once the server confirms it. ReNick() will be removed in the next release.
+func (n *Nick) ReNick(neu string) { n.reNick(neu) }
+
+// Deprecated: Delete() will be removed in the next release.
+func (n *Nick) Delete() { n.delete() }
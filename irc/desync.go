@@ -0,0 +1,100 @@
+package irc
+
+// Here you'll find the detection of our channel state going out of step with
+// the server's, e.g. after a netsplit or a missed line, and what we do to get
+// it back in step. Each time this happens a "DESYNC" event is triggered with
+// the channel in Args[0] and what happened in Args[1]: "UNTRACKED" when we
+// find we're on a channel we didn't know about, "NOTONCHANNEL" when the
+// server tells us we're not on one we thought we were, and "DUPLICATEJOIN"
+// when we see ourselves join a channel we thought we were already on.
+
+import (
+	"strings"
+)
+
+func (conn *Conn) setupDesync() {
+	// Lines from other people to channels we don't know about mean we might
+	// be on them without knowing. Ask for the names to find out; 353/366
+	// take it from there, see resyncNames() and resynced().
+	untracked := func(conn *Conn, line *Line) {
+		if len(line.Args) == 0 || line.Nick == "" || conn.EqualFold(line.Nick, conn.Me.Nick) ||
+			!conn.IsChannel(line.Args[0]) || conn.GetChannel(line.Args[0]) != nil {
+			return
+		}
+		conn.resync(line.Args[0])
+	}
+	for _, cmd := range []string{"PRIVMSG", "NOTICE", "ACTION", "TOPIC", "MODE", "KICK", "PART"} {
+		conn.AddHandler(cmd, untracked)
+	}
+
+	// Handle 442 "not on that channel" for channels we think we're on by
+	// forgetting about them, and joining them again if conn.RejoinDesynced
+	conn.AddHandler("442", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			return
+		}
+		ch := conn.GetChannel(line.Args[1])
+		if ch == nil {
+			return
+		}
+		key := ch.Modes.Key
+		ch.delete()
+		conn.dispatchEvent(&Line{Cmd: "DESYNC", Src: line.Src, Host: line.Host,
+			Args: []string{ch.Name, "NOTONCHANNEL"}})
+		if conn.RejoinDesynced {
+			conn.JoinKey(ch.Name, key)
+		}
+	})
+}
+
+// Asks the server for the names on channel, so that we can find out whether
+// we're on it, unless we already have.
+func (conn *Conn) resync(channel string) {
+	c := conn.Fold(channel)
+	conn.mu.Lock()
+	if _, ok := conn.resyncs[c]; ok {
+		conn.mu.Unlock()
+		return
+	}
+	conn.resyncs[c] = []string{}
+	conn.mu.Unlock()
+	conn.writeMessage(NewMessage("NAMES", channel))
+}
+
+// Collects names from a 353 for a channel we're resyncing. Returns false if
+// we aren't.
+func (conn *Conn) resyncNames(channel string, names []string) bool {
+	c := conn.Fold(channel)
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	l, ok := conn.resyncs[c]
+	if ok {
+		conn.resyncs[c] = append(l, names...)
+	}
+	return ok
+}
+
+// Called on 366 for a channel we don't know about. If we were resyncing it
+// and we're in the names we collected, we start tracking it again, returning
+// the new *Channel with its names waiting for the 366 handler to add.
+func (conn *Conn) resynced(channel string) *Channel {
+	c := conn.Fold(channel)
+	conn.mu.Lock()
+	names, ok := conn.resyncs[c]
+	delete(conn.resyncs, c)
+	conn.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	t := conn.modeTypes()
+	for _, nick := range names {
+		if conn.EqualFold(strings.TrimLeft(nick, t.symbols), conn.Me.Nick) {
+			ch := conn.newChannel(channel)
+			ch.names = names
+			conn.queueSync(ch)
+			conn.dispatchEvent(&Line{Cmd: "DESYNC", Args: []string{ch.Name, "UNTRACKED"}})
+			return ch
+		}
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package irc
+
+// Here you'll find why the server last disconnected us, worked out from the
+// ERROR it sends before closing the connection and from the ban notices some
+// servers send before that, so that whatever reconnects can tell a ban,
+// which reconnecting won't fix, from a netsplit or ping timeout.
+
+import "strings"
+
+// A struct representing why the server disconnected us
+type DisconnectReason struct {
+	// "BANNED" for K-lines, G-lines and the like, "KILLED", "THROTTLED" for
+	// reconnecting too quickly or too many connections from our host,
+	// "PINGTIMEOUT", "QUIT" for our own QUIT, or "" if we don't recognise
+	// what the server said
+	Kind string
+
+	// What the server said, e.g. "Closing Link: host (K-Lined: spam)"
+	Text string
+}
+
+// Returns true if we were disconnected because we're banned from the server
+func (r *DisconnectReason) Banned() bool {
+	return r != nil && r.Kind == "BANNED"
+}
+
+// Phrases found in ERRORs and ban notices, and the kind of disconnection they
+// mean. These are checked in order, so that e.g. a K-line's kill isn't taken
+// for an ordinary one.
+var DisconnectPhrases = [][2]string{
+	{"(quit:", "QUIT"},
+	{"ping timeout", "PINGTIMEOUT"},
+	{"k-line", "BANNED"},
+	{"g-line", "BANNED"},
+	{"z-line", "BANNED"},
+	{"d-line", "BANNED"},
+	{"akill", "BANNED"},
+	{"banned", "BANNED"},
+	{"killed", "KILLED"},
+	{"throttled", "THROTTLED"},
+	{"too many connections", "THROTTLED"},
+	{"too many host connections", "THROTTLED"},
+	{"reconnect too fast", "THROTTLED"},
+	{"reconnecting too fast", "THROTTLED"},
+}
+
+// Works out the kind of disconnection text is about, see DisconnectPhrases
+func disconnectKind(text string) string {
+	text = strings.ToLower(text)
+	for _, p := range DisconnectPhrases {
+		if strings.Contains(text, p[0]) {
+			return p[1]
+		}
+	}
+	return ""
+}
+
+// DisconnectReason() returns why the server disconnected us, once it has:
+// Disconnected() is closed and conn.Err has been closed. It returns nil if
+// the server closed the connection without saying why, or if we haven't been
+// disconnected since last calling Connect().
+func (conn *Conn) DisconnectReason() *DisconnectReason {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.disconnect
+}
+
+// Keeps track of what the server tells us about why it's about to disconnect
+// us. Called from recv(), so that this is known before conn.Err is closed.
+func (conn *Conn) disconnectLine(line *Line) {
+	var r *DisconnectReason
+	switch line.Cmd {
+	case "ERROR":
+		r = &DisconnectReason{Kind: disconnectKind(line.Text), Text: line.Text}
+	case "465":
+		// ERR_YOUREBANNEDCREEP
+		r = &DisconnectReason{Kind: "BANNED", Text: line.Text}
+	case "NOTICE":
+		// some servers tell us about bans in a notice while we're
+		// registering, then send a plain "Closing Link" ERROR
+		if conn.connected || strings.Contains(line.Src, "!") {
+			return
+		}
+		if disconnectKind(line.Text) != "BANNED" {
+			return
+		}
+		r = &DisconnectReason{Kind: "BANNED", Text: line.Text}
+	default:
+		return
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if conn.disconnect.Banned() && !r.Banned() {
+		// don't forget about the ban because the ERROR didn't mention it
+		conn.disconnect.Text = r.Text
+		return
+	}
+	conn.disconnect = r
+}
@@ -0,0 +1,97 @@
+package irc
+
+// Here you'll find parsing of extended bans, which let channel ops ban by
+// things other than nick!user@host, like services account or real name.
+
+import (
+	"strings"
+)
+
+// A struct representing an extended ban mask, like "$a:account" on charybdis
+// and friends, "~a:account" on UnrealIRCd or "R:account" on InspIRCd. Which of
+// these a server uses is described by EXTBAN in 005.
+type ExtBan struct {
+	// The server's extban prefix, e.g. "$", "~" or "" for InspIRCd
+	Prefix string
+
+	// The kind of extban, e.g. "a" for account. Some servers also accept
+	// names for these, like "account", which end up here as they are.
+	Type string
+
+	// Negate is true for "match everyone but" extbans, like "$~a"
+	Negate bool
+
+	// Whatever follows the ':', which can be another ban mask, or "" if there
+	// was nothing, as in "$a" which matches anyone identified to services
+	Arg string
+}
+
+// ParseExtBan() parses mask using the server's EXTBAN syntax. It returns nil
+// if mask is a plain nick!user@host mask, or the server doesn't do extbans.
+func (conn *Conn) ParseExtBan(mask string) *ExtBan {
+	v, ok := conn.ISupport("EXTBAN")
+	if !ok {
+		return nil
+	}
+	// EXTBAN looks like "$,ajrxz" or ",ABCNOQRSTUcjmprsz", or just the prefix
+	// on servers that only have named extbans
+	prefix, types := v, ""
+	if idx := strings.Index(v, ","); idx != -1 {
+		prefix, types = v[0:idx], v[idx+1:]
+	}
+	return parseExtBan(mask, prefix, types)
+}
+
+// The guts of ParseExtBan(), split out so they can be tested without a Conn
+func parseExtBan(mask, prefix, types string) *ExtBan {
+	if !strings.HasPrefix(mask, prefix) {
+		return nil
+	}
+	e := &ExtBan{Prefix: prefix}
+	rest := mask[len(prefix):]
+	if len(rest) > 0 && rest[0] == '~' && prefix != "~" {
+		e.Negate, rest = true, rest[1:]
+	}
+	if idx := strings.Index(rest, ":"); idx != -1 {
+		e.Type, e.Arg = rest[0:idx], rest[idx+1:]
+	} else if prefix != "" {
+		e.Type = rest
+	} else {
+		// without a prefix, a ':' is the only way to tell one apart
+		return nil
+	}
+	switch {
+	case e.Type == "":
+		return nil
+	case len(e.Type) == 1:
+		if strings.Index(types, e.Type) == -1 {
+			return nil
+		}
+	case prefix == "" || strings.ContainsAny(e.Type, "!@*?"):
+		// named extbans need a prefix, or nick!user@host:moo would be one
+		return nil
+	}
+	return e
+}
+
+// Turns the extban back into a mask to set with MODE +b
+func (e *ExtBan) String() string {
+	s := e.Prefix
+	if e.Negate {
+		s += "~"
+	}
+	s += e.Type
+	if e.Arg != "" {
+		s += ":" + e.Arg
+	}
+	return s
+}
+
+// Types of extban that quiet, rather than ban, by their letter and by name.
+// UnrealIRCd and InspIRCd call these quiets and mutes respectively.
+var quietExtBans = map[string]bool{
+	"q":     true,
+	"quiet": true,
+	"m":     true,
+	"mute":  true,
+}
@@ -0,0 +1,254 @@
+package irc
+
+// Here you'll find helpers for text containing mIRC-style formatting codes
+// (bold, colours and so on), which take up no room on screen and so need
+// skipping when working out how wide text is.
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// Formatting codes, as understood by most clients
+const (
+	Bold          = "\x02"
+	Colour        = "\x03"
+	HexColour     = "\x04"
+	Reset         = "\x0f"
+	Monospace     = "\x11"
+	Reverse       = "\x16"
+	Italic        = "\x1d"
+	Strikethrough = "\x1e"
+	Underline     = "\x1f"
+)
+
+// Returns the length of the formatting code at the start of s, including
+// the colours that follow \x03 and \x04, or 0 if s doesn't start with one.
+func formatCode(s string) int {
+	if s == "" {
+		return 0
+	}
+	switch s[0:1] {
+	case Bold, Reset, Monospace, Reverse, Italic, Strikethrough, Underline:
+		return 1
+	case Colour:
+		// \x03 then up to two digits, and optionally a comma and up to two
+		// digits more for the background
+		return 1 + colourArgs(s[1:], 2, isDigit)
+	case HexColour:
+		return 1 + colourArgs(s[1:], 6, isHexDigit)
+	}
+	return 0
+}
+
+// Returns the length of the "fg[,bg]" at the start of s, where each colour is
+// up to max characters that ok() allows. A comma only counts as part of it
+// if it's followed by a background colour.
+func colourArgs(s string, max int, ok func(byte) bool) int {
+	n := 0
+	for n < len(s) && n < max && ok(s[n]) {
+		n++
+	}
+	if n == 0 || n >= len(s) || s[n] != ',' {
+		return n
+	}
+	m := 0
+	for n+1+m < len(s) && m < max && ok(s[n+1+m]) {
+		m++
+	}
+	if m == 0 {
+		return n
+	}
+	return n + 1 + m
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isHexDigit(c byte) bool {
+	return isDigit(c) || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// StripFormatting() returns s without any formatting codes
+func StripFormatting(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if n := formatCode(s[i:]); n > 0 {
+			i += n
+			continue
+		}
+		b.WriteByte(s[i])
+		i++
+	}
+	return b.String()
+}
+
+// VisibleWidth() returns the number of characters in s that will actually
+// show up on screen, i.e. not counting formatting codes.
+func VisibleWidth(s string) int {
+	return utf8.RuneCountInString(StripFormatting(s))
+}
+
+// Columns() lays rows out as a table, padding the cells in each column with
+// spaces to line them up, and returns a line for each row. Formatting codes
+// in cells are allowed for, and reset at the end of each cell that has them
+// so they don't run into the next.
+func Columns(rows [][]string) []string {
+	widths := []int{}
+	for _, row := range rows {
+		for i, cell := range row {
+			if i == len(widths) {
+				widths = append(widths, 0)
+			}
+			if w := VisibleWidth(cell); w > widths[i] {
+				widths[i] = w
+			}
+		}
+	}
+	lines := make([]string, 0, len(rows))
+	for _, row := range rows {
+		line := ""
+		for i, cell := range row {
+			if StripFormatting(cell) != cell {
+				cell += Reset
+			}
+			if i < len(row)-1 {
+				cell += strings.Repeat(" ", widths[i]-VisibleWidth(cell)) + "  "
+			}
+			line += cell
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// The formatting in effect at some point in a line of text
+type formatState struct {
+	bold, italic, underline, strikethrough, monospace, reverse bool
+	colour, hexColour                                          string
+}
+
+// Updates f with the formatting codes in s
+func (f *formatState) update(s string) {
+	for i := 0; i < len(s); {
+		n := formatCode(s[i:])
+		if n == 0 {
+			i++
+			continue
+		}
+		switch code := s[i : i+n]; code[0:1] {
+		case Bold:
+			f.bold = !f.bold
+		case Italic:
+			f.italic = !f.italic
+		case Underline:
+			f.underline = !f.underline
+		case Strikethrough:
+			f.strikethrough = !f.strikethrough
+		case Monospace:
+			f.monospace = !f.monospace
+		case Reverse:
+			f.reverse = !f.reverse
+		case Colour:
+			// a bare \x03 turns colours off
+			f.colour = code
+			if n == 1 {
+				f.colour = ""
+			}
+		case HexColour:
+			f.hexColour = code
+			if n == 1 {
+				f.hexColour = ""
+			}
+		case Reset:
+			*f = formatState{}
+		}
+		i += n
+	}
+}
+
+// Returns the codes that turn on the formatting in f, to go before text.
+// Bold is toggled twice after a colour if text would otherwise be taken as
+// part of it, e.g. the "5" in "5 apples" after "\x034".
+func (f *formatState) codes(text string) string {
+	s := ""
+	for _, c := range []struct {
+		on   bool
+		code string
+	}{
+		{f.bold, Bold}, {f.italic, Italic}, {f.underline, Underline},
+		{f.strikethrough, Strikethrough}, {f.monospace, Monospace}, {f.reverse, Reverse},
+	} {
+		if c.on {
+			s += c.code
+		}
+	}
+	for _, colour := range []string{f.hexColour, f.colour} {
+		if colour == "" {
+			continue
+		}
+		s += colour
+		if formatCode(colour+text) != len(colour) {
+			s += Bold + Bold
+		}
+	}
+	return s
+}
+
+// Wrap() splits s into lines of at most max bytes, at spaces where it can.
+// Formatting that's still in effect at the end of a line is turned on again
+// at the start of the next, so that e.g. a long coloured announcement stays
+// coloured all the way through. Formatting codes and UTF-8 characters are
+// never split.
+func Wrap(s string, max int) []string {
+	lines := []string{}
+	var f formatState
+	for first := true; s != "" || first; first = false {
+		prefix := ""
+		if !first {
+			prefix = f.codes(s)
+			if len(prefix) >= max {
+				prefix = ""
+			}
+		}
+		if len(prefix)+len(s) <= max {
+			lines = append(lines, prefix+s)
+			break
+		}
+		cut := wrapPoint(s, max-len(prefix))
+		f.update(s[:cut])
+		lines = append(lines, prefix+strings.TrimRight(s[:cut], " "))
+		s = strings.TrimLeft(s[cut:], " ")
+	}
+	return lines
+}
+
+// Returns where to split s to fit in room bytes: at the last space that
+// fits, or as much as fits if there isn't one, but always after at least one
+// character or formatting code so that Wrap() gets somewhere.
+func wrapPoint(s string, room int) int {
+	i, space := 0, 0
+	for i < len(s) {
+		n := formatCode(s[i:])
+		if n == 0 {
+			if s[i] == ' ' {
+				space = i
+			}
+			_, n = utf8.DecodeRuneInString(s[i:])
+		}
+		if i+n > room {
+			break
+		}
+		i += n
+	}
+	switch {
+	case space > 0:
+		return space
+	case i > 0:
+		return i
+	}
+	if n := formatCode(s); n > 0 {
+		return n
+	}
+	_, n := utf8.DecodeRuneInString(s)
+	return n
+}
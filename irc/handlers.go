@@ -4,13 +4,17 @@ package irc
 // to manage tracking an irc connection etc.
 
 import (
-	"strings"
+	"fmt"
 	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 )
 
 // AddHandler() adds an event handler for a specific IRC command.
 //
 // Handlers take the form of an anonymous function (currently):
+//
 //	func(conn *irc.Conn, line *irc.Line) {
 //		// handler code here
 //	}
@@ -19,28 +23,105 @@ import (
 // "name" being equivalent to Line.Cmd. Read the RFCs for details on what
 // replies could come from the server. They'll generally be things like
 // "PRIVMSG", "JOIN", etc. but all the numeric replies are left as ascii
-// strings of digits like "332" (mainly because I really didn't feel like 
-// putting massive constant tables in).
+// strings of digits like "332". Handlers for numerics can also be added using
+// their names from the Numerics table, like "RPL_TOPIC"; Line.Cmd will still
+// be the numeric. Numerics nothing has a handler for are passed on as
+// "NUMERIC" events, with the numeric in Args[0].
 func (conn *Conn) AddHandler(name string, f func(*Conn, *Line)) {
-	n := strings.ToUpper(name)
-	if e, ok := conn.events[n]; ok {
-		if len(e) == cap(e) {
-			// crap, we're full. expand e by another 10 handler slots
-			ne := make([]func(*Conn, *Line), len(e), len(e)+10)
-			for i := 0; i < len(e); i++ {
-				ne[i] = e[i]
+	conn.addHandler(name, f)
+}
+
+// AddRemovableHandler() adds an event handler like AddHandler(), and returns
+// a function that removes it again, e.g. for unloading a bot module without
+// reconnecting. Removing a handler doesn't stop it if it's already running.
+func (conn *Conn) AddRemovableHandler(name string, f func(*Conn, *Line)) (remove func()) {
+	n, h := conn.addHandler(name, f)
+	return func() {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		l := conn.events[n]
+		for i := range l {
+			if l[i] == h {
+				l = append(l[0:i:i], l[i+1:]...)
+				break
 			}
-			e = ne
 		}
-		e = e[0 : len(e)+1]
-		e[len(e)-1] = f
-	} else {
-		e := make([]func(*Conn, *Line), 1, 10)
-		e[0] = f
-		conn.events[n] = e
+		if len(l) == 0 {
+			delete(conn.events, n)
+		} else {
+			conn.events[n] = l
+		}
 	}
 }
 
+// A registered event handler. These are kept as pointers so that they can be
+// told apart when removing them, which funcs can't be.
+type handler struct {
+	f func(*Conn, *Line)
+}
+
+// Adds f as a handler for name, returning the event name it was filed under
+// and the handler so that it can be removed again
+func (conn *Conn) addHandler(name string, f func(*Conn, *Line)) (string, *handler) {
+	n := strings.ToUpper(name)
+	if code, ok := NumericCodes[n]; ok {
+		n = code
+	}
+	h := &handler{f}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.events[n] = append(conn.events[n], h)
+	return n, h
+}
+
+// Returns the handlers for the event name, in the order they were added
+func (conn *Conn) handlers(name string) []func(*Conn, *Line) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	funcs := make([]func(*Conn, *Line), 0, len(conn.events[name]))
+	for _, h := range conn.events[name] {
+		funcs = append(funcs, h.f)
+	}
+	return funcs
+}
+
+// AddHandlerTimeout() adds an event handler like AddHandler(), but gives up
+// waiting for it if it runs for longer than d. The timeout is sent down
+// conn.Err and counted in conn.SlowHandlers(), and dispatch carries on
+// without it. Note that the handler isn't killed, it is merely abandoned, so
+// it will carry on running in the background until it returns.
+func (conn *Conn) AddHandlerTimeout(name string, d time.Duration, f func(*Conn, *Line)) {
+	conn.AddHandler(name, func(conn *Conn, line *Line) {
+		done := make(chan bool, 1)
+		go func() {
+			conn.runHandler(f, line)
+			done <- true
+		}()
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-done:
+		case <-t.C:
+			conn.mu.Lock()
+			conn.slow[line.Cmd]++
+			conn.mu.Unlock()
+			conn.error("irc.AddHandlerTimeout(): %s handler took longer than %s, abandoning it (line: %s)", line.Cmd, d, line.Raw)
+		}
+	})
+}
+
+// SlowHandlers() returns the number of times handlers added with
+// AddHandlerTimeout() have been abandoned, by event name.
+func (conn *Conn) SlowHandlers() map[string]int {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	slow := make(map[string]int, len(conn.slow))
+	for k, v := range conn.slow {
+		slow[k] = v
+	}
+	return slow
+}
+
 // loops through all event handlers for line.Cmd, running each in a goroutine
 func (conn *Conn) dispatchEvent(line *Line) {
 	// seems that we end up dispatching an event with a nil line when receiving
@@ -50,37 +131,487 @@ func (conn *Conn) dispatchEvent(line *Line) {
 		return
 	}
 
+	// this is the client-side half of SILENCE, for servers that don't do it
+	switch line.Cmd {
+	case "PRIVMSG", "NOTICE", "INVITE":
+		if line.Nick != "" && conn.silenced(line.Src) {
+			return
+		}
+	}
+
+	// lines that are part of some batches aren't dispatched, see batch.go
+	if conn.batchLine(line) {
+		return
+	}
+
+	// responses to labeled commands go to whoever sent them, see labels.go,
+	// as well as being dispatched as usual
+	conn.labeledLine(line)
+
+	// echoes of our own messages aren't dispatched, see delivery.go
+	if conn.echo(line) {
+		return
+	}
+
+	// nor are lines we've already seen, see conn.DedupWindow
+	if line.MsgId != "" && conn.DedupWindow > 0 && conn.duplicate(line.MsgId) {
+		return
+	}
+
+	// Depending on the ircd, INVITE's channel may or may not be the trailing
+	// parameter. Make sure it always ends up in line.Args[1].
+	if line.Cmd == "INVITE" && len(line.Args) == 1 {
+		line.Args = []string{line.Args[0], line.Text}
+		line.Text = ""
+	}
+
 	// So, I think CTCP and (in particular) CTCP ACTION are better handled as
 	// separate events as opposed to forcing people to have gargantuan PRIVMSG
 	// handlers to cope with the possibilities.
-	if line.Cmd == "PRIVMSG" && len(line.Text) > 2 &&
-		line.Text[0] == '\001' && line.Text[len(line.Text)-1] == '\001' {
-		// WOO, it's a CTCP message
-		t := strings.Split(line.Text[1:len(line.Text)-1], " ", 2)
-		if c := strings.ToUpper(t[0]); c == "ACTION" {
-			// make a CTCP ACTION it's own event a-la PRIVMSG
-			line.Cmd = c
-		} else {
-			// otherwise, dispatch a generic CTCP event that
-			// contains the type of CTCP in line.Args[0]
-			line.Cmd = "CTCP"
-			a := make([]string, len(line.Args)+1)
-			a[0] = c
-			for i := 0; i < len(line.Args); i++ {
-				a[i+1] = line.Args[i]
+	if line.Cmd == "PRIVMSG" {
+		if c, text, ok := parseCTCP(line.Text); ok {
+			// WOO, it's a CTCP message
+			if c == "ACTION" {
+				// make a CTCP ACTION it's own event a-la PRIVMSG
+				line.Cmd = c
+			} else {
+				// otherwise, dispatch a generic CTCP event that
+				// contains the type of CTCP in line.Args[0]
+				line.Cmd = "CTCP"
+				line.Args = append([]string{c}, line.Args...)
 			}
-			line.Args = a
-		}
-		if len(t) > 1 {
 			// for some CTCP messages this could make more sense
 			// in line.Args[], but meh. MEH, I say.
-			line.Text = t[1]
+			line.Text = text
+		}
+	}
+	// see sanitize.go
+	switch line.Cmd {
+	case "PRIVMSG", "NOTICE", "ACTION":
+		if conn.Sanitize != nil {
+			line.RawText, line.Text = line.Text, conn.Sanitize(line.Text)
+		}
+	}
+
+	// CTCP requests from people sending too many are dropped, see ctcpflood.go
+	if line.Cmd == "CTCP" && conn.ctcpFlooding(line) {
+		return
+	}
+
+	// see idle.go, coalesce.go and changes.go
+	conn.idleLine(line)
+	conn.coalesceLine(line)
+	conn.channelChanges(line)
+
+	// Numerics nothing is listening for are passed on as "NUMERIC" events,
+	// so that nothing the server sends has to go unseen. This is a copy, as
+	// batches and labeled responses may have hung on to line already.
+	funcs := conn.handlers(line.Cmd)
+	if len(funcs) == 0 && isNumeric(line.Cmd) {
+		l := *line
+		l.Args = append([]string{line.Cmd}, line.Args...)
+		l.Cmd = "NUMERIC"
+		line = &l
+		funcs = conn.handlers(line.Cmd)
+	}
+	if len(funcs) > 0 {
+		if conn.inline {
+			// we're replaying a log, see replay.go
+			for _, f := range funcs {
+				conn.runHandler(f, line)
+			}
+			return
+		}
+		if conn.workers == nil {
+			for _, f := range funcs {
+				go conn.runHandler(f, line)
+			}
+			return
+		}
+		w := conn.workers[conn.dispatchKey(line)%uint32(len(conn.workers))]
+		j := &job{line, funcs}
+		if conn.Overflow == OverflowDrop {
+			select {
+			case w <- j:
+			default:
+				conn.error("irc.dispatchEvent(): queue full, dropping line: %s", line.Raw)
+			}
+		} else {
+			w <- j
+		}
+	}
+}
+
+// runs a handler, recovering from any panic so that one buggy handler can't
+// take down the whole connection. The panic is sent down conn.Err instead.
+func (conn *Conn) runHandler(f func(*Conn, *Line), line *Line) {
+	defer func() {
+		if err := recover(); err != nil {
+			conn.error("irc.runHandler(): %s handler panicked: %v (line: %s)", line.Cmd, err, line.Raw)
+		}
+	}()
+	f(conn, line)
+	conn.handled(line)
+}
+
+// A line and the handlers that need to be run for it, in order
+type job struct {
+	line  *Line
+	funcs []func(*Conn, *Line)
+}
+
+// runs the handlers for jobs in the order they are queued
+func (conn *Conn) worker(jobs chan *job) {
+	for j := range jobs {
+		for _, f := range j.funcs {
+			conn.runHandler(f, j.line)
+		}
+	}
+}
+
+// hashes the channel a line is for, or the nick it is from if it isn't for a
+// channel, so that all lines about the same thing go to the same worker.
+// NOTE: handlers that dispatch further events with OverflowBlock set can
+// deadlock if they fill up their own worker's queue.
+func (conn *Conn) dispatchKey(line *Line) uint32 {
+	key := line.Nick
+	if len(line.Args) > 0 && conn.IsChannel(line.Args[0]) {
+		key = line.Args[0]
+	}
+	var h uint32
+	for i := 0; i < len(key); i++ {
+		h = h*31 + uint32(key[i])
+	}
+	return h
+}
+
+// Characters put on the end of nicks that are in use, in the order they're
+// tried once nicks are as long as the server allows, see altNick()
+const altNickChars = "_0123456789"
+
+// Works out the nick to try when nick is in use: nick with "_" on the end, or
+// if that would be longer than max, nick with its last character replaced by
+// the next one in altNickChars. Returns "" once those have all been tried.
+func altNick(nick string, max int) string {
+	if max <= 0 || len(nick) < max {
+		return nick + "_"
+	}
+	i := strings.IndexByte(altNickChars, nick[max-1])
+	if i == len(altNickChars)-1 {
+		return ""
+	}
+	// don't cut a character in half
+	cut := max - 1
+	for cut > 0 && !utf8.RuneStart(nick[cut]) {
+		cut--
+	}
+	return nick[:cut] + altNickChars[i+1:i+2]
+}
+
+// Reasons given in "JOINERROR" events, by the numeric that causes them
+var JoinErrors = map[string]string{
+	"405": "TOOMANY",
+	"471": "FULL",
+	"473": "INVITEONLY",
+	"474": "BANNED",
+	"475": "BADKEY",
+	"476": "BADNAME",
+	"477": "REGONLY",
+}
+
+// Works out whether a JOIN for channel is bound to fail, returning the reason
+// it would fail or "". This only knows about the channel's name, what the
+// server has told us in 005 and conn's own limits: "BADNAME", "NOTALLOWED"
+// or "TOOMANY". We don't track the modes or bans of channels we aren't in, so
+// "INVITEONLY", "BADKEY", "FULL" and "BANNED" only come from the server's
+// replies to the JOIN, once it's been sent.
+func (conn *Conn) cantJoin(channel string) string {
+	if !conn.IsChannel(channel) {
+		return "BADNAME"
+	}
+	if v, ok := conn.ISupport("CHANNELLEN"); ok {
+		if l, err := strconv.Atoi(v); err == nil && len(channel) > l {
+			return "BADNAME"
+		}
+	}
+	if conn.GetChannel(channel) != nil {
+		return ""
+	}
+	if !conn.joinAllowed(channel) {
+		return "NOTALLOWED"
+	}
+	chans := conn.Channels()
+	if conn.MaxChannels > 0 && len(chans) >= conn.MaxChannels {
+		return "TOOMANY"
+	}
+	// CHANLIMIT looks like "#&:20,+:5"; MAXCHANNELS is the older version
+	limits := make(map[string]int)
+	if v, ok := conn.ISupport("CHANLIMIT"); ok {
+		for _, l := range strings.Split(v, ",") {
+			if kv := strings.SplitN(l, ":", 2); len(kv) == 2 && kv[1] != "" {
+				limits[kv[0]], _ = strconv.Atoi(kv[1])
+			}
+		}
+	} else if v, ok := conn.ISupport("MAXCHANNELS"); ok {
+		chantypes, ok := conn.ISupport("CHANTYPES")
+		if !ok {
+			chantypes = "#&"
+		}
+		limits[chantypes], _ = strconv.Atoi(v)
+	}
+	for prefixes, limit := range limits {
+		if limit <= 0 || strings.IndexByte(prefixes, channel[0]) == -1 {
+			continue
+		}
+		n := 0
+		for _, ch := range chans {
+			if strings.IndexByte(prefixes, ch.Name[0]) != -1 {
+				n++
+			}
+		}
+		if n >= limit {
+			return "TOOMANY"
+		}
+	}
+	return ""
+}
+
+// Returns true if channel is allowed by conn.JoinMasks and conn.NoJoinMasks
+func (conn *Conn) joinAllowed(channel string) bool {
+	c := conn.Fold(channel)
+	for _, mask := range conn.NoJoinMasks {
+		if matchMask(conn.Fold(mask), c) {
+			return false
+		}
+	}
+	for _, mask := range conn.JoinMasks {
+		if matchMask(conn.Fold(mask), c) {
+			return true
+		}
+	}
+	return len(conn.JoinMasks) == 0
+}
+
+// Returns the PONG answering a PING. Servers send these in all sorts of ways,
+// e.g. "PING :irc.server", "PING 12345" or "PING irc.server :token", before
+// and after registration, and some disconnect us unless we send back exactly
+// the parameters they sent, so we do.
+func pong(line *Line) *Message {
+	p := params(line, 0)
+	if len(p) == 0 {
+		return NewMessage("PONG").WithText("")
+	}
+	return NewMessage("PONG", p[0:len(p)-1]...).WithText(p[len(p)-1])
+}
+
+// Returns the parameters of line after the first n, including the trailing one
+// in line.Text, as servers differ on which parameters they put there.
+func params(line *Line, n int) []string {
+	p := []string{}
+	if n < len(line.Args) {
+		p = append(p, line.Args[n:]...)
+	}
+	if line.Text != "" {
+		p = append(p, line.Text)
+	}
+	return p
+}
+
+// A single change from a MODE line, e.g. the "+o nick" in "+ov nick nick"
+type modeChange struct {
+	add  bool
+	mode byte
+	arg  string
+}
+
+// Which channel modes take arguments, from PREFIX and CHANMODES in 005.
+// prefix modes are privileges like +o, list modes are lists like +b, always
+// modes always take an argument, and set modes only take one when being set.
+type modeTypes struct {
+	prefix, symbols, list, always, set string
+}
+
+// What we assume if the server doesn't tell us, which covers most ircds
+var defaultModeTypes = modeTypes{
+	prefix:  "qaohv",
+	symbols: "~&@%+",
+	list:    "beI",
+	always:  "k",
+	set:     "l",
+}
+
+// Works out which channel modes take arguments on this server
+func (conn *Conn) modeTypes() modeTypes {
+	t := defaultModeTypes
+	// PREFIX looks like "(qaohv)~&@%+"
+	if v, ok := conn.ISupport("PREFIX"); ok {
+		if idx := strings.Index(v, ")"); len(v) > 0 && v[0] == '(' && idx != -1 &&
+			len(v)-idx-1 == idx-1 {
+			t.prefix, t.symbols = v[1:idx], v[idx+1:]
+		}
+	}
+	// CHANMODES looks like "beI,k,l,imnpst"
+	if v, ok := conn.ISupport("CHANMODES"); ok {
+		if m := strings.Split(v, ","); len(m) >= 3 {
+			t.list, t.always, t.set = m[0], m[1], m[2]
+		}
+	}
+	return t
+}
+
+// Splits a mode string like "+o-v" and its arguments into separate changes,
+// using t to work out which modes take arguments. If it runs out of arguments
+// it returns the changes parsed so far along with an error, so a truncated
+// MODE from the server can't knock things out of step.
+func parseModeChange(modes string, args []string, t modeTypes) ([]modeChange, error) {
+	changes := []modeChange{}
+	add := true
+	for i := 0; i < len(modes); i++ {
+		c := modeChange{add: add, mode: modes[i]}
+		switch {
+		case c.mode == '+' || c.mode == '-':
+			add = c.mode == '+'
+			continue
+		case strings.IndexByte(t.prefix, c.mode) != -1,
+			strings.IndexByte(t.list, c.mode) != -1:
+			if len(args) == 0 {
+				return changes, fmt.Errorf("not enough arguments for %c", c.mode)
+			}
+			c.arg, args = args[0], args[1:]
+		case strings.IndexByte(t.always, c.mode) != -1:
+			// some servers don't bother sending the key when it's removed
+			if len(args) > 0 {
+				c.arg, args = args[0], args[1:]
+			} else if add {
+				return changes, fmt.Errorf("not enough arguments for %c", c.mode)
+			}
+		case add && strings.IndexByte(t.set, c.mode) != -1:
+			if len(args) == 0 {
+				return changes, fmt.Errorf("not enough arguments for %c", c.mode)
+			}
+			c.arg, args = args[0], args[1:]
 		}
+		changes = append(changes, c)
 	}
-	if funcs, ok := conn.events[line.Cmd]; ok {
-		for _, f := range funcs {
-			go f(conn, line)
+	return changes, nil
+}
+
+// Updates our idea of ch's modes, and the privileges of nicks on it
+func (conn *Conn) applyChanModes(ch *Channel, changes []modeChange, t modeTypes) {
+	for _, c := range changes {
+		if strings.IndexByte(t.list, c.mode) != -1 {
+			ch.setList(c.mode, c.arg, c.add)
+			continue
 		}
+		if strings.IndexByte(t.prefix, c.mode) != -1 {
+			n := conn.GetNick(c.arg)
+			p := ch.privs(n)
+			if p == nil || n == nil {
+				conn.error("irc.MODE(): MODE %s %c %s: buh? state tracking failure.", ch.Name, c.mode, c.arg)
+				continue
+			}
+			p.set(c.mode, c.add)
+			continue
+		}
+		switch c.mode {
+		case 'i':
+			ch.Modes.InviteOnly = c.add
+		case 'm':
+			ch.Modes.Moderated = c.add
+		case 'n':
+			ch.Modes.NoExternalMsg = c.add
+		case 'p':
+			ch.Modes.Private = c.add
+		case 's':
+			ch.Modes.Secret = c.add
+		case 't':
+			ch.Modes.ProtectedTopic = c.add
+		case 'z':
+			ch.Modes.SSLOnly = c.add
+		case 'O':
+			ch.Modes.OperOnly = c.add
+		case 'k':
+			if c.add {
+				// NOTE: this isn't added as a secret, as the server
+				// sends non-ops placeholders like "*"; keys we
+				// supply ourselves are, see JoinKey()
+				ch.Modes.Key = c.arg
+			} else {
+				ch.Modes.Key = ""
+			}
+		case 'l':
+			if c.add {
+				ch.Modes.Limit, _ = strconv.Atoi(c.arg)
+			} else {
+				ch.Modes.Limit = 0
+			}
+		}
+	}
+}
+
+// Decodes a CTCP message, "\001TYPE text\001", into its upper-cased type and
+// text. ok is false if s isn't a CTCP message.
+func parseCTCP(s string) (cmd, text string, ok bool) {
+	if len(s) < 3 || s[0] != '\001' || s[len(s)-1] != '\001' {
+		return "", "", false
+	}
+	t := strings.SplitN(s[1:len(s)-1], " ", 2)
+	if len(t) > 1 {
+		text = t[1]
+	}
+	return strings.ToUpper(t[0]), text, true
+}
+
+// Updates n's ident and host. If n is us and our host has changed from one we
+// already knew, e.g. because we've been cloaked, a "HOSTCHANGED" event is
+// triggered with the new host in Args[0].
+func (conn *Conn) setHost(n *Nick, ident, host string) {
+	old := n.Host
+	n.Ident, n.Host = ident, host
+	if n == conn.Me && old != "" && old != host {
+		conn.dispatchEvent(&Line{Cmd: "HOSTCHANGED", Nick: n.Nick, Ident: ident,
+			Host: host, Src: n.Nick + "!" + ident + "@" + host, Args: []string{host}})
+	}
+}
+
+// Returns true if we have ops (or better) on channel
+func (conn *Conn) opOn(channel string) bool {
+	if ch := conn.GetChannel(channel); ch != nil {
+		if p := ch.privs(conn.Me); p != nil {
+			return p.Op || p.Admin || p.Owner
+		}
+	}
+	return false
+}
+
+// Sends a NOTICE to the ops of channel: to "@channel" if the server supports
+// it through STATUSMSG, otherwise to each op in turn.
+func (conn *Conn) noticeOps(channel, msg string) {
+	if v, ok := conn.ISupport("STATUSMSG"); ok && strings.Contains(v, "@") {
+		conn.Notice("@"+channel, msg)
+		return
+	}
+	ch := conn.GetChannel(channel)
+	if ch == nil {
+		return
+	}
+	for _, n := range ch.NickList() {
+		if p := ch.privs(n); n != conn.Me && p != nil && (p.Op || p.Admin || p.Owner) {
+			conn.Notice(n.Nick, msg)
+		}
+	}
+}
+
+// The token we put in our WHOX requests, so we know the replies are ours
+const whoxToken = "152"
+
+// Sends a WHO for target to fill in what we know about the nicks it matches,
+// using WHOX if the server supports it to get their accounts too.
+func (conn *Conn) who(target string) {
+	if _, ok := conn.ISupport("WHOX"); ok {
+		conn.writeMessage(NewMessage("WHO", target, "%tcuhnfar,"+whoxToken))
+	} else {
+		conn.Who(target)
 	}
 }
 
@@ -90,107 +621,340 @@ func (conn *Conn) dispatchEvent(line *Line) {
 // according to the people on freenode/#go-nuts ... :-(
 // see: http://golang.org/doc/go_spec.html#Method_expressions for details
 // I think this means we should be able to do something along the lines of:
-//   conn.AddHandler("event", (*Conn).h_handler);
+//
+//	conn.AddHandler("event", (*Conn).h_handler);
+//
 // where h_handler is declared in the irc package as:
-//   func (conn *Conn) h_handler(line *Line) {}
+//
+//	func (conn *Conn) h_handler(line *Line) {}
+//
 // in the future, but for now the compiler throws a hissy fit.
 func (conn *Conn) setupEvents() {
-	conn.events = make(map[string][]func(*Conn, *Line))
+	conn.events = make(map[string][]*handler)
 
-	// Basic ping/pong handler
-	conn.AddHandler("PING", func(conn *Conn, line *Line) { conn.Raw("PONG :" + line.Text) })
+	// Basic ping/pong handler, see pong()
+	conn.AddHandler("PING", func(conn *Conn, line *Line) { conn.writeMessage(pong(line)) })
 
-	// Handler to trigger a "CONNECTED" event on receipt of numeric 001
+	// Handle IRCv3 capability negotiation. We REQ everything we want that the
+	// server has offered, and end negotiation once it has replied to that.
+	conn.AddHandler("CAP", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			conn.error("irc.CAP(): buh? not enough arguments to process CAP %s", line.Text)
+			return
+		}
+		caps := strings.Fields(line.Text)
+		switch line.Args[1] {
+		case "LS", "NEW":
+			req := make([]string, 0, len(caps))
+			for _, c := range caps {
+				v := ""
+				if idx := strings.Index(c, "="); idx != -1 {
+					c, v = c[0:idx], c[idx+1:]
+				}
+				conn.capsAvail[c] = v
+				if _, ok := conn.capsWanted[c]; ok {
+					req = append(req, c)
+				}
+			}
+			if line.Args[1] == "LS" {
+				if len(line.Args) > 2 && line.Args[2] == "*" {
+					// multi-line LS reply, there's more to come
+					return
+				}
+				// REQ everything we want from all the lines of the reply
+				req = req[0:0]
+				for c := range conn.capsAvail {
+					if _, ok := conn.capsWanted[c]; ok {
+						req = append(req, c)
+					}
+				}
+			}
+			if len(req) > 0 {
+				conn.Cap("REQ", ":"+strings.Join(req, " "))
+			} else if !conn.connected {
+				conn.Cap("END", "")
+			}
+		case "ACK":
+			for _, c := range caps {
+				if len(c) > 1 && c[0] == '-' {
+					delete(conn.caps, c[1:])
+				} else {
+					conn.caps[c] = true
+				}
+			}
+			if !conn.connected {
+				conn.Cap("END", "")
+			}
+		case "NAK":
+			if !conn.connected {
+				conn.Cap("END", "")
+			}
+		case "DEL":
+			for _, c := range caps {
+				delete(conn.capsAvail, c)
+				delete(conn.caps, c)
+			}
+		}
+	})
+	// invite-notify tells us about INVITEs to channels we're in, see below
+	conn.RequestCap("invite-notify")
+	// message-tags lets us send and receive Line.Tags
+	conn.RequestCap("message-tags")
+	// batch and chathistory are needed for ChatHistory(), see batch.go
+	conn.RequestCap("batch")
+	conn.RequestCap("chathistory")
+	conn.RequestCap("draft/chathistory")
+
+	// Handle 001 welcome messages, which tell us we're connected
 	conn.AddHandler("001", func(conn *Conn, line *Line) {
 		// we're connected!
 		conn.connected = true
-		conn.dispatchEvent(&Line{Cmd: "CONNECTED"})
-		// and we're being given our hostname (from the server's perspective)
+		// we might not have been given the nick we asked for, e.g. if the
+		// server truncated it, so believe what the server calls us
+		if len(line.Args) > 0 && !conn.EqualFold(line.Args[0], conn.Me.Nick) {
+			conn.Me.reNick(line.Args[0])
+		}
+		// and we may be being given our hostname (from the server's
+		// perspective). Not all servers do this, so ask for it too.
 		if ridx := strings.LastIndex(line.Text, " "); ridx != -1 {
 			h := line.Text[ridx+1 : len(line.Text)]
 			if idx := strings.Index(h, "@"); idx != -1 {
-				conn.Me.Host = h[idx+1 : len(h)]
+				conn.Me.Host = h[idx+1:]
 			}
 		}
+		conn.Whois(conn.Me.Nick)
 	})
 
-	// XXX: do we need 005 protocol support message parsing here?
-	// probably in the future, but I can't quite be arsed yet.
+	// Handler to trigger a "CONNECTED" event on the end of the MOTD (or a
+	// lack of one), by which time we know what the server supports. The
+	// network name from 005 is in Args[0], if the server sent one.
+	connected := func(conn *Conn, line *Line) {
+		if conn.announced {
+			// someone's asked for the MOTD again
+			return
+		}
+		conn.announced = true
+		network, _ := conn.ISupport("NETWORK")
+		conn.dispatchEvent(&Line{Cmd: "CONNECTED", Host: line.Host,
+			Src: line.Src, Args: []string{network}})
+	}
+	conn.AddHandler("376", connected)
+	conn.AddHandler("422", connected)
+
+	// Handle 005 protocol support messages, which look like:
 	/*
-	:irc.pl0rt.org 005 GoTest CMDS=KNOCK,MAP,DCCALLOW,USERIP UHNAMES NAMESX SAFELIST HCN MAXCHANNELS=20 CHANLIMIT=#:20 MAXLIST=b:60,e:60,I:60 NICKLEN=30 CHANNELLEN=32 TOPICLEN=307 KICKLEN=307 AWAYLEN=307 :are supported by this server
-	:irc.pl0rt.org 005 GoTest MAXTARGETS=20 WALLCHOPS WATCH=128 WATCHOPTS=A SILENCE=15 MODES=12 CHANTYPES=# PREFIX=(qaohv)~&@%+ CHANMODES=beI,kfL,lj,psmntirRcOAQKVCuzNSMT NETWORK=bb101.net CASEMAPPING=ascii EXTBAN=~,cqnr ELIST=MNUCT :are supported by this server
-	:irc.pl0rt.org 005 GoTest STATUSMSG=~&@%+ EXCEPTS INVEX :are supported by this server
+		:irc.pl0rt.org 005 GoTest CMDS=KNOCK,MAP,DCCALLOW,USERIP UHNAMES NAMESX SAFELIST HCN MAXCHANNELS=20 CHANLIMIT=#:20 MAXLIST=b:60,e:60,I:60 NICKLEN=30 CHANNELLEN=32 TOPICLEN=307 KICKLEN=307 AWAYLEN=307 :are supported by this server
+		:irc.pl0rt.org 005 GoTest MAXTARGETS=20 WALLCHOPS WATCH=128 WATCHOPTS=A SILENCE=15 MODES=12 CHANTYPES=# PREFIX=(qaohv)~&@%+ CHANMODES=beI,kfL,lj,psmntirRcOAQKVCuzNSMT NETWORK=bb101.net CASEMAPPING=ascii EXTBAN=~,cqnr ELIST=MNUCT :are supported by this server
+		:irc.pl0rt.org 005 GoTest STATUSMSG=~&@%+ EXCEPTS INVEX :are supported by this server
 	*/
+	// The tokens end up in conn.isupport, see conn.ISupport()
+	conn.AddHandler("005", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			return
+		}
+		conn.isupportMu.Lock()
+		for _, tok := range line.Args[1:len(line.Args)] {
+			if len(tok) > 1 && tok[0] == '-' {
+				delete(conn.isupport, tok[1:])
+				continue
+			}
+			kv := strings.SplitN(tok, "=", 2)
+			if len(kv) > 1 {
+				conn.isupport[kv[0]] = kv[1]
+			} else {
+				conn.isupport[kv[0]] = ""
+			}
+		}
+		conn.isupportMu.Unlock()
+		// nicks we already know about may need filing differently
+		conn.refold()
+	})
 
 	// Handler to deal with "433 :Nickname already in use"
 	conn.AddHandler("433", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			conn.error("irc.433(): buh? no nick in %s", line.Raw)
+			return
+		}
 		// Args[1] is the new nick we were attempting to acquire
-		conn.Nick(line.Args[1] + "_")
+		nick := altNick(line.Args[1], conn.Limit("NICKLEN"))
+		if nick == "" {
+			conn.error("irc.433(): ran out of nicks to try after %s", line.Args[1])
+			return
+		}
+		if err := conn.Nick(nick); err != nil {
+			conn.error("irc.433(): %s", err.Error())
+			return
+		}
 		// if this is happening before we're properly connected (i.e. the nick
 		// we sent in the initial NICK command is in use) we will not receive
-		// a NICK message to confirm our change of nick, so ReNick here...
-		if !conn.connected && line.Args[1] == conn.Me.Nick {
-			conn.Me.ReNick(line.Args[1] + "_")
+		// a NICK message to confirm our change of nick, so reNick here...
+		if !conn.connected && conn.EqualFold(line.Args[1], conn.Me.Nick) {
+			conn.Me.reNick(nick)
 		}
 	})
 
 	// Handler NICK messages to inform us about nick changes
 	conn.AddHandler("NICK", func(conn *Conn, line *Line) {
 		// all nicks should be handled the same way, our own included
-		if n := conn.GetNick(line.Nick); n != nil {
-			n.ReNick(line.Text)
+		nick := line.Text
+		if nick == "" && len(line.Args) > 0 {
+			nick = line.Args[0]
+		}
+		if nick == "" {
+			conn.error("irc.NICK(): buh? no new nick for %s", line.Nick)
+		} else if n := conn.GetNick(line.Nick); n != nil {
+			n.reNick(nick)
 		} else {
 			conn.error("irc.NICK(): buh? unknown nick %s.", line.Nick)
 		}
 	})
 
-	// Handle VERSION requests and CTCP PING
+	// Handle CTCP PING and the requests in conn.CtcpReplies, like VERSION
 	conn.AddHandler("CTCP", func(conn *Conn, line *Line) {
-		if line.Args[0] == "VERSION" {
-			conn.CtcpReply(line.Nick, "VERSION", "powered by goirc...")
-		} else if line.Args[0] == "PING" {
-			conn.CtcpReply(line.Nick, "PING", line.Text)
+		if len(line.Args) == 0 {
+			// a server sending us CTCP lines of its own, not one we decoded
+			return
+		}
+		if conn.NoCtcpReplies {
+			return
+		}
+		r, ok := conn.CtcpReplies[line.Args[0]]
+		if line.Args[0] == "PING" {
+			r, ok = line.Text, true
+		}
+		if ok && conn.ctcpReplyAllowed() {
+			conn.CtcpReply(line.Nick, line.Args[0], r)
+		}
+	})
+
+	// Handle SILENCE confirmations from the server to keep our list in sync
+	conn.AddHandler("SILENCE", func(conn *Conn, line *Line) {
+		mask := line.Text
+		if len(line.Args) > 0 {
+			mask = line.Args[0]
+		}
+		if len(mask) > 1 && mask[0] == '+' {
+			conn.setSilenced(mask[1:], true)
+		} else if len(mask) > 1 && mask[0] == '-' {
+			conn.setSilenced(mask[1:], false)
 		}
 	})
 
+	// Handle INVITEs, joining the channel if conn.AutoJoinInvites is set.
+	// With invite-notify we'll also see other people's invites, so make sure
+	// we only follow the ones actually directed at us.
+	conn.AddHandler("INVITE", func(conn *Conn, line *Line) {
+		if !conn.AutoJoinInvites || len(line.Args) < 2 || !conn.EqualFold(line.Args[0], conn.Me.Nick) {
+			return
+		}
+		follow := len(conn.InviteMasks) == 0
+		for _, mask := range conn.InviteMasks {
+			if matchMask(conn.Fold(mask), conn.Fold(line.Src)) {
+				follow = true
+				break
+			}
+		}
+		if follow {
+			conn.Join(line.Args[1])
+		}
+	})
+
+	// Turn invite-notify INVITEs of other people to channels we op into
+	// "CHANINVITE" events, with the channel in Args[0] and who was invited in
+	// Args[1]. Nick and Src are whoever did the inviting.
+	conn.AddHandler("INVITE", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 || conn.EqualFold(line.Args[0], conn.Me.Nick) || !conn.opOn(line.Args[1]) {
+			return
+		}
+		conn.dispatchEvent(&Line{Cmd: "CHANINVITE", Nick: line.Nick, Ident: line.Ident,
+			Host: line.Host, Src: line.Src, Args: []string{line.Args[1], line.Args[0]}})
+	})
+
+	// Handle 710 knock notifications, which look like:
+	//	:server 710 #moo #moo nick!user@host :has asked for an invite.
+	// by triggering a "KNOCK" event with the channel in Args[0] and the
+	// knocker's nick!user@host in Args[1], and telling the channel's ops about
+	// it if conn.RelayKnocks is set.
+	conn.AddHandler("710", func(conn *Conn, line *Line) {
+		if len(line.Args) < 3 {
+			conn.error("irc.710(): buh? not enough arguments in %s", line.Raw)
+			return
+		}
+		channel, src := line.Args[1], line.Args[2]
+		conn.dispatchEvent(&Line{Cmd: "KNOCK", Src: line.Src, Host: line.Host,
+			Args: []string{channel, src}, Text: line.Text})
+		if conn.RelayKnocks && conn.opOn(channel) {
+			conn.noticeOps(channel, src+" knocked on "+channel+": "+line.Text)
+		}
+	})
+
+	// Turn NOTICEs from the server itself, rather than from a nick, into
+	// "SERVERNOTICE" events so they don't have to be picked out from user
+	// NOTICEs. These include connection notices sent before we've registered
+	// and, for opers, server notices like "*** Notice -- ...". Text is the
+	// notice without any leading "*** ". WALLOPS are already their own event.
+	conn.AddHandler("NOTICE", func(conn *Conn, line *Line) {
+		if line.Nick != "" {
+			return
+		}
+		conn.dispatchEvent(&Line{Cmd: "SERVERNOTICE", Src: line.Src, Host: line.Host,
+			Args: line.Args, Text: strings.TrimPrefix(line.Text, "*** "), Tags: line.Tags})
+	})
+
 	// Handle JOINs to channels to maintain state
 	conn.AddHandler("JOIN", func(conn *Conn, line *Line) {
-		ch := conn.GetChannel(line.Text)
+		// the channel isn't always sent as the trailing parameter
+		name := line.Text
+		if len(line.Args) > 0 {
+			name = line.Args[0]
+		}
+		if name == "" || line.Nick == "" {
+			conn.error("irc.JOIN(): buh? not sure what to do with JOIN %s", line.Raw)
+			return
+		}
+		ch := conn.GetChannel(name)
 		n := conn.GetNick(line.Nick)
+		if ch != nil && n == conn.Me && ch.privs(n) != nil {
+			// we never saw ourselves leave, so what we know is stale
+			ch.delete()
+			ch = nil
+			conn.dispatchEvent(&Line{Cmd: "DESYNC", Args: []string{name, "DUPLICATEJOIN"}})
+		}
 		if ch == nil {
 			// first we've seen of this channel, so should be us joining it
 			// NOTE this will also take care of n == nil && ch == nil
 			if n != conn.Me {
-				conn.error("irc.JOIN(): buh? JOIN to unknown channel %s recieved from (non-me) nick %s", line.Text, line.Nick)
+				conn.error("irc.JOIN(): buh? JOIN to unknown channel %s recieved from (non-me) nick %s", name, line.Nick)
 				return
 			}
-			ch = conn.NewChannel(line.Text)
-			// since we don't know much about this channel, ask server for info
-			// we get the channel users automatically in 353 and the channel
-			// topic in 332 on join, so we just need to get the modes
-			conn.Mode(ch.Name,"")
-			// sending a WHO for the channel is MUCH more efficient than
-			// triggering a WHOIS on every nick from the 353 handler
-			conn.Who(ch.Name)
+			ch = conn.newChannel(name)
+			// since we don't know much about this channel, ask server for
+			// info when there's a gap in the traffic, see sync.go
+			conn.queueSync(ch)
 		}
 		if n == nil {
 			// this is the first we've seen of this nick
-			n = conn.NewNick(line.Nick, line.Ident, "", line.Host)
+			n = conn.newNick(line.Nick, line.Ident, "", line.Host)
 			// since we don't know much about this nick, ask server for info
-			conn.Who(n.Nick)
+			conn.who(n.Nick)
 		}
 		// this takes care of both nick and channel linking \o/
-		ch.AddNick(n)
+		ch.addNick(n)
 	})
 
 	// Handle PARTs from channels to maintain state
 	conn.AddHandler("PART", func(conn *Conn, line *Line) {
-		ch := conn.GetChannel(line.Args[0])
+		name := line.Text
+		if len(line.Args) > 0 {
+			name = line.Args[0]
+		}
+		ch := conn.GetChannel(name)
 		n := conn.GetNick(line.Nick)
 		if ch != nil && n != nil {
-			ch.DelNick(n)
+			ch.delNick(n)
 		} else {
-			conn.error("irc.PART(): buh? PART of channel %s by nick %s", line.Args[0], line.Nick)
+			conn.error("irc.PART(): buh? PART of channel %s by nick %s", name, line.Nick)
 		}
 	})
 
@@ -198,10 +962,14 @@ func (conn *Conn) setupEvents() {
 	conn.AddHandler("KICK", func(conn *Conn, line *Line) {
 		// XXX: this won't handle autorejoining channels on KICK
 		// it's trivial to do this in a seperate handler...
+		if len(line.Args) < 2 {
+			conn.error("irc.KICK(): buh? not sure what to do with KICK %s", line.Raw)
+			return
+		}
 		ch := conn.GetChannel(line.Args[0])
 		n := conn.GetNick(line.Args[1])
 		if ch != nil && n != nil {
-			ch.DelNick(n)
+			ch.delNick(n)
 		} else {
 			conn.error("irc.KICK(): buh? KICK from channel %s of nick %s", line.Args[0], line.Args[1])
 		}
@@ -210,118 +978,81 @@ func (conn *Conn) setupEvents() {
 	// Handle other people's QUITs
 	conn.AddHandler("QUIT", func(conn *Conn, line *Line) {
 		if n := conn.GetNick(line.Nick); n != nil {
-			n.Delete()
+			n.delete()
 		} else {
 			conn.error("irc.QUIT(): buh? QUIT from unknown nick %s", line.Nick)
 		}
 	})
 
 	// Handle MODE changes for channels we know about (and our nick personally)
-	// this is moderately ugly. suggestions for improvement welcome
 	conn.AddHandler("MODE", func(conn *Conn, line *Line) {
+		p := params(line, 1)
+		if len(line.Args) == 0 || len(p) == 0 {
+			conn.error("irc.MODE(): buh? no modes in MODE %s", line.Raw)
+			return
+		}
 		// channel modes first
 		if ch := conn.GetChannel(line.Args[0]); ch != nil {
-			modeargs := line.Args[2:len(line.Args)]
-			var modeop bool // true => add mode, false => remove mode
-			var modestr string
-			for i := 0; i < len(line.Args[1]); i++ {
-				switch m := line.Args[1][i]; m {
-				case '+':
-					modeop = true
-					modestr = string(m)
-				case '-':
-					modeop = false
-					modestr = string(m)
-				case 'i':
-					ch.Modes.InviteOnly = modeop
-				case 'm':
-					ch.Modes.Moderated = modeop
-				case 'n':
-					ch.Modes.NoExternalMsg = modeop
-				case 'p':
-					ch.Modes.Private = modeop
-				case 's':
-					ch.Modes.Secret = modeop
-				case 't':
-					ch.Modes.ProtectedTopic = modeop
-				case 'z':
-					ch.Modes.SSLOnly = modeop
-				case 'O':
-					ch.Modes.OperOnly = modeop
-				case 'k':
-					if len(modeargs) != 0 {
-						ch.Modes.Key, modeargs = modeargs[0], modeargs[1:len(modeargs)]
-					} else {
-						conn.error("irc.MODE(): buh? not enough arguments to process MODE %s %s%s", ch.Name, modestr, m)
-					}
-				case 'l':
-					if len(modeargs) != 0 {
-						ch.Modes.Limit, _ = strconv.Atoi(modeargs[0])
-						modeargs = modeargs[1:len(modeargs)]
-					} else {
-						conn.error("irc.MODE(): buh? not enough arguments to process MODE %s %s%s", ch.Name, modestr, m)
-					}
-				case 'q', 'a', 'o', 'h', 'v':
-					if len(modeargs) != 0 {
-						n := conn.GetNick(modeargs[0])
-						if p, ok := ch.Nicks[n]; ok && n != nil {
-							switch m {
-							case 'q':
-								p.Owner = modeop
-							case 'a':
-								p.Admin = modeop
-							case 'o':
-								p.Op = modeop
-							case 'h':
-								p.HalfOp = modeop
-							case 'v':
-								p.Voice = modeop
-							}
-							modeargs = modeargs[1:len(modeargs)]
-						} else {
-							conn.error("irc.MODE(): MODE %s %s%s %s: buh? state tracking failure.", ch.Name, modestr, m, modeargs[0])
-						}
-					} else {
-						conn.error("irc.MODE(): buh? not enough arguments to process MODE %s %s%s", ch.Name, modestr, m)
-					}
-				}
+			t := conn.modeTypes()
+			changes, err := parseModeChange(p[0], p[1:], t)
+			if err != nil {
+				conn.error("irc.MODE(): buh? %s in MODE %s %s", err, ch.Name, strings.Join(p, " "))
 			}
+			conn.applyChanModes(ch, changes, t)
 		} else if n := conn.GetNick(line.Args[0]); n != nil {
 			// nick mode change, should be us
 			if n != conn.Me {
-				conn.error("irc.MODE(): buh? recieved MODE %s for (non-me) nick %s", line.Text, n.Nick)
+				conn.error("irc.MODE(): buh? recieved MODE %s for (non-me) nick %s", p[0], n.Nick)
+				return
+			}
+			// the modes and any snomask can all be in the trailing part
+			if p = strings.Fields(strings.Join(p, " ")); len(p) == 0 {
 				return
 			}
-			var modeop bool // true => add mode, false => remove mode
-			for i := 0; i < len(line.Text); i++ {
-				switch m := line.Text[i]; m {
-				case '+':
-					modeop = true
-				case '-':
-					modeop = false
+			changes, _ := parseModeChange(p[0], nil, modeTypes{})
+			whois := false
+			conn.state.Lock()
+			for _, c := range changes {
+				switch c.mode {
+				case 's':
+					// opers' snomask changes come after, as in "+s +cF-k"
+					if !c.add {
+						n.Modes.Snomasks = nil
+					} else if len(p) > 1 {
+						n.Modes.setSnomasks(p[1])
+					}
 				case 'i':
-					n.Modes.Invisible = modeop
+					n.Modes.Invisible = c.add
 				case 'o':
-					n.Modes.Oper = modeop
+					n.Modes.Oper = c.add
 				case 'w':
-					n.Modes.WallOps = modeop
+					n.Modes.WallOps = c.add
 				case 'x':
-					n.Modes.HiddenHost = modeop
+					// our host is about to change, if it hasn't already.
+					// Some servers tell us the new one with a 396, but
+					// not all of them, so ask.
+					whois = whois || n.Modes.HiddenHost != c.add
+					n.Modes.HiddenHost = c.add
 				case 'z':
-					n.Modes.SSL = modeop
+					n.Modes.SSL = c.add
 				}
 			}
-		} else {
-			if line.Text != "" {
-				conn.error("irc.MODE(): buh? not sure what to do with nick MODE %s %s", line.Args[0], line.Text)
-			} else {
-				conn.error("irc.MODE(): buh? not sure what to do with chan MODE %s", strings.Join(line.Args, " "))
+			nick := n.Nick
+			conn.state.Unlock()
+			if whois {
+				conn.Whois(nick)
 			}
+		} else {
+			conn.error("irc.MODE(): buh? not sure what to do with MODE %s %s", line.Args[0], strings.Join(p, " "))
 		}
 	})
 
 	// Handle TOPIC changes for channels
 	conn.AddHandler("TOPIC", func(conn *Conn, line *Line) {
+		if len(line.Args) < 1 {
+			conn.error("irc.TOPIC(): buh? no channel in TOPIC %s", line.Raw)
+			return
+		}
 		if ch := conn.GetChannel(line.Args[0]); ch != nil {
 			ch.Topic = line.Text
 		} else {
@@ -331,68 +1062,161 @@ func (conn *Conn) setupEvents() {
 
 	// Handle 311 whois reply
 	conn.AddHandler("311", func(conn *Conn, line *Line) {
+		if len(line.Args) < 4 {
+			conn.error("irc.311(): buh? not enough arguments in %s", line.Raw)
+			return
+		}
 		if n := conn.GetNick(line.Args[1]); n != nil {
-			n.Ident = line.Args[2]
-			n.Host = line.Args[3]
+			conn.setHost(n, line.Args[2], line.Args[3])
 			n.Name = line.Text
 		} else {
 			conn.error("irc.311(): buh? received WHOIS info for unknown nick %s", line.Args[1])
 		}
 	})
 
+	// Handle 396 "is now your displayed host", which servers send when they
+	// cloak us. Args[1] is either host or ident@host.
+	conn.AddHandler("396", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			conn.error("irc.396(): buh? no host in %s", line.Raw)
+			return
+		}
+		ident, host := conn.Me.Ident, line.Args[1]
+		if idx := strings.Index(host, "@"); idx != -1 {
+			ident, host = host[0:idx], host[idx+1:]
+		}
+		conn.setHost(conn.Me, ident, host)
+	})
+
+	// Handle 271 silence list reply
+	conn.AddHandler("271", func(conn *Conn, line *Line) {
+		if len(line.Args) > 1 {
+			conn.setSilenced(line.Args[len(line.Args)-1], true)
+		} else {
+			conn.error("irc.271(): buh? received SILENCE list entry with no mask")
+		}
+	})
+
+	// Handle 381 "You are now an IRC operator" by triggering an "OPERED" event
+	conn.AddHandler("381", func(conn *Conn, line *Line) {
+		conn.state.Lock()
+		conn.Me.Modes.Oper = true
+		conn.state.Unlock()
+		conn.dispatchEvent(&Line{Cmd: "OPERED", Text: line.Text})
+	})
+
+	// Handle 305 and 306, the server confirming Back() and Away(), by keeping
+	// track of whether we're away in conn.Me.Away and triggering "UNAWAY" and
+	// "NOWAWAY" events
+	conn.AddHandler("305", func(conn *Conn, line *Line) {
+		conn.Me.Away = false
+		conn.dispatchEvent(&Line{Cmd: "UNAWAY", Text: line.Text})
+	})
+	conn.AddHandler("306", func(conn *Conn, line *Line) {
+		conn.Me.Away = true
+		conn.dispatchEvent(&Line{Cmd: "NOWAWAY", Text: line.Text})
+	})
+
+	// Handle 382 "Rehashing" by triggering a "REHASHING" event, with the
+	// name of the config file being rehashed in Args[0]
+	conn.AddHandler("382", func(conn *Conn, line *Line) {
+		a := []string{""}
+		if len(line.Args) > 1 {
+			a[0] = line.Args[1]
+		}
+		conn.dispatchEvent(&Line{Cmd: "REHASHING", Args: a, Text: line.Text})
+	})
+
+	// Handle 464 "Password incorrect" and 491 "No O-lines for your host" by
+	// triggering an "OPERFAILED" event, with the numeric in Args[0]. Before
+	// we're connected a 464 is about the server password, not OPER.
+	operfail := func(conn *Conn, line *Line) {
+		if !conn.connected {
+			return
+		}
+		conn.dispatchEvent(&Line{Cmd: "OPERFAILED", Args: []string{line.Cmd}, Text: line.Text})
+	}
+	conn.AddHandler("464", operfail)
+	conn.AddHandler("491", operfail)
+
+	// Handle 481 "Permission Denied" by triggering a "NOPRIVILEGES" event
+	conn.AddHandler("481", func(conn *Conn, line *Line) {
+		conn.dispatchEvent(&Line{Cmd: "NOPRIVILEGES", Text: line.Text})
+	})
+
 	// Handle 324 mode reply
 	conn.AddHandler("324", func(conn *Conn, line *Line) {
-		// XXX: copypasta from MODE, needs tidying.
+		p := params(line, 2)
+		if len(line.Args) < 2 || len(p) == 0 {
+			conn.error("irc.324(): buh? no modes in %s", line.Raw)
+			return
+		}
 		if ch := conn.GetChannel(line.Args[1]); ch != nil {
-			modeargs := line.Args[3:len(line.Args)]
-			var modeop bool // true => add mode, false => remove mode
-			var modestr string
-			for i := 0; i < len(line.Args[2]); i++ {
-				switch m := line.Args[2][i]; m {
-				case '+':
-					modeop = true
-					modestr = string(m)
-				case '-':
-					modeop = false
-					modestr = string(m)
-				case 'i':
-					ch.Modes.InviteOnly = modeop
-				case 'm':
-					ch.Modes.Moderated = modeop
-				case 'n':
-					ch.Modes.NoExternalMsg = modeop
-				case 'p':
-					ch.Modes.Private = modeop
-				case 's':
-					ch.Modes.Secret = modeop
-				case 't':
-					ch.Modes.ProtectedTopic = modeop
-				case 'z':
-					ch.Modes.SSLOnly = modeop
-				case 'O':
-					ch.Modes.OperOnly = modeop
-				case 'k':
-					if len(modeargs) != 0 {
-						ch.Modes.Key, modeargs = modeargs[0], modeargs[1:len(modeargs)]
-					} else {
-						conn.error("irc.324(): buh? not enough arguments to process MODE %s %s%s", ch.Name, modestr, m)
-					}
-				case 'l':
-					if len(modeargs) != 0 {
-						ch.Modes.Limit, _ = strconv.Atoi(modeargs[0])
-						modeargs = modeargs[1:len(modeargs)]
-					} else {
-						conn.error("irc.324(): buh? not enough arguments to process MODE %s %s%s", ch.Name, modestr, m)
-					}
-				}
+			t := conn.modeTypes()
+			changes, err := parseModeChange(p[0], p[1:], t)
+			if err != nil {
+				conn.error("irc.324(): buh? %s in MODE %s %s", err, ch.Name, strings.Join(p, " "))
 			}
+			conn.applyChanModes(ch, changes, t)
 		} else {
 			conn.error("irc.324(): buh? received MODE settings for unknown channel %s", line.Args[1])
 		}
 	})
 
+	// Handle 329 channel creation time reply, which follows 324
+	conn.AddHandler("329", func(conn *Conn, line *Line) {
+		if len(line.Args) < 3 {
+			conn.error("irc.329(): buh? not enough arguments in %s", line.Raw)
+			return
+		}
+		if ch := conn.GetChannel(line.Args[1]); ch != nil {
+			if t, err := strconv.ParseInt(line.Args[2], 10, 64); err == nil {
+				ch.Created = time.Unix(t, 0)
+			} else {
+				conn.error("irc.329(): buh? bad creation time %s for channel %s", line.Args[2], ch.Name)
+			}
+		} else {
+			conn.error("irc.329(): buh? received creation time for unknown channel %s", line.Args[1])
+		}
+	})
+
+	// Handle 328 channel URL reply, sent on join by some servers
+	conn.AddHandler("328", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			conn.error("irc.328(): buh? no channel in %s", line.Raw)
+			return
+		}
+		if ch := conn.GetChannel(line.Args[1]); ch != nil {
+			ch.URL = line.Text
+		} else {
+			conn.error("irc.328(): buh? received URL for unknown channel %s", line.Args[1])
+		}
+	})
+
+	// Handle 367 ban list and 728 quiet list replies, which look like:
+	//	:server 367 me #moo *!*@bad.host setter 1300000000
+	//	:server 728 me #moo q *!*@bad.host setter 1300000000
+	conn.AddHandler("367", func(conn *Conn, line *Line) {
+		if len(line.Args) < 3 {
+			conn.error("irc.367(): buh? no mask in %s", line.Raw)
+		} else if ch := conn.GetChannel(line.Args[1]); ch != nil {
+			ch.setList('b', line.Args[2], true)
+		}
+	})
+	conn.AddHandler("728", func(conn *Conn, line *Line) {
+		if len(line.Args) < 4 || len(line.Args[2]) != 1 {
+			conn.error("irc.728(): buh? no mask in %s", line.Raw)
+		} else if ch := conn.GetChannel(line.Args[1]); ch != nil {
+			ch.setList(line.Args[2][0], line.Args[3], true)
+		}
+	})
+
 	// Handle 332 topic reply on join to channel
 	conn.AddHandler("332", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			conn.error("irc.332(): buh? no channel in %s", line.Raw)
+			return
+		}
 		if ch := conn.GetChannel(line.Args[1]); ch != nil {
 			ch.Topic = line.Text
 		} else {
@@ -402,73 +1226,135 @@ func (conn *Conn) setupEvents() {
 
 	// Handle 352 who reply
 	conn.AddHandler("352", func(conn *Conn, line *Line) {
+		if len(line.Args) < 7 {
+			conn.error("irc.352(): buh? not enough arguments in %s", line.Raw)
+			return
+		}
 		if n := conn.GetNick(line.Args[5]); n != nil {
-			n.Ident = line.Args[2]
-			n.Host = line.Args[3]
+			conn.setHost(n, line.Args[2], line.Args[3])
 			// XXX: do we care about the actual server the nick is on?
 			//      or the hop count to this server?
 			// line.Text contains "<hop count> <real name>"
-			a := strings.Split(line.Text, " ", 2)
-			n.Name = a[1]
-			if idx := strings.Index(line.Args[6], "*"); idx != -1 {
-				n.Modes.Oper = true
-			}
-			if idx := strings.Index(line.Args[6], "H"); idx != -1 {
-				n.Modes.Invisible = true
+			if a := strings.SplitN(line.Text, " ", 2); len(a) > 1 {
+				n.Name = a[1]
 			}
+			n.whoFlags(line.Args[6])
 		} else {
 			conn.error("irc.352(): buh? got WHO reply for unknown nick %s", line.Args[5])
 		}
 	})
 
-	// Handle 353 names reply
+	// Handle 354 WHOX replies to the WHOs sent by conn.who(), which look like:
+	//	:server 354 me 152 #moo ident host nick H@ account :real name
+	// Other people's WHOX replies will have a different token, or none.
+	conn.AddHandler("354", func(conn *Conn, line *Line) {
+		if len(line.Args) < 8 || line.Args[1] != whoxToken {
+			return
+		}
+		if n := conn.GetNick(line.Args[5]); n != nil {
+			conn.setHost(n, line.Args[3], line.Args[4])
+			n.Name = line.Text
+			n.whoFlags(line.Args[6])
+			// "0" means they're not logged in
+			if n.Account = line.Args[7]; n.Account == "0" {
+				n.Account = ""
+			}
+		} else {
+			conn.error("irc.354(): buh? got WHO reply for unknown nick %s", line.Args[5])
+		}
+	})
+
+	// Handle 353 names replies. There may be several of these for a channel,
+	// so they're collected up until the 366 that ends them.
 	conn.AddHandler("353", func(conn *Conn, line *Line) {
+		if len(line.Args) < 3 {
+			conn.error("irc.353(): buh? no channel in %s", line.Raw)
+			return
+		}
 		if ch := conn.GetChannel(line.Args[2]); ch != nil {
-			nicks := strings.Split(line.Text, " ", -1)
-			for _, nick := range nicks {
-				// UnrealIRCd's coders are lazy and leave a trailing space
-				if nick == "" {
-					continue
-				}
-				switch c := nick[0]; c {
-				case '~', '&', '@', '%', '+':
-					nick = nick[1:len(nick)]
-					fallthrough
-				default:
-					n := conn.GetNick(nick)
-					if n == nil {
-						// we don't know this nick yet!
-						n = conn.NewNick(nick, "", "", "")
-					}
-					if n != conn.Me {
-						// we will be in the names list, but should also be in
-						// the channel's nick list from the JOIN handler above
-						ch.AddNick(n)
-					}
-					p := ch.Nicks[n]
-					switch c {
-					case '~':
-						p.Owner = true
-					case '&':
-						p.Admin = true
-					case '@':
-						p.Op = true
-					case '%':
-						p.HalfOp = true
-					case '+':
-						p.Voice = true
-					}
+			// UnrealIRCd's coders are lazy and leave a trailing space,
+			// which strings.Fields takes care of for us
+			ch.names = append(ch.names, strings.Fields(line.Text)...)
+		} else if !conn.resyncNames(line.Args[2], strings.Fields(line.Text)) {
+			conn.error("irc.353(): buh? received NAMES list for unknown channel %s", line.Args[2])
+		}
+	})
+
+	// Handle 366 end of names by adding everyone from the 353s to the channel
+	// and triggering a "CHANNELSYNCED" event with the channel in Args[0]
+	conn.AddHandler("366", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			conn.error("irc.366(): buh? no channel in %s", line.Raw)
+			return
+		}
+		ch := conn.GetChannel(line.Args[1])
+		if ch == nil {
+			// we already complained about the 353s, unless we're getting
+			// back in sync with the server, see desync.go
+			if ch = conn.resynced(line.Args[1]); ch == nil {
+				return
+			}
+		}
+		t := conn.modeTypes()
+		for _, nick := range ch.names {
+			// with multi-prefix there may be more than one of these
+			modes := ""
+			for len(nick) > 0 {
+				if idx := strings.IndexByte(t.symbols, nick[0]); idx != -1 && idx < len(t.prefix) {
+					modes, nick = modes+t.prefix[idx:idx+1], nick[1:]
+				} else {
+					break
 				}
 			}
-		} else {
-			conn.error("irc.353(): buh? received NAMES list for unknown channel %s", line.Args[2])
+			if nick == "" {
+				continue
+			}
+			n := conn.GetNick(nick)
+			if n == nil {
+				// we don't know this nick yet!
+				n = conn.newNick(nick, "", "", "")
+			}
+			p := ch.privs(n)
+			if p == nil {
+				// we will be in the names list, but should also be in
+				// the channel's nick list from the JOIN handler above
+				ch.addNick(n)
+				p = ch.privs(n)
+			}
+			for i := 0; i < len(modes); i++ {
+				p.set(modes[i], true)
+			}
 		}
+		ch.names = nil
+		ch.Synced = true
+		conn.dispatchEvent(&Line{Cmd: "CHANNELSYNCED", Src: line.Src, Host: line.Host,
+			Args: []string{ch.Name}})
 	})
 
+	// Handle numerics telling us we couldn't join a channel by triggering a
+	// "JOINERROR" event, with the channel in Args[0] and the reason from
+	// JoinErrors in Args[1]. Text is the server's explanation, if any.
+	joinerror := func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			return
+		}
+		conn.dispatchEvent(&Line{Cmd: "JOINERROR", Src: line.Src, Host: line.Host,
+			Args: []string{line.Args[1], JoinErrors[line.Cmd]}, Text: line.Text})
+	}
+	for num := range JoinErrors {
+		conn.AddHandler(num, joinerror)
+	}
+
 	// Handle 671 whois reply (nick connected via SSL)
 	conn.AddHandler("671", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			conn.error("irc.671(): buh? no nick in %s", line.Raw)
+			return
+		}
 		if n := conn.GetNick(line.Args[1]); n != nil {
+			conn.state.Lock()
 			n.Modes.SSL = true
+			conn.state.Unlock()
 		} else {
 			conn.error("irc.671(): buh? received WHOIS SSL info for unknown nick %s", line.Args[1])
 		}
@@ -0,0 +1,73 @@
+package irc
+
+// Here you'll find the tracking of when channels were last active, so that
+// bots invited into lots of channels can find (and leave) the dead ones.
+
+import (
+	"time"
+)
+
+// Keeps track of when channels were last talked in, and every so often looks
+// for ones that have been quiet for longer than conn.IdleTimeout, triggering
+// an "IDLECHANNEL" event with the channel in Args[0] for each (and parting
+// them if conn.IdlePart is set). Called from dispatchEvent(), so that the
+// check needs no goroutine of its own. That's also called from handlers for
+// the events they trigger, so this holds conn.state while it looks at the
+// channels, and triggers the events once it has let go of it.
+func (conn *Conn) idleLine(line *Line) {
+	now := time.Now()
+	switch line.Cmd {
+	case "PRIVMSG", "NOTICE", "ACTION", "TOPIC":
+		if len(line.Args) > 0 && line.Nick != "" {
+			if ch := conn.GetChannel(line.Args[0]); ch != nil {
+				conn.state.Lock()
+				ch.Active, ch.idle = now, false
+				conn.state.Unlock()
+			}
+		}
+	}
+	if conn.IdleTimeout <= 0 {
+		return
+	}
+	// no need to look more than once a minute, unless the timeout's shorter
+	every := time.Minute
+	if conn.IdleTimeout < every {
+		every = conn.IdleTimeout
+	}
+	conn.state.Lock()
+	if now.Sub(conn.idleChecked) < every {
+		conn.state.Unlock()
+		return
+	}
+	conn.idleChecked = now
+	idle := []string{}
+	for _, ch := range conn.chans {
+		if ch.idle || now.Sub(ch.Active) < conn.IdleTimeout {
+			continue
+		}
+		ch.idle = true
+		idle = append(idle, ch.Name)
+	}
+	conn.state.Unlock()
+	for _, name := range idle {
+		conn.dispatchEvent(&Line{Cmd: "IDLECHANNEL", Args: []string{name}})
+		if conn.IdlePart {
+			conn.Part(name, "")
+		}
+	}
+}
+
+// Returns the channels we're on that nobody has said anything in for at
+// least d, e.g. for a bot to list the ones it might want to leave.
+func (conn *Conn) IdleChannels(d time.Duration) []*Channel {
+	idle := []*Channel{}
+	now := time.Now()
+	conn.state.RLock()
+	defer conn.state.RUnlock()
+	for _, ch := range conn.chans {
+		if now.Sub(ch.Active) >= d {
+			idle = append(idle, ch)
+		}
+	}
+	return idle
+}
@@ -0,0 +1,51 @@
+package irc
+
+// Here you'll find ways to tell whether event handlers are keeping up with
+// what the server sends us. If they fall far enough behind, the server's
+// PINGs don't get answered in time and it disconnects us, so it's worth
+// knowing about before then.
+
+import (
+	"time"
+)
+
+// QueuedIn() returns the number of lines read from the server that are
+// waiting to be dispatched, including those queued for conn.Workers.
+func (conn *Conn) QueuedIn() int {
+	n := len(conn.in)
+	for _, w := range conn.workers {
+		n += len(w)
+	}
+	return n
+}
+
+// DispatchLatency() returns how long it was between reading the last line
+// handled and its handlers finishing.
+func (conn *Conn) DispatchLatency() time.Duration {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return conn.latency
+}
+
+// Called by runHandler() when a handler for line has finished. If it's been
+// longer than conn.SlowDispatch since line was read, a "SLOWDISPATCH" event
+// is triggered with the line's command in Args[0] and how long it took in
+// Args[1], at most once a minute so as not to add to the problem.
+func (conn *Conn) handled(line *Line) {
+	if line.read.IsZero() {
+		// we made it up ourselves, or it's from a replay
+		return
+	}
+	now := time.Now()
+	d := now.Sub(line.read)
+	conn.mu.Lock()
+	conn.latency = d
+	slow := conn.SlowDispatch > 0 && d > conn.SlowDispatch && now.Sub(conn.slowWarned) > time.Minute
+	if slow {
+		conn.slowWarned = now
+	}
+	conn.mu.Unlock()
+	if slow {
+		conn.dispatchEvent(&Line{Cmd: "SLOWDISPATCH", Args: []string{line.Cmd, d.String()}})
+	}
+}
@@ -0,0 +1,137 @@
+//go:build integration
+
+package irc
+
+// Tests against a real ircd, to check that what the library does matches what
+// servers actually do. They're behind the "integration" build tag and need
+// GOIRC_TEST_SERVER to say where the server is, e.g. with ergo in Docker:
+//
+//	docker run -d --rm -p 6667:6667 ghcr.io/ergochat/ergo:stable
+//	GOIRC_TEST_SERVER=localhost:6667 go test -tags integration ./irc
+//
+// Ergo is what these are written against; other ircds should mostly work,
+// but may differ in e.g. whether the first person to join a channel is opped.
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// How long to wait for the server to do anything
+const integrationTimeout = 10 * time.Second
+
+// A client connected to the test server, with the events tests wait for
+// sent down events as "CMD nick args..."
+type testClient struct {
+	*Conn
+	events chan string
+}
+
+// Connects a new client with a nick starting with nick, and waits for it to
+// be registered.
+func connectTestClient(t *testing.T, nick string) *testClient {
+	server := os.Getenv("GOIRC_TEST_SERVER")
+	if server == "" {
+		t.Skip("GOIRC_TEST_SERVER isn't set")
+	}
+	nick = fmt.Sprintf("%s%d", nick, time.Now().UnixNano()%100000)
+	c := &testClient{New(nick, "goirc", "goirc integration test"), make(chan string, 100)}
+	c.RequestCap("multi-prefix")
+	for _, cmd := range []string{"CONNECTED", "CHANNELREADY", "JOIN", "MODE", "KICK", "PRIVMSG"} {
+		c.AddHandler(cmd, func(conn *Conn, line *Line) {
+			c.events <- strings.Join(append([]string{line.Cmd, line.Nick}, params(line, 0)...), " ")
+		})
+	}
+	c.connect(t)
+	t.Cleanup(func() {
+		if c.Connected() {
+			c.Quit("done")
+			<-c.Disconnected()
+		}
+	})
+	return c
+}
+
+// Connects to the test server, and waits for registration to finish
+func (c *testClient) connect(t *testing.T) {
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Logf("%s: %s", c.Me.Nick, err)
+		}
+	}()
+	if err := c.Connect(os.Getenv("GOIRC_TEST_SERVER"), ""); err != nil {
+		t.Fatalf("Connect() failed: %s", err)
+	}
+	c.waitFor(t, "CONNECTED")
+}
+
+// Waits for an event starting with prefix, failing the test if there isn't
+// one in time. Events before it are thrown away.
+func (c *testClient) waitFor(t *testing.T, prefix string) string {
+	t.Helper()
+	timeout := time.After(integrationTimeout)
+	for {
+		select {
+		case e := <-c.events:
+			if strings.HasPrefix(e, prefix) {
+				return e
+			}
+		case <-timeout:
+			t.Fatalf("%s: timed out waiting for %q", c.Me.Nick, prefix)
+		}
+	}
+}
+
+func TestIntegration(t *testing.T) {
+	a := connectTestClient(t, "alice")
+	b := connectTestClient(t, "bob")
+	if !a.HasCap("multi-prefix") {
+		t.Errorf("expected the server to ack multi-prefix")
+	}
+
+	channel := fmt.Sprintf("#goirc%d", time.Now().UnixNano()%100000)
+	a.Join(channel)
+	a.waitFor(t, "CHANNELREADY")
+	if p := a.GetChannel(channel).Nicks[a.Me]; p == nil || !p.Op {
+		t.Fatalf("expected to be opped on creating %s, got %v", channel, p)
+	}
+
+	b.Join(channel)
+	a.waitFor(t, "JOIN "+b.Me.Nick)
+	if a.GetChannel(channel).Nicks[a.GetNick(b.Me.Nick)] == nil {
+		t.Errorf("%s should be tracking %s on %s", a.Me.Nick, b.Me.Nick, channel)
+	}
+
+	a.Mode(channel, "+v "+b.Me.Nick)
+	b.waitFor(t, "MODE "+a.Me.Nick)
+	if p := b.GetChannel(channel).Nicks[b.Me]; p == nil || !p.Voice {
+		t.Errorf("%s should be voiced on %s, got %v", b.Me.Nick, channel, p)
+	}
+
+	a.Privmsg(channel, "hello")
+	if e := b.waitFor(t, "PRIVMSG "+a.Me.Nick); e != "PRIVMSG "+a.Me.Nick+" "+channel+" hello" {
+		t.Errorf("unexpected PRIVMSG: %q", e)
+	}
+
+	a.Kick(channel, b.Me.Nick, "bye")
+	b.waitFor(t, "KICK "+a.Me.Nick)
+	if b.GetChannel(channel) != nil {
+		t.Errorf("%s shouldn't be tracking %s after being kicked", b.Me.Nick, channel)
+	}
+
+	// reconnecting should start afresh
+	b.Quit("brb")
+	select {
+	case <-b.Disconnected():
+	case <-time.After(integrationTimeout):
+		t.Fatalf("timed out waiting to disconnect")
+	}
+	b.connect(t)
+	if len(b.Channels()) != 0 {
+		t.Errorf("expected no channels after reconnecting, got %v", b.Channels())
+	}
+}
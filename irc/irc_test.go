@@ -1,7 +1,21 @@
 package irc
 
 import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 // Not really sure what or how to test something that basically requires a
@@ -13,3 +27,1785 @@ func TestIRC(t *testing.T) {
 	}
 }
 
+// Replaying a log is the closest thing we have to a fake server, so use it to
+// check that NAMES and MODE handling ends up with the right state.
+func TestReplay(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	log := "<- :srv 001 test :Welcome test!test@host\n" +
+		"-> WHOIS test\n" +
+		"<- :test!test@host JOIN :#moo\n" +
+		"<- :srv 353 test = #moo :test @bob +alice\n" +
+		"<- :srv 366 test #moo :End of /NAMES list.\n" +
+		"<- :bob!b@h MODE #moo +o-v alice alice\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	ch := c.GetChannel("#moo")
+	if ch == nil {
+		t.Fatalf("not tracking #moo after JOIN")
+	}
+	if !ch.Synced {
+		t.Errorf("#moo should be synced after 366")
+	}
+	if p := ch.Nicks[c.GetNick("alice")]; p == nil || !p.Op || p.Voice {
+		t.Errorf("alice should be +o-v on #moo, got %v", p)
+	}
+	if p := ch.Nicks[c.GetNick("bob")]; p == nil || !p.Op {
+		t.Errorf("bob should be +o on #moo, got %v", p)
+	}
+	names := []string{}
+	for _, n := range ch.NickList() {
+		names = append(names, n.Nick)
+	}
+	if strings.Join(names, " ") != "alice bob test" {
+		t.Errorf("expected ops then everyone else in NickList(), got %v", names)
+	}
+}
+
+// On charybdis-style servers +q is a list of quiets rather than owners
+func TestListModes(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":srv 005 test CHANMODES=eIbq,k,flj,CFLMPQScgimnprstz PREFIX=(ov)@+ :are supported\n" +
+		":test!test@host JOIN :#moo\n" +
+		":srv 353 test = #moo :@test bob\n" +
+		":srv 366 test #moo :End of /NAMES list.\n" +
+		":srv 367 test #moo *!*@spam setter 1300000000\n" +
+		":test!test@host MODE #moo +qbo-b *!*@noisy *!*@evil bob *!*@spam\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	ch := c.GetChannel("#moo")
+	if q := ch.Quiets(); len(q) != 1 || q[0] != "*!*@noisy" {
+		t.Errorf("expected quiets [*!*@noisy], got %q", q)
+	}
+	if b := ch.Bans(); len(b) != 1 || b[0] != "*!*@evil" {
+		t.Errorf("expected bans [*!*@evil], got %q", b)
+	}
+	if p := ch.Nicks[c.GetNick("bob")]; p == nil || !p.Op || p.Owner {
+		t.Errorf("bob should just be +o on #moo, got %v", p)
+	}
+}
+
+func TestParseExtBan(t *testing.T) {
+	tests := []struct {
+		mask, prefix, types string
+		want                *ExtBan
+	}{
+		{"$a:moo", "$", "ajrxz", &ExtBan{"$", "a", false, "moo"}},
+		{"$~a", "$", "ajrxz", &ExtBan{"$", "a", true, ""}},
+		{"~q:*!*@noisy", "~", "qjncrRa", &ExtBan{"~", "q", false, "*!*@noisy"}},
+		{"~account:moo", "~", "qjncrRa", &ExtBan{"~", "account", false, "moo"}},
+		{"R:moo", "", "ABCNOQRSTUcjmprsz", &ExtBan{"", "R", false, "moo"}},
+		{"*!*@host", "$", "ajrxz", nil},
+		{"$b:moo", "$", "ajrxz", nil},
+		{"nick!user@host:moo", "", "ABCNOQRSTUcjmprsz", nil},
+	}
+	for _, tt := range tests {
+		got := parseExtBan(tt.mask, tt.prefix, tt.types)
+		if (got == nil) != (tt.want == nil) || (got != nil && *got != *tt.want) {
+			t.Errorf("parseExtBan(%q) = %+v, expected %+v", tt.mask, got, tt.want)
+		} else if got != nil && got.String() != tt.mask {
+			t.Errorf("%+v.String() = %q, expected %q", got, got.String(), tt.mask)
+		}
+	}
+}
+
+func TestParseUserHost(t *testing.T) {
+	r := parseUserHost("bob*=+b@h.org alice=-a@[::1] broken=+ =x")
+	if len(r) != 2 {
+		t.Fatalf("expected 2 replies, got %d", len(r))
+	}
+	if *r[0] != (UserHostReply{"bob", "b", "h.org", true, false}) {
+		t.Errorf("got %+v for bob", *r[0])
+	}
+	if *r[1] != (UserHostReply{"alice", "a", "[::1]", false, true}) {
+		t.Errorf("got %+v for alice", *r[1])
+	}
+}
+
+// Handlers can be added by numeric name, and unhandled numerics get passed on
+func TestNumerics(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	var topic, numeric string
+	c.AddHandler("RPL_TOPIC", func(conn *Conn, line *Line) {
+		topic = line.Cmd
+	})
+	c.AddHandler("NUMERIC", func(conn *Conn, line *Line) {
+		numeric = line.Args[0]
+	})
+	log := ":srv 332 test #moo :moo\n" +
+		":srv 999 test :what's this?\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if topic != "332" {
+		t.Errorf("RPL_TOPIC handler got %q, expected 332", topic)
+	}
+	if numeric != "999" {
+		t.Errorf("NUMERIC handler got %q, expected 999", numeric)
+	}
+}
+
+func TestPrivmsgConfirm(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	var privmsgs int
+	var delivered, failed error = ErrUnconfirmed, nil
+	c.AddHandler("PRIVMSG", func(conn *Conn, line *Line) {
+		privmsgs++
+		conn.PrivmsgConfirm("bob", "hello", func(err error) { delivered = err })
+		conn.PrivmsgConfirm("nobody", "hello", func(err error) { failed = err })
+	})
+	log := ":srv CAP * ACK :echo-message\n" +
+		":bob!b@h PRIVMSG test :hi\n" +
+		":test!test@host PRIVMSG bob :hello\n" +
+		":srv 401 test nobody :No such nick/channel\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if privmsgs != 1 {
+		t.Errorf("expected our echo not to be dispatched, got %d PRIVMSGs", privmsgs)
+	}
+	if delivered != nil {
+		t.Errorf("expected message to bob to be delivered, got %v", delivered)
+	}
+	if failed == nil {
+		t.Errorf("expected message to nobody to fail")
+	}
+}
+
+func TestLabeled(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	var whois <-chan []*Line
+	var failed error
+	c.AddHandler("CONNECTED", func(conn *Conn, line *Line) {
+		whois = conn.Labeled("WHOIS bob")
+		conn.PrivmsgConfirm("nobody", "hello", func(err error) { failed = err })
+	})
+	log := ":srv CAP * ACK :batch labeled-response\n" +
+		":srv 422 test :No MOTD\n" +
+		"@label=1 :srv BATCH +w labeled-response\n" +
+		"@batch=w :srv 311 test bob b h * :Bob\n" +
+		"@batch=w :srv 317 test bob 10 :seconds idle\n" +
+		"@batch=w :srv 318 test bob :End of /WHOIS list.\n" +
+		":srv BATCH -w\n" +
+		"@label=2 :srv 401 test nobody :No such nick/channel\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	// 317 and 318 are dispatched as NUMERIC events, which shouldn't change
+	// the lines we get back
+	if lines := <-whois; len(lines) != 3 || lines[0].Cmd != "311" ||
+		lines[1].Cmd != "317" || lines[1].Args[0] != "test" {
+		t.Errorf("expected the WHOIS reply, got %v", lines)
+	}
+	if failed == nil {
+		t.Errorf("expected message to nobody to fail")
+	}
+}
+
+func TestMulti(t *testing.T) {
+	m := NewMulti()
+	var got []string
+	m.AddHandler("PRIVMSG", func(network string, conn *Conn, line *Line) {
+		got = append(got, network+" "+line.Text)
+	})
+	for _, network := range []string{"moonet", "cownet"} {
+		c := New("test", "test", "Testing IRC")
+		m.Add(network, c)
+		errs := c.Err
+		go func() {
+			for range errs {
+			}
+		}()
+		if err := c.Replay(strings.NewReader(":bob!b@h PRIVMSG test :moo\n")); err != nil {
+			t.Fatalf("Replay() failed: %s", err)
+		}
+	}
+	if len(got) != 2 || got[0] != "moonet moo" || got[1] != "cownet moo" {
+		t.Errorf("expected a PRIVMSG from each network, got %q", got)
+	}
+	if n := m.Networks(); len(n) != 2 || n[0] != "cownet" {
+		t.Errorf("expected sorted networks, got %q", n)
+	}
+}
+
+// A client attaching to a bouncer should be told what channels it's on, and
+// be given what it missed
+func TestBouncer(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":test!test@host JOIN :#moo\n" +
+		":srv 353 test = #moo :test @bob\n" +
+		":srv 366 test #moo :End of /NAMES list.\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	b := NewBouncer(c)
+	line, _ := ParseLine(":bob!b@h PRIVMSG #moo :you missed this")
+	b.upstream(line)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go b.serveClient(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("NICK test\r\nUSER test 0 * :Testing IRC\r\n"))
+	r := bufio.NewReader(client)
+	want := []string{":test!test@host JOIN #moo", ":goirc 353 test = #moo :", ":bob!b@h PRIVMSG #moo :you missed this"}
+	for len(want) > 0 {
+		s, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("still waiting for %q: %s", want, err)
+		}
+		if strings.HasPrefix(s, want[0]) {
+			want = want[1:]
+		}
+	}
+}
+
+// Catching up on more than a client's queue normally holds shouldn't drop it,
+// and what's buffered should be kept until a client has actually had it
+func TestBouncerBigBuffer(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	if err := c.Replay(strings.NewReader(":srv 001 test :Welcome test!test@host\n")); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	b := NewBouncer(c)
+	for i := 0; i < 300; i++ {
+		line, _ := ParseLine(fmt.Sprintf(":bob!b@h PRIVMSG test :line %d", i))
+		b.upstream(line)
+	}
+	buffered := func() int {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		return len(b.buffer)
+	}
+
+	// a client that goes away straight after registering
+	client, server := net.Pipe()
+	done := make(chan bool)
+	go func() {
+		b.serveClient(server)
+		close(done)
+	}()
+	client.Write([]byte("NICK test\r\nUSER test 0 * :Testing IRC\r\n"))
+	client.Close()
+	<-done
+	if n := buffered(); n != 300 {
+		t.Errorf("expected 300 lines still buffered, got %d", n)
+	}
+
+	client, server = net.Pipe()
+	defer client.Close()
+	go b.serveClient(server)
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	client.Write([]byte("NICK test\r\nUSER test 0 * :Testing IRC\r\n"))
+	r := bufio.NewReader(client)
+	for i := 0; i < 300; {
+		s, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("still waiting for line %d: %s", i, err)
+		}
+		if strings.HasPrefix(s, ":bob!b@h PRIVMSG test :line ") {
+			if want := fmt.Sprintf(":bob!b@h PRIVMSG test :line %d\r\n", i); s != want {
+				t.Fatalf("expected %q, got %q", want, s)
+			}
+			i++
+		}
+	}
+	// the buffer is forgotten once the last line has been written
+	for i := 0; buffered() != 0; i++ {
+		if i > 100 {
+			t.Fatalf("expected the buffer to be emptied, still %d lines", buffered())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWhox(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":srv 005 test WHOX :are supported\n" +
+		":test!test@host JOIN :#moo\n" +
+		":bob!b@h JOIN :#moo\n" +
+		":srv 354 test 152 #moo b h bob G cowmaster :Bob\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if n := c.GetNick("bob"); n.Account != "cowmaster" || !n.Away || n.Name != "Bob" {
+		t.Errorf("WHOX reply not applied to bob: %+v", n)
+	}
+}
+
+// PINGs should be answered with exactly the parameters they were sent with
+func TestPong(t *testing.T) {
+	for ping, want := range map[string]string{
+		"PING :irc.server":                   "PONG :irc.server",
+		"PING 12345":                         "PONG :12345",
+		"PING irc.server :token":             "PONG irc.server :token",
+		"PING irc.server other.server":       "PONG irc.server :other.server",
+		":irc.server PING :LAG 1234":         "PONG :LAG 1234",
+		"@time=2011-01-01T00:00:00Z PING :x": "PONG :x",
+		"PING :":                             "PONG :",
+		"PING":                               "PONG :",
+	} {
+		line, err := ParseLine(ping)
+		if err != nil {
+			t.Errorf("couldn't parse %q: %s", ping, err)
+		} else if got := pong(line).String(); got != want {
+			t.Errorf("pong(%q) = %q, want %q", ping, got, want)
+		}
+	}
+}
+
+func TestMessage(t *testing.T) {
+	for m, want := range map[*Message]string{
+		NewMessage("PRIVMSG", "#moo").WithText("hello there"):        "PRIVMSG #moo :hello there",
+		NewMessage("MODE", "#moo").withRaw("+ov bob bob"):            "MODE #moo +ov bob bob",
+		NewMessage("CAP", "REQ").withRaw(":multi-prefix sasl"):       "CAP REQ :multi-prefix sasl",
+		NewMessage("USER", "test", "12", "*").WithText(""):           "USER test 12 * :",
+		NewMessage("TAGMSG", "#moo").WithTag("+typing", "active"):    "@+typing=active TAGMSG #moo",
+		NewMessage("PRIVMSG", "#moo").WithText("x").WithTag("a", ""): "@a PRIVMSG #moo :x",
+	} {
+		if err := m.Validate(); err != nil {
+			t.Errorf("%q should be valid: %s", want, err)
+		}
+		if got := m.String(); got != want {
+			t.Errorf("got %q, want %q", got, want)
+		}
+	}
+	for _, m := range []*Message{
+		NewMessage("PRIVMSG", "#moo").WithText("hi\r\nQUIT :pwned"),
+		NewMessage("PRIVMSG", "#moo bob").WithText("hi"),
+		NewMessage("PRIVMSG", ":moo").WithText("hi"),
+		NewMessage("PRIVMSG", "").WithText("hi"),
+		NewMessage("PRIV MSG", "#moo"),
+		NewMessage("PRIVMSG", "#moo").WithText(strings.Repeat("x", 500)),
+		NewMessage("TAGMSG", "#moo").WithTag("+a=b", "c"),
+	} {
+		if m.Validate() == nil {
+			t.Errorf("%q shouldn't be valid", m.String())
+		}
+	}
+}
+
+// Lines to a busy channel shouldn't hold up lines to anyone else
+func TestSendQueue(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	q := newSendQueue()
+	for _, l := range []string{
+		"PRIVMSG #busy :1", "PRIVMSG #busy :2", "PRIVMSG #busy :3",
+		"PRIVMSG bob :hi", "MODE #busy", "PRIVMSG #BUSY :4", "NOTICE Bob :there",
+	} {
+		if !q.push(c.lineTarget(l), l, 10, OverflowBlock) {
+			t.Fatalf("couldn't queue %q", l)
+		}
+	}
+	want := []string{
+		"PRIVMSG #busy :1", "PRIVMSG bob :hi", "MODE #busy", "PRIVMSG #busy :2",
+		"NOTICE Bob :there", "PRIVMSG #busy :3", "PRIVMSG #BUSY :4",
+	}
+	for _, w := range want {
+		if l, _ := q.pop(); l != w {
+			t.Errorf("expected %q, got %q", w, l)
+		}
+	}
+
+	// when full, the oldest line for the busiest target makes way
+	q.push("#busy", "PRIVMSG #busy :1", 3, OverflowDropOldest)
+	q.push("#busy", "PRIVMSG #busy :2", 3, OverflowDropOldest)
+	q.push("bob", "PRIVMSG bob :hi", 3, OverflowDropOldest)
+	q.push("#busy", "PRIVMSG #busy :3", 3, OverflowDropOldest)
+	if q.push("#busy", "PRIVMSG #busy :4", 3, OverflowDrop) {
+		t.Errorf("shouldn't be able to queue more than 3 lines")
+	}
+	q.close()
+	got := []string{}
+	for l, ok := q.pop(); ok; l, ok = q.pop() {
+		got = append(got, l)
+	}
+	if strings.Join(got, ",") != "PRIVMSG #busy :2,PRIVMSG bob :hi,PRIVMSG #busy :3" {
+		t.Errorf("wrong lines left in queue: %q", got)
+	}
+
+	// lines that aren't messages are never the ones dropped
+	q = newSendQueue()
+	q.push("", "PONG :1", 2, OverflowDropOldest)
+	q.push("", "PONG :2", 2, OverflowDropOldest)
+	done := make(chan bool)
+	go func() {
+		q.push("bob", "PRIVMSG bob :hi", 2, OverflowDropOldest)
+		close(done)
+	}()
+	if l, _ := q.pop(); l != "PONG :1" {
+		t.Errorf("expected PONG :1 to be kept, got %q", l)
+	}
+	<-done
+	q.push("", "PONG :3", 2, OverflowDropOldest)
+	q.close()
+	got = []string{}
+	for l, ok := q.pop(); ok; l, ok = q.pop() {
+		got = append(got, l)
+	}
+	if strings.Join(got, ",") != "PONG :2,PONG :3" {
+		t.Errorf("wrong lines left in queue: %q", got)
+	}
+
+	// dropping lines shouldn't wait for anyone to read conn.Err
+	c = New("test", "test", "Testing IRC")
+	c.SendQueue, c.SendOverflow = 1, OverflowDrop
+	for i := 0; i < 10; i++ {
+		c.Privmsg("#moo", "hi")
+	}
+}
+
+// Senders should be able to wait for space in the send queue, or give up
+func TestSendContext(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	c.SendQueue = 2
+	m := NewMessage("PRIVMSG", "#moo").WithText("hi")
+	for i := 0; i < 2; i++ {
+		if err := c.TrySend(m); err != nil {
+			t.Fatalf("TrySend() failed with space in the queue: %s", err)
+		}
+	}
+	if err := c.TrySend(m); err != ErrQueueFull {
+		t.Errorf("TrySend() should fail with a full queue, got %v", err)
+	}
+	if n, to := c.Queued(), c.QueuedTo("#MOO"); n != 2 || to != 2 {
+		t.Errorf("expected 2 lines queued for #moo, got %d (%d in total)", to, n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := c.SendContext(ctx, m); err != context.DeadlineExceeded {
+		t.Errorf("SendContext() should time out with a full queue, got %v", err)
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		c.out.pop()
+	}()
+	if err := c.SendContext(context.Background(), m); err != nil {
+		t.Errorf("SendContext() should succeed once there's space, got %v", err)
+	}
+}
+
+// Channels are queued to be synced, and become ready once every reply is in
+func TestSync(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	ready := 0
+	c.AddHandler("CHANNELREADY", func(conn *Conn, line *Line) { ready++ })
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":test!test@host JOIN :#moo\n" +
+		":test!test@host JOIN :#baa\n" +
+		":test!test@host PART :#baa\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if n := c.SyncQueue(); n != 1 {
+		t.Errorf("expected only #moo to be queued, got %d channels", n)
+	}
+
+	log = ":srv 324 test #moo +nt\n" +
+		":srv 368 test #moo :End of Channel Ban List\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if ch := c.GetChannel("#moo"); ch.Ready || ready != 0 {
+		t.Errorf("#moo shouldn't be ready before the end of the WHO")
+	}
+	log = ":srv 315 test #moo :End of /WHO list.\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if ch := c.GetChannel("#moo"); !ch.Ready || ready != 1 {
+		t.Errorf("#moo should be ready, got %d CHANNELREADY events", ready)
+	}
+}
+
+// Channels nobody has talked in for a while should be noticed, once
+func TestIdle(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	c.IdleTimeout = time.Hour
+	idle := []string{}
+	c.AddHandler("IDLECHANNEL", func(conn *Conn, line *Line) { idle = append(idle, line.Args[0]) })
+	log := ":test!test@host JOIN :#moo\n" +
+		":test!test@host JOIN :#baa\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	c.GetChannel("#moo").Active = time.Now().Add(-2 * time.Hour)
+	c.GetChannel("#baa").Active = time.Now().Add(-2 * time.Hour)
+	c.idleChecked = time.Time{}
+	log = ":bob!b@h PRIVMSG #baa :anyone here?\n" +
+		":srv PING :srv\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	c.idleChecked = time.Time{}
+	if err := c.Replay(strings.NewReader(":srv PING :srv\n")); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if len(idle) != 1 || idle[0] != "#moo" {
+		t.Errorf("expected one IDLECHANNEL for #moo, got %v", idle)
+	}
+	if l := c.IdleChannels(time.Hour); len(l) != 1 || l[0].Name != "#moo" {
+		t.Errorf("expected #moo to be the only idle channel, got %v", l)
+	}
+	// channels coming and going while we look shouldn't upset anything
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			c.newChannel(fmt.Sprintf("#tmp%d", i)).delete()
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		c.IdleChannels(time.Hour)
+		c.idleLine(&Line{Cmd: "PRIVMSG", Nick: "bob", Args: []string{"#moo"}})
+	}
+	<-done
+}
+
+// Nicks and channels should be found however they're capitalised
+func TestCaseMapping(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":test!test@host JOIN :#Moo[1]\n" +
+		":Bob[away]!b@h JOIN :#MOO{1}\n" +
+		":BOB{AWAY}!b@h NICK :Bob\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	ch := c.GetChannel("#moo{1}")
+	if ch == nil || ch.Name != "#Moo[1]" {
+		t.Fatalf("#Moo[1] not found as #moo{1}: %v", ch)
+	}
+	if n := c.GetNick("bob"); n == nil || n.Nick != "Bob" || ch.Nicks[n] == nil {
+		t.Errorf("Bob not tracked on #Moo[1] after changing nick: %v", n)
+	}
+
+	// with ascii casemapping, [] and {} are different
+	log = ":srv 005 test CASEMAPPING=ascii :are supported by this server\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if c.GetChannel("#moo{1}") != nil || c.GetChannel("#MOO[1]") != ch {
+		t.Errorf("#Moo[1] not refiled for ascii casemapping")
+	}
+	if CaseFold("rfc1459", "Nick[]\\~") != "nick{}|^" || CaseFold("strict-rfc1459", "~") != "~" {
+		t.Errorf("CaseFold() is broken")
+	}
+}
+
+// Removed handlers shouldn't be run, and numerics should fall back to NUMERIC
+func TestRemoveHandler(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	got := []string{}
+	remove := c.AddRemovableHandler("250", func(conn *Conn, line *Line) { got = append(got, "250") })
+	c.AddHandler("NUMERIC", func(conn *Conn, line *Line) { got = append(got, "NUMERIC "+line.Args[0]) })
+	log := ":srv 250 test :Highest connection count: 1\n"
+	c.Replay(strings.NewReader(log))
+	remove()
+	remove()
+	c.Replay(strings.NewReader(log))
+	if strings.Join(got, ",") != "250,NUMERIC 250" {
+		t.Errorf("expected the 250 handler to run once, then NUMERIC, got %v", got)
+	}
+}
+
+// When our state goes out of step with the server's, we should notice and
+// get back in step
+func TestDesync(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	desyncs := []string{}
+	c.AddHandler("DESYNC", func(conn *Conn, line *Line) {
+		desyncs = append(desyncs, line.Args[0]+" "+line.Args[1])
+	})
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":test!test@host JOIN :#moo\n" +
+		":bob!b@h PRIVMSG #baa :hi\n" +
+		":srv 353 test = #baa :test @bob\n" +
+		":srv 366 test #baa :End of /NAMES list.\n" +
+		":carol!c@h PRIVMSG #pub :hi\n" +
+		":srv 353 test = #pub :dave\n" +
+		":srv 366 test #pub :End of /NAMES list.\n" +
+		":srv 442 test #moo :You're not on that channel\n" +
+		":test!test@host JOIN :#baa\n"
+	c.Replay(strings.NewReader(log))
+	want := "#baa UNTRACKED,#moo NOTONCHANNEL,#baa DUPLICATEJOIN"
+	if got := strings.Join(desyncs, ","); got != want {
+		t.Errorf("expected DESYNC events %q, got %q", want, got)
+	}
+	if c.GetChannel("#moo") != nil || c.GetChannel("#pub") != nil {
+		t.Errorf("shouldn't be tracking #moo or #pub")
+	}
+	if ch := c.GetChannel("#baa"); ch == nil || ch.Nicks[c.Me] == nil {
+		t.Errorf("should be tracking #baa again")
+	}
+}
+
+func TestFormatting(t *testing.T) {
+	for in, want := range map[string]string{
+		"\x02bold\x02 text":         "bold text",
+		"\x0304,12red on blue\x03":  "red on blue",
+		"\x03" + "12345":            "345",
+		"\x033,x":                   ",x",
+		"\x04FF00FF,00ff00hex\x0f":  "hex",
+		"\x1d\x1f\x16\x11\x1eplain": "plain",
+	} {
+		if got := StripFormatting(in); got != want {
+			t.Errorf("StripFormatting(%q) = %q, want %q", in, got, want)
+		}
+	}
+	got := Columns([][]string{
+		{"nick", "flags", "note"},
+		{"\x02bob\x02", "t", "ünïcode"},
+		{"alice", "o"},
+	})
+	want := []string{
+		"nick   flags  note",
+		"\x02bob\x02\x0f    t      ünïcode",
+		"alice  o",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Columns() = %q, want %q", got, want)
+	}
+}
+
+// Malformed lines should become "PARSEERROR" events without getting in the
+// way of the lines after them.
+func TestCtcpFlood(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	c.CtcpLimit = 2
+	c.CtcpGlobalLimit = 3
+	seen, floods := []string{}, []string{}
+	c.AddHandler("CTCP", func(conn *Conn, line *Line) { seen = append(seen, line.Nick) })
+	c.AddHandler("CTCPFLOOD", func(conn *Conn, line *Line) { floods = append(floods, line.Args[0]) })
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":bob!b@flood PRIVMSG test :\001VERSION\001\n" +
+		":bob!b@flood PRIVMSG test :\001VERSION\001\n" +
+		":bob!b@flood PRIVMSG test :\001VERSION\001\n" +
+		":bob2!b@flood PRIVMSG test :\001PING 1\001\n" +
+		":carol!c@h PRIVMSG test :\001PING 1\001\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if got := strings.Join(seen, ","); got != "bob,bob,carol" {
+		t.Errorf("expected CTCPs from bob,bob,carol to get through, got %q", got)
+	}
+	if len(floods) != 1 || floods[0] != "bob" {
+		t.Errorf("expected one CTCPFLOOD for bob, got %v", floods)
+	}
+	if c.ctcpReplies.n != 3 || c.ctcpReplyAllowed() {
+		t.Errorf("expected 3 replies to use up the global limit, got %d", c.ctcpReplies.n)
+	}
+}
+
+func TestCtcpSweep(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	c.CtcpSweep = 3
+	sweeps := []string{}
+	c.AddHandler("CTCPSWEEP", func(conn *Conn, line *Line) { sweeps = append(sweeps, line.Args[0]) })
+	log := ":srv 001 test :Welcome test!test@host\n"
+	for _, host := range []string{"a", "b", "c", "d", "e"} {
+		log += ":" + host + "!u@" + host + " PRIVMSG test :\001VERSION\001\n"
+	}
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if len(sweeps) != 1 || sweeps[0] != "4" {
+		t.Errorf("expected one CTCPSWEEP from 4 hosts, got %v", sweeps)
+	}
+	if c.ctcpReplies.n != 3 || c.ctcpReplyAllowed() {
+		t.Errorf("expected replies to stop after 3, got %d", c.ctcpReplies.n)
+	}
+}
+
+func TestJoinPolicy(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	c.AutoJoinInvites = true
+	c.JoinMasks = []string{"#moo*", "#baa"}
+	c.NoJoinMasks = []string{"#moo-secret"}
+	c.MaxChannels = 2
+	refused := []string{}
+	c.AddHandler("JOINERROR", func(conn *Conn, line *Line) {
+		refused = append(refused, line.Args[0]+" "+line.Args[1])
+	})
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":test!test@host JOIN :#moo\n" +
+		":bob!b@h INVITE test :#warez\n" +
+		":bob!b@h INVITE test :#MOO-Secret\n" +
+		":test!test@host JOIN :#moo2\n" +
+		":bob!b@h INVITE test :#baa\n" +
+		":bob!b@h INVITE test :#moo\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	want := "#warez NOTALLOWED,#MOO-Secret NOTALLOWED,#baa TOOMANY"
+	if got := strings.Join(refused, ","); got != want {
+		t.Errorf("expected JOINERRORs %q, got %q", want, got)
+	}
+}
+
+func TestSanitize(t *testing.T) {
+	for in, want := range map[string]string{
+		"!c\x02md\x02":     "!cmd",
+		"!cmd\x07\x07":     "!cmd",
+		"!\u200bcmd\u202e": "!cmd",
+		"tab\tbed":         "tab bed",
+		"bad\xffutf8":      "badutf8",
+		"ünicode is fine":  "ünicode is fine",
+	} {
+		if got := SanitizeText(in); got != want {
+			t.Errorf("SanitizeText(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if got := FoldConfusables("！сmd ＡΒС"); got != "!cmd ABC" {
+		t.Errorf("FoldConfusables() = %q, want %q", got, "!cmd ABC")
+	}
+
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	c.Sanitize = SanitizeText
+	var text, raw string
+	c.AddHandler("PRIVMSG", func(conn *Conn, line *Line) { text, raw = line.Text, line.RawText })
+	if err := c.Replay(strings.NewReader(":bob!b@h PRIVMSG #moo :\x02!cmd\x02\x07\n")); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if text != "!cmd" || raw != "\x02!cmd\x02\x07" {
+		t.Errorf("expected sanitized text %q and raw text %q, got %q and %q", "!cmd", "\x02!cmd\x02\x07", text, raw)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	c.CoalesceWindow = 20 * time.Millisecond
+	got := []string{}
+	for _, cmd := range []string{"JOINS", "PARTS", "QUITS"} {
+		c.AddHandler(cmd, func(conn *Conn, line *Line) {
+			got = append(got, line.Cmd+" "+strings.Join(line.Args, " ")+" "+line.Text)
+		})
+	}
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":test!test@host JOIN :#moo\n" +
+		":bob!b@h JOIN :#moo\n" +
+		":alice!a@h JOIN :#moo\n" +
+		":bob!b@h PART #moo :bye\n" +
+		":carol!c@h QUIT :irc.a.net irc.b.net\n" +
+		":dave!d@h QUIT :irc.a.net irc.b.net\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if len(got) != 0 {
+		t.Errorf("expected nothing before the window is up, got %q", got)
+	}
+	time.Sleep(c.CoalesceWindow)
+	if err := c.Replay(strings.NewReader(":srv PING :srv\n")); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	sort.Strings(got)
+	want := "JOINS #moo bob alice ,PARTS #moo bob ,QUITS carol dave irc.a.net irc.b.net"
+	if strings.Join(got, ",") != want {
+		t.Errorf("expected %q, got %q", want, strings.Join(got, ","))
+	}
+
+	// events triggered by handlers are dispatched from their goroutines too
+	c = New("test", "test", "Testing IRC")
+	c.CoalesceWindow = time.Nanosecond
+	done := make(chan bool)
+	for g := 0; g < 2; g++ {
+		go func(g int) {
+			for i := 0; i < 100; i++ {
+				c.coalesceLine(&Line{Cmd: "JOIN", Nick: fmt.Sprintf("n%d_%d", g, i), Args: []string{"#moo"}})
+			}
+			done <- true
+		}(g)
+	}
+	<-done
+	<-done
+}
+
+func TestSlowDispatch(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	c.SlowDispatch = time.Second
+	slow := make(chan []string, 2)
+	c.AddHandler("SLOWDISPATCH", func(conn *Conn, line *Line) { slow <- line.Args })
+	f := func(conn *Conn, line *Line) {}
+	c.runHandler(f, &Line{Cmd: "PRIVMSG", read: time.Now()})
+	c.runHandler(f, &Line{Cmd: "PRIVMSG", read: time.Now().Add(-time.Minute)})
+	c.runHandler(f, &Line{Cmd: "NOTICE", read: time.Now().Add(-time.Minute)})
+	select {
+	case args := <-slow:
+		if args[0] != "PRIVMSG" {
+			t.Errorf("expected SLOWDISPATCH for PRIVMSG, got %q", args)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a SLOWDISPATCH event")
+	}
+	select {
+	case args := <-slow:
+		t.Errorf("expected only one SLOWDISPATCH a minute, got another for %q", args)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if d := c.DispatchLatency(); d < time.Minute {
+		t.Errorf("expected DispatchLatency() of at least a minute, got %s", d)
+	}
+}
+
+func TestModeBatch(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	b := c.NewModeBatch("#moo").Op("a").Op("b").Voice("c").Deop("d").Set('m', "").Ban("*!*@e")
+	got := strings.Join(b.modeStrings(c.modesLimit()), ",")
+	if want := "+oov a b c,-o+mb d *!*@e"; got != want {
+		t.Errorf("expected %q with the default MODES=3, got %q", want, got)
+	}
+	c.isupport["MODES"] = ""
+	got = strings.Join(b.modeStrings(c.modesLimit()), ",")
+	if want := "+oov-o+mb a b c d *!*@e"; got != want {
+		t.Errorf("expected %q with no MODES limit, got %q", want, got)
+	}
+	b = c.NewModeBatch("#moo")
+	for i := 0; i < 50; i++ {
+		b.Ban(strings.Repeat("x", 20))
+	}
+	for _, m := range b.modeStrings(0) {
+		if l := len("MODE #moo " + m); l > maxMessageLength {
+			t.Errorf("MODE is %d bytes long, more than %d", l, maxMessageLength)
+		}
+	}
+}
+
+func TestWhowas(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	bob, nobody := c.Whowas("Bob"), c.Whowas("nobody")
+	log := ":srv 314 test bob b h1 * :Bob One\n" +
+		":srv 312 test bob irc.a.net :Sat Oct 17 12:00:00 2026\n" +
+		":srv 314 test bob b2 h2 * :Bob Two\n" +
+		":srv 312 test bob irc.b.net :Fri Oct 16 12:00:00 2026\n" +
+		":srv 369 test bob :End of WHOWAS\n" +
+		":srv 406 test nobody :There was no such nickname\n" +
+		":srv 369 test nobody :End of WHOWAS\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	r := <-bob
+	if len(r) != 2 || *r[0] != (WhowasReply{"bob", "b", "h1", "Bob One", "irc.a.net", "Sat Oct 17 12:00:00 2026"}) ||
+		r[1].Host != "h2" || r[1].Server != "irc.b.net" {
+		t.Errorf("unexpected WHOWAS replies for bob: %+v", r)
+	}
+	if r := <-nobody; len(r) != 0 {
+		t.Errorf("expected no WHOWAS replies for nobody, got %+v", r)
+	}
+}
+
+func TestWrap(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		max  int
+		want []string
+	}{
+		{"short", 10, []string{"short"}},
+		{"the quick brown fox", 10, []string{"the quick", "brown fox"}},
+		{"abcdefghijkl", 5, []string{"abcde", "fghij", "kl"}},
+		{"\x02bold words here\x02 plain text", 12, []string{"\x02bold words", "\x02here\x02 plain", "text"}},
+		{"\x034red 55 pears", 7, []string{"\x034red", "\x034\x02\x0255", "\x034pears"}},
+		{"\x0304,12abc def", 12, []string{"\x0304,12abc", "\x0304,12def"}},
+		{"ééééé", 5, []string{"éé", "éé", "é"}},
+	} {
+		got := Wrap(tt.in, tt.max)
+		if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+			t.Errorf("Wrap(%q, %d) = %q, want %q", tt.in, tt.max, got, tt.want)
+		}
+		for _, l := range got {
+			if len(l) > tt.max {
+				t.Errorf("Wrap(%q, %d) gave a %d byte line %q", tt.in, tt.max, len(l), l)
+			}
+		}
+	}
+}
+
+func TestSnomasks(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for err := range errs {
+			t.Errorf("unexpected error: %s", err)
+		}
+	}()
+	snotices := []string{}
+	c.AddHandler("SNOTICE", func(conn *Conn, line *Line) {
+		snotices = append(snotices, line.Args[0]+" "+line.Text)
+	})
+	log := ":srv NOTICE * :*** Looking up your hostname...\n" +
+		":srv 001 test :Welcome test!test@host\n" +
+		":test MODE test :+ios +cFk\n" +
+		":srv 008 test +cFx :Server notice mask\n" +
+		":test MODE test :+s -x\n" +
+		":srv NOTICE test :*** Notice -- Client connecting: bob (b@h) [1.2.3.4]\n" +
+		":srv NOTICE test :*** Notice -- Something odd\n" +
+		":srv NOTICE test :*** CONNECT: Client connecting on port 6697: alice!a@h\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if got := c.Me.Modes.String(); got != "+ios +Fc" {
+		t.Errorf("expected modes +ios +Fc, got %q", got)
+	}
+	want := "CONNECT Client connecting: bob (b@h) [1.2.3.4]," +
+		"OTHER Something odd," +
+		"CONNECT Client connecting on port 6697: alice!a@h"
+	if got := strings.Join(snotices, ","); got != want {
+		t.Errorf("expected SNOTICEs %q, got %q", want, got)
+	}
+
+	// snomasks change under the state lock, so reading our state alongside
+	// them is fine
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			_ = c.Me.String()
+		}
+		close(done)
+	}()
+	log = strings.Repeat(":srv 008 test +cF :Server notice mask\n:test MODE test :+s -c\n", 50)
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	<-done
+}
+
+func TestWithOps(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	c.Services.Timeout = 20 * time.Millisecond
+	// count requests for ops instead of messaging ChanServ from the timers
+	asked := make(chan string, 10)
+	c.Services.RequestOps = func(channel string) { asked <- channel }
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":test!test@host JOIN :#moo\n" +
+		":srv 353 test = #moo :test @ChanServ\n" +
+		":srv 366 test #moo :End of /NAMES list.\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	done, failed := make(chan string, 3), make(chan error, 1)
+	c.Services.WithOps("#moo", func() { done <- "kick" }, false, nil)
+	c.Services.WithOps("#moo", func() { done <- "ban" }, true, func(err error) { done <- fmt.Sprint(err) })
+	c.Services.WithOps("#baa", func() { done <- "oops" }, false, func(err error) { failed <- err })
+	if err := c.Replay(strings.NewReader(":ChanServ!s@services MODE #moo +o test\n")); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	got := []string{}
+	for len(got) < 3 {
+		select {
+		case s := <-done:
+			got = append(got, s)
+		case <-time.After(time.Second):
+			t.Fatalf("expected 3 results, got %q", got)
+		}
+	}
+	if want := "kick,ban,<nil>"; strings.Join(got, ",") != want {
+		t.Errorf("expected %q, got %q", want, strings.Join(got, ","))
+	}
+	if err := <-failed; err != ErrNoOps {
+		t.Errorf("expected ErrNoOps for #baa, got %v", err)
+	}
+
+	// asked once, then once more after the first timeout
+	for len(asked) > 0 {
+		<-asked
+	}
+	c.Services.WithOps("#baa", func() { done <- "oops" }, false, func(err error) { failed <- err })
+	if err := <-failed; err != ErrNoOps {
+		t.Errorf("expected ErrNoOps for #baa, got %v", err)
+	}
+	if len(asked) != 2 {
+		t.Errorf("expected ops to be asked for twice, got %d", len(asked))
+	}
+
+	// admins don't need to ask
+	log = ":test!test@host JOIN :#baa\n" +
+		":srv 353 test = #baa :&test\n" +
+		":srv 366 test #baa :End of /NAMES list.\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	c.Services.WithOps("#baa", func() { done <- "topic" }, false, nil)
+	if s := <-done; s != "topic" || len(asked) != 2 {
+		t.Errorf("expected topic without asking for ops, got %q after %d", s, len(asked))
+	}
+
+	// ops we already had are kept, and the mode we were given goes afterwards
+	c.Services.WithOps("#moo", func() {}, true, nil)
+	c.Services.run("#baa", &opWait{deop: true}, 'a')
+	if line, _ := c.out.pop(); line != "MODE #baa -a test" {
+		t.Errorf("expected to give up only the +a we were given, got %q", line)
+	}
+}
+
+func TestChannelChanges(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	all, stop := c.ChannelChanges("", 10)
+	moo, _ := c.ChannelChanges("#MOO", 2)
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":test!test@host JOIN :#moo\n" +
+		":srv 353 test = #moo :test bob\n" +
+		":srv 366 test #moo :End of /NAMES list.\n" +
+		":test!test@host JOIN :#baa\n" +
+		":srv 353 test = #baa :test bob\n" +
+		":srv 366 test #baa :End of /NAMES list.\n" +
+		":bob!b@h NICK :robert\n" +
+		":test!test@host TOPIC #moo :moo!\n" +
+		":test!test@host MODE #moo +o robert\n" +
+		":test!test@host KICK #baa robert :go away\n" +
+		":services.srv MODE #moo +m\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	stop()
+	got := []string{}
+	for change := range all {
+		got = append(got, strings.Join([]string{change.Kind, change.Channel, change.Nick, change.By, change.Arg}, " "))
+	}
+	want := []string{
+		"JOIN #moo test  ",
+		"JOIN #baa test  ",
+		"NICK #baa bob  robert",
+		"NICK #moo bob  robert",
+		"TOPIC #moo  test moo!",
+		"MODE #moo  test +o robert",
+		"KICK #baa robert test go away",
+		"MODE #moo  services.srv +m",
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("expected changes\n%q\ngot\n%q", want, got)
+	}
+	<-moo
+	<-moo
+	if err := c.Replay(strings.NewReader(":test!test@host TOPIC #moo :baa!\n")); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	select {
+	case change := <-moo:
+		if change.Arg != "baa!" || change.Missed != 3 {
+			t.Errorf("expected the new topic after missing 3 changes, got %+v", change)
+		}
+	default:
+		t.Errorf("expected a change for #moo")
+	}
+	// handlers change the state from their own goroutines meanwhile
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			ch := c.newChannel(fmt.Sprintf("#tmp%d", i))
+			ch.addNick(c.GetNick("robert"))
+			ch.delete()
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		c.channelChanges(&Line{Cmd: "QUIT", Nick: "robert", Text: "bye"})
+	}
+	<-done
+}
+
+func TestRecorder(t *testing.T) {
+	path := t.TempDir() + "/traffic"
+	r := NewRecorder(path, 100, 2)
+	for i := 0; i < 10; i++ {
+		if err := r.Write("->", fmt.Sprintf("PRIVMSG #moo :line %d", i)); err != nil {
+			t.Fatalf("Write() failed: %s", err)
+		}
+	}
+	r.Close()
+	for _, f := range []string{path, path + ".1", path + ".2"} {
+		st, err := os.Stat(f)
+		if err != nil {
+			t.Fatalf("expected %s to exist: %s", f, err)
+		}
+		if st.Size() > 100 {
+			t.Errorf("%s is %d bytes, more than 100", f, st.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); err == nil {
+		t.Errorf("expected only 2 old files to be kept")
+	}
+	b, _ := os.ReadFile(path)
+	if !strings.HasSuffix(string(b), " -> PRIVMSG #moo :line 9\n") {
+		t.Errorf("expected the last line at the end of %s, got %q", path, b)
+	}
+
+	c := New("test", "test", "Testing IRC")
+	c.AddSecret("hunter2")
+	c.Record(NewRecorder(path, 0, 0))
+	c.record("->", "PRIVMSG NickServ :IDENTIFY hunter2")
+	c.Record(nil)
+	b, _ = os.ReadFile(path)
+	if strings.Contains(string(b), "hunter2") {
+		t.Errorf("expected secrets to be masked, got %q", b)
+	}
+}
+
+func TestLimits(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	if l := c.Limit("TOPICLEN"); l != 0 {
+		t.Errorf("expected no TOPICLEN before 005, got %d", l)
+	}
+	if s, err := c.fitLimit("TOPIC", "TOPICLEN", strings.Repeat("x", 1000)); err != nil || len(s) != 1000 {
+		t.Errorf("expected no limit without TOPICLEN, got %d bytes, %v", len(s), err)
+	}
+	c.isupport["TOPICLEN"] = "5"
+	c.isupport["NICKLEN"] = "bogus"
+	if l := c.Limit("NICKLEN"); l != 0 {
+		t.Errorf("expected a bogus NICKLEN to be ignored, got %d", l)
+	}
+	_, err := c.fitLimit("TOPIC", "TOPICLEN", "moooooo")
+	if e, ok := err.(*LimitError); !ok || e.Len != 7 || e.Max != 5 {
+		t.Errorf("expected a *LimitError for 7 bytes over 5, got %v", err)
+	}
+	if err, ok := c.Topic("#moo", "moooooo").(*LimitError); !ok || err.Cmd != "TOPIC" {
+		t.Errorf("expected Topic() to return a *LimitError, got %v", err)
+	}
+	c.TruncateToLimits = true
+	if s, err := c.fitLimit("TOPIC", "TOPICLEN", "mooooo"); err != nil || s != "moooo" {
+		t.Errorf("expected %q, got %q, %v", "moooo", s, err)
+	}
+	// "ü" is two bytes, and shouldn't be cut in half
+	if s, _ := c.fitLimit("TOPIC", "TOPICLEN", "mooüü"); s != "mooü" {
+		t.Errorf("expected %q, got %q", "mooü", s)
+	}
+}
+
+func TestAway(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	events := []string{}
+	for _, cmd := range []string{"NOWAWAY", "UNAWAY"} {
+		c.AddHandler(cmd, func(conn *Conn, line *Line) {
+			events = append(events, fmt.Sprintf("%s %v", line.Cmd, conn.Me.Away))
+		})
+	}
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":srv 306 test :You have been marked as being away\n" +
+		":srv 305 test :You are no longer marked as being away\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if got, want := strings.Join(events, ","), "NOWAWAY true,UNAWAY false"; got != want {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+}
+
+func TestJoinAll(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	if err := c.Replay(strings.NewReader(":srv 001 test :Welcome test!test@host\n")); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	results := c.JoinAll([]string{"#moo", "#Secret", "#banned", "#private", "#slow", "#MOO", "#old"}, 50*time.Millisecond)
+	log := ":test!test@host JOIN :#moo\n" +
+		":srv 470 test #old ##new :Forwarding to another channel\n" +
+		":test!test@host JOIN :##new\n" +
+		":srv 473 test #secret :Cannot join channel (+i)\n" +
+		":srv 474 test #banned :Cannot join channel (+b)\n" +
+		":srv 473 test #private :Cannot join channel (+i)\n" +
+		":ChanServ!s@services INVITE test :#secret\n" +
+		":test!test@host JOIN :#secret\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	select {
+	case r := <-results:
+		got := []string{}
+		for _, j := range r {
+			got = append(got, fmt.Sprintf("%s %q %v%s", j.Channel, j.Reason, j.Invited, j.Forward))
+		}
+		want := `#moo "" false,#Secret "" true,#banned "BANNED" false,#private "INVITEONLY" true,#slow "TIMEOUT" false,#old "FORWARDED" false##new`
+		if strings.Join(got, ",") != want {
+			t.Errorf("expected %s, got %s", want, strings.Join(got, ","))
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for JoinAll() results")
+	}
+	if _, ok := <-results; ok {
+		t.Errorf("expected results to be closed")
+	}
+}
+
+func TestDisconnectReason(t *testing.T) {
+	for _, tc := range []struct {
+		lines []string
+		kind  string
+	}{
+		{[]string{"ERROR :Closing Link: host (Quit: bye)"}, "QUIT"},
+		{[]string{"ERROR :Closing Link: host (Ping timeout: 240 seconds)"}, "PINGTIMEOUT"},
+		{[]string{"ERROR :Closing Link: host (K-Lined: spam)"}, "BANNED"},
+		{[]string{"ERROR :Closing Link: host (Killed (oper (go away)))"}, "KILLED"},
+		{[]string{"ERROR :Trying to reconnect too fast."}, "THROTTLED"},
+		{[]string{"ERROR :Closing Link: host (Excess Flood)"}, ""},
+		{[]string{":srv 465 * :You are banned from this server", "ERROR :Closing Link: host"}, "BANNED"},
+		{[]string{":srv NOTICE * :*** You are G-lined: spam", "ERROR :Closing Link: host"}, "BANNED"},
+		{[]string{":bob!b@h NOTICE test :you are banned lol", "ERROR :Closing Link: host"}, ""},
+	} {
+		c := New("test", "test", "Testing IRC")
+		for _, s := range tc.lines {
+			c.disconnectLine(lineOrError(s))
+		}
+		r := c.DisconnectReason()
+		if r == nil || r.Kind != tc.kind {
+			t.Errorf("expected %q for %q, got %+v", tc.kind, tc.lines, r)
+		}
+		if r.Banned() != (tc.kind == "BANNED") {
+			t.Errorf("Banned() wrong for %q", tc.lines)
+		}
+	}
+}
+
+func TestRefoldConcurrent(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 200; i++ {
+			c.GetNick("test")
+			c.Nicks()
+			c.EqualFold("[moo]", "{MOO}")
+		}
+		close(done)
+	}()
+	for i := 0; i < 200; i++ {
+		c.newNick(fmt.Sprintf("nick%d", i), "", "", "")
+		c.isupportMu.Lock()
+		c.isupport["CASEMAPPING"] = []string{"ascii", "rfc1459"}[i%2]
+		c.isupportMu.Unlock()
+		c.refold()
+	}
+	<-done
+	if c.GetNick("NICK199") == nil {
+		t.Errorf("expected to find NICK199 after refolding")
+	}
+}
+
+func TestSilence(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	heard := []string{}
+	c.AddHandler("PRIVMSG", func(conn *Conn, line *Line) { heard = append(heard, line.Nick) })
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":test!test@host SILENCE +*!*@spam.host\n" +
+		":spammer!s@spam.host PRIVMSG test :buy stuff\n" +
+		":bob!b@h PRIVMSG test :hi\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if strings.Join(heard, ",") != "bob" {
+		t.Errorf("expected only bob to be heard, got %v", heard)
+	}
+	// changing the list while lines are checked against it
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			c.setSilenced(fmt.Sprintf("*!*@host%d", i), true)
+			c.setSilenced(fmt.Sprintf("*!*@host%d", i), false)
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		c.silenced("bob!b@h")
+	}
+	<-done
+}
+
+func TestDedup(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	c.DedupWindow = time.Minute
+	heard := 0
+	c.AddHandler("PRIVMSG", func(conn *Conn, line *Line) { heard++ })
+	log := "@msgid=abc :bob!b@h PRIVMSG #moo :hi\n" +
+		"@msgid=abc :bob!b@h PRIVMSG #moo :hi\n" +
+		"@msgid=def :bob!b@h PRIVMSG #moo :hi again\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if heard != 2 {
+		t.Errorf("expected 2 PRIVMSGs, got %d", heard)
+	}
+	// events triggered by handlers are dispatched from their goroutines
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			c.duplicate(fmt.Sprintf("a%d", i))
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		c.duplicate(fmt.Sprintf("b%d", i))
+	}
+	<-done
+}
+
+func TestSTS(t *testing.T) {
+	file := t.TempDir() + "/sts"
+	c := New("test", "test", "Testing IRC")
+	c.secure, c.Host, c.STSFile = true, "irc.example.net:6697", file
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 100; i++ {
+			c.stsPolicy("irc.example.net")
+		}
+		close(done)
+	}()
+	for i := 0; i < 100; i++ {
+		c.stsCap("port=6697,duration=60")
+	}
+	<-done
+	c = New("test", "test", "Testing IRC")
+	c.STSFile = file
+	if p := c.stsPolicy("irc.example.net"); p == nil || p.Port != "6697" {
+		t.Errorf("expected the saved STS policy for port 6697, got %v", p)
+	}
+
+	// policies seen over plain text only upgrade the next connection
+	c = New("test", "test", "Testing IRC")
+	c.Host = "irc.example.net:6667"
+	c.stsCap("port=6697,duration=60")
+	if p := c.stsPolicy("irc.example.net"); p == nil || p.Port != "6697" {
+		t.Errorf("expected an STS upgrade to port 6697, got %v", p)
+	}
+	if p := c.stsPolicy("irc.example.net"); p != nil {
+		t.Errorf("expected the STS upgrade to be used up, got %v", p)
+	}
+}
+
+func TestConnectSSL(t *testing.T) {
+	// all we want is a handshake, which the HTTP server's certificate for
+	// 127.0.0.1 gives us
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	c := New("test", "test", "Testing IRC")
+	c.SSL, c.SSLConfig = true, &tls.Config{RootCAs: pool}
+	if err := c.Connect(srv.Listener.Addr().String(), ""); err != nil {
+		t.Fatalf("Connect() failed: %s", err)
+	}
+	errs, done := c.Err, c.Disconnected()
+	go func() {
+		for range errs {
+		}
+	}()
+	if c.SSLConfig.ServerName != "" {
+		t.Errorf("expected conn.SSLConfig to be left alone, got ServerName %q", c.SSLConfig.ServerName)
+	}
+	c.Quit("bye")
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected to be disconnected")
+	}
+}
+
+// send() and recv() both shut the connection down when they fail, and only
+// the first of them should
+func TestShutdownOnce(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	client, server := net.Pipe()
+	defer server.Close()
+	c.sock = client
+	errs, done := c.Err, c.Disconnected()
+	c.shutdown(client, "irc.send(): %s", "write timeout")
+	c.shutdown(client, "irc.recv(): %s", "use of closed connection")
+	if err := <-errs; err == nil || err.Error() != "irc.send(): write timeout" {
+		t.Errorf("expected the send() error, got %v", err)
+	}
+	if _, ok := <-errs; ok {
+		t.Errorf("expected one error before conn.Err was closed")
+	}
+	<-done
+	select {
+	case err, ok := <-c.Err:
+		t.Errorf("expected the next connection's Err to be left alone, got %v %v", err, ok)
+	default:
+	}
+}
+
+func TestAltNick(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	log := ":srv 005 * NICKLEN=5 :are supported\n" +
+		":srv 433 * test :Nickname is already in use\n" +
+		":srv 433 * test_ :Nickname is already in use\n" +
+		":srv 433 * test0 :Nickname is already in use\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if c.Me.Nick != "test1" {
+		t.Errorf("expected to end up trying test1, got %s", c.Me.Nick)
+	}
+	for _, tt := range [][3]string{{"bob", "9", "bob_"}, {"bob", "3", "bo_"},
+		{"bo8", "3", "bo9"}, {"bo9", "3", ""}, {"bob", "0", "bob_"}} {
+		max, _ := strconv.Atoi(tt[1])
+		if got := altNick(tt[0], max); got != tt[2] {
+			t.Errorf("altNick(%q, %d) = %q, expected %q", tt[0], max, got, tt[2])
+		}
+	}
+}
+
+// Lists of channels should be checked one at a time, and "JOIN 0" sent as is
+func TestJoinList(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	c.JoinKey("#a,bad,#b", "k1,k2,k3")
+	c.Join("#a,#b")
+	c.Join("0")
+	for _, want := range []string{"JOIN #a,#b k1,k3", "JOIN #a,#b", "JOIN 0"} {
+		if line, _ := c.out.pop(); line != want {
+			t.Errorf("expected %q, got %q", want, line)
+		}
+	}
+}
+
+// Only keys we supply ourselves should be redacted, not whatever the server
+// says a channel's key is
+func TestSecrets(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	log := ":srv 001 test :Welcome test!test@host\n" +
+		":test!test@host JOIN :#moo\n" +
+		":srv 324 test #moo +k *\n" +
+		":bob!b@h MODE #moo +k a\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	c.JoinKey("#baa", "sekrit")
+	if got := c.redact("a * sekrit"); got != "a * *****" {
+		t.Errorf("expected only our own key to be redacted, got %q", got)
+	}
+}
+
+func TestDryRunAllowed(t *testing.T) {
+	for line, want := range map[string]bool{
+		"PONG :srv":        true,
+		"QUIT :bye":        true,
+		"NICK test_":       true,
+		"MODE #moo":        true,
+		"MODE #moo +b":     true,
+		"MODE #moo +o bob": false,
+		"PRIVMSG #moo :hi": false,
+		"KICK #moo bob":    false,
+	} {
+		if got := dryRunAllowed(line); got != want {
+			t.Errorf("dryRunAllowed(%q) = %v, want %v", line, got, want)
+		}
+	}
+}
+
+// Refused and unanswered queries shouldn't leave anyone waiting, or get
+// later replies sent to the wrong place
+func TestQueryRefused(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	if _, ok := <-c.IsOn(); ok {
+		t.Errorf("expected IsOn() with no nicks to be closed")
+	}
+	refused, bob := c.IsOn("alice"), c.IsOn("bob")
+	log := ":srv 421 test ISON :Unknown command\n" +
+		":srv 303 test :bob\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if r, ok := <-refused; ok {
+		t.Errorf("expected the refused ISON to be closed, got %q", r)
+	}
+	if r := <-bob; strings.Join(r, ",") != "bob" {
+		t.Errorf("expected bob to be on, got %q", r)
+	}
+	u, w := c.UserHost("bob"), c.Whowas("bob")
+	c.failQueries()
+	if _, ok := <-u; ok {
+		t.Errorf("expected the USERHOST to be closed on disconnect")
+	}
+	if _, ok := <-w; ok {
+		t.Errorf("expected the WHOWAS to be closed on disconnect")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	c := New("test", "test", "Testing IRC")
+	errs := c.Err
+	go func() {
+		for range errs {
+		}
+	}()
+	bad := []string{}
+	c.AddHandler("PARSEERROR", func(conn *Conn, line *Line) {
+		bad = append(bad, line.Raw)
+	})
+	var text string
+	c.AddHandler("PRIVMSG", func(conn *Conn, line *Line) {
+		text = line.Text
+	})
+	log := ":srv\n" +
+		"@tags=only\n" +
+		":srv :no command\n" +
+		"bob!b@h PRIVMSG test :no colon on the prefix\n" +
+		":bob!b@h PRIVMSG test " + strings.Repeat("x", maxLineLength) + "\n" +
+		":bob!b@h   PRIVMSG  test  caf\xe9\n"
+	if err := c.Replay(strings.NewReader(log)); err != nil {
+		t.Fatalf("Replay() failed: %s", err)
+	}
+	if len(bad) != 5 {
+		t.Errorf("expected 5 PARSEERRORs, got %d: %q", len(bad), bad)
+	}
+	if text != "caf\uFFFD" {
+		t.Errorf("expected PRIVMSG text %q, got %q", "caf\uFFFD", text)
+	}
+}
+
+// Lines longer than the read buffer should come back in one piece
+func TestReadLine(t *testing.T) {
+	long := ":srv 005 test " + strings.Repeat("A ", 3000) + ":are supported\r\n"
+	r := bufio.NewReader(iotest.OneByteReader(strings.NewReader(long + "PING :srv\r\n")))
+	if s, err := readLine(r); err != nil || s != long {
+		t.Errorf("readLine() = %d bytes, %v; expected %d bytes", len(s), err, len(long))
+	}
+	if s, err := readLine(r); err != nil || s != "PING :srv\r\n" {
+		t.Errorf("readLine() = %q, %v", s, err)
+	}
+}
+
+// Fuzz targets for the parsers, run with e.g.
+//
+//	go test -fuzz FuzzParseLine ./irc
+//
+// Without -fuzz they just check the seed corpus.
+
+func FuzzParseLine(f *testing.F) {
+	f.Add(":nick!user@host PRIVMSG #moo :hello there")
+	f.Add("@msgid=abc;time=2011-01-01T00:00:00.000Z :srv 001 test :Welcome")
+	f.Add("PING :srv")
+	f.Add("TOPIC #moo :")
+	f.Add("@")
+	f.Add(":")
+	f.Add(":@! ")
+	f.Add("")
+	f.Fuzz(func(t *testing.T, s string) {
+		line, err := ParseLine(s)
+		if err != nil {
+			return
+		}
+		if line.Raw != s || !validCommand(line.Cmd) {
+			t.Errorf("ParseLine(%q) = %#v", s, line)
+		}
+		// String() should give us back something that parses the same
+		again, err := ParseLine(line.String())
+		if err != nil || again.Src != line.Src || again.Cmd != line.Cmd ||
+			again.Text != line.Text || again.trailing != line.trailing ||
+			strings.Join(again.Args, " ") != strings.Join(line.Args, " ") ||
+			formatTags(again.Tags) != formatTags(line.Tags) {
+			t.Errorf("ParseLine(%q).String() = %q, which parses differently (%v)", s, line.String(), err)
+		}
+	})
+}
+
+func FuzzParseModeChange(f *testing.F) {
+	f.Add("+o-v", "alice alice")
+	f.Add("+kl-b", "key 10 *!*@*")
+	f.Add("-k+l", "")
+	f.Fuzz(func(t *testing.T, modes, args string) {
+		a := strings.Fields(args)
+		changes, err := parseModeChange(modes, a, defaultModeTypes)
+		used := 0
+		for _, c := range changes {
+			if c.arg != "" {
+				if used >= len(a) || c.arg != a[used] {
+					t.Fatalf("parseModeChange(%q, %q) used args out of order: %v", modes, a, changes)
+				}
+				used++
+			}
+		}
+		if err == nil && len(changes) > len(modes) {
+			t.Errorf("parseModeChange(%q, %q) returned more changes than modes", modes, a)
+		}
+	})
+}
+
+func FuzzParseCTCP(f *testing.F) {
+	f.Add("\001ACTION waves\001")
+	f.Add("\001VERSION\001")
+	f.Add("\001\001")
+	f.Fuzz(func(t *testing.T, s string) {
+		cmd, text, ok := parseCTCP(s)
+		if !ok && (cmd != "" || text != "") {
+			t.Errorf("parseCTCP(%q) returned %q, %q for a non-CTCP message", s, cmd, text)
+		}
+	})
+}
+
+// Whatever the server sends, handlers shouldn't panic
+func FuzzHandlers(f *testing.F) {
+	for _, s := range []string{"MODE #moo", "MODE #moo +o", "KICK #moo", "353 test",
+		"352 test #moo", ":bob!b@h JOIN", ":bob!b@h NICK", "CTCP", "433", "324 test #moo"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		c := New("test", "test", "Testing IRC")
+		errs, done := c.Err, make(chan bool)
+		go func() {
+			for err := range errs {
+				if strings.Contains(err.Error(), "panicked") {
+					t.Errorf("%s", err)
+				}
+			}
+			done <- true
+		}()
+		log := ":srv 001 test :Welcome test!test@host\n" +
+			":test!test@host JOIN :#moo\n" +
+			":srv 353 test = #moo :test @bob\n" +
+			":srv 366 test #moo :End of /NAMES list.\n" +
+			strings.Replace(s, "\n", " ", -1) + "\n"
+		c.Replay(strings.NewReader(log))
+		<-done
+	})
+}
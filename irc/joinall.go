@@ -0,0 +1,173 @@
+package irc
+
+// Here you'll find JoinAll(), for joining a list of channels, e.g. from a
+// config file once we're connected, and finding out which of them we didn't
+// get into and why, instead of quietly missing some.
+
+import (
+	"sync"
+	"time"
+)
+
+// A struct representing how joining a channel with JoinAll() went
+type JoinResult struct {
+	Channel string
+
+	// "" if we joined the channel, otherwise why we didn't: a reason from
+	// JoinErrors, "NOTALLOWED" or "TOOMANY" (see conn.JoinMasks),
+	// "FORWARDED" if the server sent us to another channel instead, or
+	// "TIMEOUT" if the server never told us either way
+	Reason string
+
+	// The channel we were sent to instead, for "FORWARDED"
+	Forward string
+
+	// The server's explanation, if it gave one
+	Text string
+
+	// Whether we asked ChanServ to invite us after the first try failed. If
+	// Reason isn't "" as well, that didn't help: Reason and Text are from
+	// the second try if the server refused that too, or still from the
+	// first if ChanServ never invited us.
+	Invited bool
+}
+
+// Join errors that ChanServ can get us past by inviting us
+var inviteJoinErrors = map[string]bool{
+	"INVITEONLY": true,
+	"BADKEY":     true,
+	"FULL":       true,
+}
+
+// JoinAll() joins channels, and then waits up to timeout for the server to
+// say how each join went. Channels we can't join because they're invite
+// only, keyed or full are tried once more after asking ChanServ to invite us,
+// unless conn.Services.ChanServ is "". The results are sent down the returned
+// channel, one for each channel in the order they first appear in channels,
+// once we know about all of them or timeout has passed, and then it's closed.
+func (conn *Conn) JoinAll(channels []string, timeout time.Duration) <-chan []*JoinResult {
+	var mu sync.Mutex
+	results := make([]*JoinResult, 0, len(channels))
+	pending := make(map[string]*JoinResult, len(channels))
+	for _, ch := range channels {
+		if _, ok := pending[conn.Fold(ch)]; ok {
+			// we'd only hear about it once
+			continue
+		}
+		r := &JoinResult{Channel: ch, Reason: "TIMEOUT"}
+		results = append(results, r)
+		pending[conn.Fold(ch)] = r
+	}
+	c := make(chan []*JoinResult, 1)
+	removers := []func(){}
+	// called with mu held
+	finish := func() {
+		if pending == nil {
+			return
+		}
+		pending = nil
+		for _, remove := range removers {
+			remove()
+		}
+		c <- results
+		close(c)
+	}
+	// Records how joining channel went, if we're still waiting to hear, and
+	// finishes once we've heard about them all. Called with mu held.
+	resolve := func(channel, reason, text string) {
+		r, ok := pending[conn.Fold(channel)]
+		if !ok {
+			return
+		}
+		r.Reason, r.Text = reason, text
+		delete(pending, conn.Fold(channel))
+		if len(pending) == 0 {
+			finish()
+		}
+	}
+	handle := func(name string, f func(*Conn, *Line)) {
+		remove := conn.AddRemovableHandler(name, f)
+		mu.Lock()
+		defer mu.Unlock()
+		if pending == nil {
+			// timed out already
+			remove()
+		}
+		removers = append(removers, remove)
+	}
+
+	handle("JOIN", func(conn *Conn, line *Line) {
+		if !conn.EqualFold(line.Nick, conn.Me.Nick) {
+			return
+		}
+		channel := line.Text
+		if len(line.Args) > 0 {
+			channel = line.Args[0]
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		resolve(channel, "", "")
+	})
+	handle("JOINERROR", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			return
+		}
+		mu.Lock()
+		r := pending[conn.Fold(line.Args[0])]
+		if r == nil {
+			mu.Unlock()
+			return
+		}
+		invite := inviteJoinErrors[line.Args[1]] && !r.Invited && conn.Services.ChanServ != ""
+		if invite {
+			// keep why, in case we never hear back from ChanServ
+			r.Reason, r.Text, r.Invited = line.Args[1], line.Text, true
+		} else {
+			resolve(line.Args[0], line.Args[1], line.Text)
+		}
+		mu.Unlock()
+		if invite {
+			conn.Privmsg(conn.Services.ChanServ, "INVITE "+r.Channel)
+		}
+	})
+	// "470 test #moo ##moo :Forwarding to another channel", which is followed
+	// by us joining ##moo rather than #moo
+	handle("470", func(conn *Conn, line *Line) {
+		if len(line.Args) < 3 {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if r, ok := pending[conn.Fold(line.Args[1])]; ok {
+			r.Forward = line.Args[2]
+			resolve(line.Args[1], "FORWARDED", line.Text)
+		}
+	})
+	handle("INVITE", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 || !conn.EqualFold(line.Args[0], conn.Me.Nick) {
+			return
+		}
+		mu.Lock()
+		r := pending[conn.Fold(line.Args[1])]
+		invited := r != nil && r.Invited
+		mu.Unlock()
+		// with AutoJoinInvites set, the INVITE handler will join anyway
+		if invited && !conn.AutoJoinInvites {
+			conn.Join(r.Channel)
+		}
+	})
+	time.AfterFunc(timeout, func() {
+		mu.Lock()
+		defer mu.Unlock()
+		finish()
+	})
+	if len(results) == 0 {
+		mu.Lock()
+		finish()
+		mu.Unlock()
+	}
+	for _, r := range results {
+		conn.Join(r.Channel)
+	}
+	return c
+}
@@ -0,0 +1,97 @@
+package irc
+
+// Here you'll find support for IRCv3 labeled-response, which lets us tell
+// which of the lines the server sends are the response to a given command.
+
+import (
+	"strconv"
+)
+
+func (conn *Conn) setupLabels() {
+	conn.RequestCap("labeled-response")
+}
+
+// Returns a new label for a command, and arranges for f to be called with the
+// lines the server responds with once they have all arrived, or with err set
+// if we disconnect first. Returns "" if the server doesn't do
+// labeled-response, in which case f is never called.
+func (conn *Conn) newLabel(f func([]*Line, error)) string {
+	if !conn.HasCap("labeled-response") {
+		return ""
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	conn.label++
+	label := strconv.Itoa(conn.label)
+	conn.labels[label] = f
+	return label
+}
+
+// Sends m with a label, see newLabel(). Returns false without sending
+// anything if the server doesn't do labeled-response. m must be valid.
+func (conn *Conn) sendLabeled(m *Message, f func([]*Line, error)) bool {
+	label := conn.newLabel(f)
+	if label == "" {
+		return false
+	}
+	conn.writeMessage(m.WithTag("label", label))
+	return true
+}
+
+// Labeled() sends cmd, e.g. "WHOIS nick", with a label so that the lines the
+// server sends in response can be picked out from everything else. They are
+// sent down the returned channel once they've all arrived, and dispatched to
+// event handlers as usual. If the server doesn't support labeled-response,
+// cmd is sent as it is and the channel is closed straight away; it's also
+// closed if we disconnect before the response arrives.
+func (conn *Conn) Labeled(cmd string) <-chan []*Line {
+	c := make(chan []*Line, 1)
+	label := conn.newLabel(func(lines []*Line, err error) {
+		if err == nil {
+			c <- lines
+		}
+		close(c)
+	})
+	if label == "" {
+		conn.write(cmd)
+		close(c)
+	} else {
+		conn.write("@label=" + label + " " + cmd)
+	}
+	return c
+}
+
+// Hands lines that are the response to a labeled command to whoever sent it.
+// A response is either a single line with the label tag, which may be an ACK
+// when there's nothing else to say, or a labeled-response batch; those are
+// delivered from endBatch() instead. Called from dispatchEvent().
+func (conn *Conn) labeledLine(line *Line) {
+	if line.Cmd == "BATCH" {
+		return
+	}
+	if label, ok := line.Tags["label"]; ok {
+		conn.deliverLabeled(label, []*Line{line})
+	}
+}
+
+// Calls the function waiting for the response to label
+func (conn *Conn) deliverLabeled(label string, lines []*Line) {
+	conn.mu.Lock()
+	f, ok := conn.labels[label]
+	delete(conn.labels, label)
+	conn.mu.Unlock()
+	if ok {
+		f(lines, nil)
+	}
+}
+
+// Tells everyone still waiting for a labeled response that they won't get one
+func (conn *Conn) failLabels() {
+	conn.mu.Lock()
+	all := conn.labels
+	conn.labels = make(map[string]func([]*Line, error))
+	conn.mu.Unlock()
+	for _, f := range all {
+		f(nil, ErrDisconnected)
+	}
+}
@@ -0,0 +1,59 @@
+package irc
+
+// Here you'll find the limits servers put on the length of nicks, topics,
+// kick messages and away messages, which they tell us about in 005. Servers
+// cut anything longer short, or refuse it, without telling us, so we check
+// before sending instead.
+
+import (
+	"fmt"
+	"strconv"
+	"unicode/utf8"
+)
+
+// Returned by Nick(), Topic(), Kick() and Away() when what they were given
+// is too long to send, and conn.TruncateToLimits isn't set
+type LimitError struct {
+	// The command, e.g. "TOPIC", and the 005 token that limits it, e.g.
+	// "TOPICLEN"
+	Cmd, Token string
+
+	// How long it was, and the most the server allows, in bytes
+	Len, Max int
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("irc: %s is %d bytes long, the server's %s is %d", e.Cmd, e.Len, e.Token, e.Max)
+}
+
+// Limit() returns the number given by a 005 token like "TOPICLEN", or 0 if
+// the server didn't send it or it isn't a number, e.g. for working out how
+// long a topic can be before setting it.
+func (conn *Conn) Limit(token string) int {
+	v, ok := conn.ISupport(token)
+	if !ok {
+		return 0
+	}
+	l, err := strconv.Atoi(v)
+	if err != nil || l < 0 {
+		return 0
+	}
+	return l
+}
+
+// Checks s against the limit given by token. If it's too long, it's either
+// cut short, if conn.TruncateToLimits is set, or returned with a *LimitError.
+func (conn *Conn) fitLimit(cmd, token, s string) (string, error) {
+	max := conn.Limit(token)
+	if max == 0 || len(s) <= max {
+		return s, nil
+	}
+	if !conn.TruncateToLimits {
+		return "", &LimitError{Cmd: cmd, Token: token, Len: len(s), Max: max}
+	}
+	// don't cut a character in half
+	for max > 0 && !utf8.RuneStart(s[max]) {
+		max--
+	}
+	return s[:max], nil
+}
@@ -0,0 +1,173 @@
+package irc
+
+// Here you'll find the Message type that all our commands are built with, so
+// that what we send is put together in the same way and checked for things
+// that would get it mangled or rejected by the server.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// The longest line we can send, not counting tags or the \r\n
+	maxMessageLength = 510
+	// The most tag data we can send, including the '@' and the space after
+	maxTagsLength = 4094
+)
+
+// A struct representing a line to be sent to the server. This is the outgoing
+// counterpart of Line, and is built up like so:
+//
+//	NewMessage("PRIVMSG", "#moo").WithText("hello there")
+//	NewMessage("MODE", "#moo", "+o", "bob")
+//
+// Text is sent as the trailing parameter, after a ':', so it may contain
+// spaces. Args may not.
+type Message struct {
+	Cmd  string
+	Args []string
+	Text string
+	Tags map[string]string
+
+	// Whether Text is sent even if it's empty, see WithText()
+	trailing bool
+}
+
+// Creates a new message with the command cmd and parameters args
+func NewMessage(cmd string, args ...string) *Message {
+	return &Message{Cmd: cmd, Args: args}
+}
+
+// Sets the message's text. This is sent as the trailing parameter even if
+// it's empty, e.g. "USER ident 12 * :".
+func (m *Message) WithText(text string) *Message {
+	m.Text, m.trailing = text, true
+	return m
+}
+
+// Adds an IRCv3 message tag to the message
+func (m *Message) WithTag(key, value string) *Message {
+	if m.Tags == nil {
+		m.Tags = make(map[string]string)
+	}
+	m.Tags[key] = value
+	return m
+}
+
+// Adds all of tags to the message
+func (m *Message) WithTags(tags map[string]string) *Message {
+	for k, v := range tags {
+		m.WithTag(k, v)
+	}
+	return m
+}
+
+// Validate() returns an error if the message can't be sent as it is: if any
+// of it contains characters that would end the line early or split up its
+// parameters, or it is too long for the server to take without cutting it
+// short. Note that the server will still cut off the end of messages it
+// relays if our nick!user@host doesn't fit on the line as well.
+func (m *Message) Validate() error {
+	if !validCommand(m.Cmd) {
+		return fmt.Errorf("irc.Message.Validate(): bad command %q", m.Cmd)
+	}
+	for _, a := range m.Args {
+		if a == "" || a[0] == ':' || strings.ContainsAny(a, " \r\n\000") {
+			return fmt.Errorf("irc.Message.Validate(): bad parameter %q for %s", a, m.Cmd)
+		}
+	}
+	if strings.ContainsAny(m.Text, "\r\n\000") {
+		return fmt.Errorf("irc.Message.Validate(): line break or NUL in text for %s", m.Cmd)
+	}
+	for k := range m.Tags {
+		if k == "" || strings.ContainsAny(k, "=; \r\n\000") {
+			return fmt.Errorf("irc.Message.Validate(): bad tag %q for %s", k, m.Cmd)
+		}
+	}
+	if l := len(m.line()); l > maxMessageLength {
+		return fmt.Errorf("irc.Message.Validate(): %s is %d bytes long, the limit is %d", m.Cmd, l, maxMessageLength)
+	}
+	if len(m.Tags) > 0 && len(formatTags(m.Tags))+2 > maxTagsLength {
+		return errors.New("irc.Message.Validate(): too many tags for " + m.Cmd)
+	}
+	return nil
+}
+
+// Adds the parameters in s, e.g. "+ntk key" or ":multi-prefix sasl", to the message.
+// Anything after a " :" (or a ':' at the start) becomes its text.
+func (m *Message) withRaw(s string) *Message {
+	if idx := strings.Index(" "+s, " :"); idx != -1 {
+		m.WithText(s[idx+1:])
+		s = s[0:idx]
+	}
+	m.Args = append(m.Args, strings.Fields(s)...)
+	return m
+}
+
+// String() returns the message as a raw IRC line, without the \r\n
+func (m *Message) String() string {
+	if len(m.Tags) == 0 {
+		return m.line()
+	}
+	return "@" + formatTags(m.Tags) + " " + m.line()
+}
+
+// Bytes() returns the message as it is sent to the server, with the \r\n
+func (m *Message) Bytes() []byte {
+	return []byte(m.String() + "\r\n")
+}
+
+// the message without its tags
+func (m *Message) line() string {
+	s := m.Cmd
+	for _, a := range m.Args {
+		s += " " + a
+	}
+	if m.trailing || m.Text != "" {
+		s += " :" + m.Text
+	}
+	return s
+}
+
+// Send() checks the message with Validate(), then queues it up to be sent to
+// the server. Messages that aren't valid aren't sent at all.
+func (conn *Conn) Send(m *Message) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	conn.write(m.String())
+	return nil
+}
+
+// SendContext() is like Send(), but if there are already conn.SendQueue lines
+// waiting to be sent, it waits for there to be space until ctx is done,
+// whatever conn.SendOverflow says. This lets things that send a lot, like
+// feed announcers, slow down rather than pile up lines behind them. It
+// returns ctx.Err() if ctx is done first, or ErrQueueClosed if we disconnect.
+func (conn *Conn) SendContext(ctx context.Context, m *Message) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	line := m.String()
+	return conn.out.wait(ctx, true, conn.lineTarget(line), line, conn.SendQueue)
+}
+
+// TrySend() is like Send(), but returns ErrQueueFull instead of sending m if
+// there are already conn.SendQueue lines waiting to be sent.
+func (conn *Conn) TrySend(m *Message) error {
+	if err := m.Validate(); err != nil {
+		return err
+	}
+	line := m.String()
+	return conn.out.wait(context.Background(), false, conn.lineTarget(line), line, conn.SendQueue)
+}
+
+// Sends m, complaining down conn.Err if it isn't valid
+func (conn *Conn) writeMessage(m *Message) {
+	if err := conn.Send(m); err != nil {
+		conn.error("%s", err.Error())
+	}
+}
@@ -0,0 +1,120 @@
+package irc
+
+// Here you'll find ModeBatch, for making lots of mode changes on a channel,
+// like opping everyone on a list, in as few MODE commands as the server will
+// let us.
+
+import (
+	"strconv"
+	"strings"
+)
+
+// A ModeBatch collects mode changes for a channel until Flush() is called,
+// then sends them in as few MODE commands as possible. Each MODE has no more
+// changes with arguments than the server's MODES token allows (3 if it
+// doesn't say), and is short enough for the server to accept.
+//
+//	b := conn.NewModeBatch("#moo")
+//	for _, nick := range nicks {
+//		b.Op(nick)
+//	}
+//	b.Ban("*!*@evil.host").Flush()
+type ModeBatch struct {
+	conn    *Conn
+	channel string
+	changes []modeChange
+}
+
+// NewModeBatch() returns an empty ModeBatch for channel
+func (conn *Conn) NewModeBatch(channel string) *ModeBatch {
+	return &ModeBatch{conn: conn, channel: channel}
+}
+
+// Set() adds setting mode, with arg if it takes one, to the batch
+func (b *ModeBatch) Set(mode byte, arg string) *ModeBatch {
+	b.changes = append(b.changes, modeChange{add: true, mode: mode, arg: arg})
+	return b
+}
+
+// Unset() adds unsetting mode, with arg if it takes one, to the batch
+func (b *ModeBatch) Unset(mode byte, arg string) *ModeBatch {
+	b.changes = append(b.changes, modeChange{add: false, mode: mode, arg: arg})
+	return b
+}
+
+// Shorthands for the commonest changes
+func (b *ModeBatch) Op(nick string) *ModeBatch      { return b.Set('o', nick) }
+func (b *ModeBatch) Deop(nick string) *ModeBatch    { return b.Unset('o', nick) }
+func (b *ModeBatch) Voice(nick string) *ModeBatch   { return b.Set('v', nick) }
+func (b *ModeBatch) Devoice(nick string) *ModeBatch { return b.Unset('v', nick) }
+func (b *ModeBatch) Ban(mask string) *ModeBatch     { return b.Set('b', mask) }
+func (b *ModeBatch) Unban(mask string) *ModeBatch   { return b.Unset('b', mask) }
+
+// Len() returns the number of changes waiting to be sent
+func (b *ModeBatch) Len() int { return len(b.changes) }
+
+// Flush() sends the changes in the batch, and empties it
+func (b *ModeBatch) Flush() {
+	for _, modes := range b.modeStrings(b.conn.modesLimit()) {
+		b.conn.Mode(b.channel, modes)
+	}
+	b.changes = nil
+}
+
+// Splits the changes up into mode strings like "+oo-v bob alice carol",
+// each with no more than limit arguments (or any number, if limit is 0) and
+// short enough to fit in a MODE for the channel.
+func (b *ModeBatch) modeStrings(limit int) []string {
+	room := maxMessageLength - len("MODE "+b.channel+" ")
+	out := []string{}
+	var modes, args []string
+	n, size := 0, 0
+	flush := func() {
+		if len(modes) > 0 {
+			out = append(out, strings.Join(append([]string{strings.Join(modes, "")}, args...), " "))
+		}
+		modes, args, n, size = nil, nil, 0, 0
+	}
+	var add bool
+	for _, c := range b.changes {
+		need := 2 // the mode and possibly a sign
+		if c.arg != "" {
+			need += 1 + len(c.arg)
+		}
+		if (c.arg != "" && limit > 0 && n == limit) || size+need > room {
+			flush()
+		}
+		if len(modes) == 0 || c.add != add {
+			add = c.add
+			if add {
+				modes = append(modes, "+")
+			} else {
+				modes = append(modes, "-")
+			}
+		}
+		modes = append(modes, string(c.mode))
+		if c.arg != "" {
+			args = append(args, c.arg)
+			n++
+		}
+		size += need
+	}
+	flush()
+	return out
+}
+
+// Returns the most modes with arguments the server allows in one MODE, from
+// MODES in 005, or 0 for no limit
+func (conn *Conn) modesLimit() int {
+	v, ok := conn.ISupport("MODES")
+	if !ok {
+		return 3
+	}
+	if v == "" {
+		return 0
+	}
+	if l, err := strconv.Atoi(v); err == nil && l > 0 {
+		return l
+	}
+	return 3
+}
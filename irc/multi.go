@@ -0,0 +1,132 @@
+package irc
+
+// Here you'll find Multi, which looks after connections to several networks
+// at once for bots and bouncers that need more than one.
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A struct representing a set of connections, each to a different network
+type Multi struct {
+	conns    map[string]*Conn
+	handlers map[string][]func(string, *Conn, *Line)
+	mu       sync.Mutex
+}
+
+// Creates a new *irc.Multi with no connections
+func NewMulti() *Multi {
+	return &Multi{
+		conns:    make(map[string]*Conn),
+		handlers: make(map[string][]func(string, *Conn, *Line)),
+	}
+}
+
+// Add() adds conn to m as network, replacing any connection already there.
+// Handlers added to m with m.AddHandler() are added to conn too. Connecting
+// conn, and reconnecting it when it disconnects, is still up to you.
+func (m *Multi) Add(network string, conn *Conn) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.conns[network] = conn
+	for name, funcs := range m.handlers {
+		for _, f := range funcs {
+			m.addHandler(network, conn, name, f)
+		}
+	}
+}
+
+// Remove() stops m from looking after network's connection, which is left
+// connected. Handlers m added to it will no longer be called.
+func (m *Multi) Remove(network string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.conns, network)
+}
+
+// Get() returns the connection to network, or nil
+func (m *Multi) Get(network string) *Conn {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.conns[network]
+}
+
+// Networks() returns the names of the networks in m, sorted
+func (m *Multi) Networks() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	n := make([]string, 0, len(m.conns))
+	for network := range m.conns {
+		n = append(n, network)
+	}
+	sort.Strings(n)
+	return n
+}
+
+// AddHandler() adds an event handler to all of m's connections, current and
+// future. Handlers are like the ones added by conn.AddHandler(), but are also
+// given the name of the network the line came from.
+func (m *Multi) AddHandler(name string, f func(network string, conn *Conn, line *Line)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[name] = append(m.handlers[name], f)
+	for network, conn := range m.conns {
+		m.addHandler(network, conn, name, f)
+	}
+}
+
+func (m *Multi) addHandler(network string, conn *Conn, name string, f func(string, *Conn, *Line)) {
+	conn.AddHandler(name, func(conn *Conn, line *Line) {
+		// the connection may have been removed or replaced since
+		if m.Get(network) == conn {
+			f(network, conn, line)
+		}
+	})
+}
+
+// Each() calls f for each of m's connected connections, in network order.
+// This is how to broadcast, e.g.
+//
+//	m.Each(func(network string, conn *irc.Conn) { conn.Away("lunch") })
+func (m *Multi) Each(f func(network string, conn *Conn)) {
+	for _, network := range m.Networks() {
+		if conn := m.Get(network); conn != nil && conn.Connected() {
+			f(network, conn)
+		}
+	}
+}
+
+// Quit() sends a QUIT with message to all of m's connections and waits for up
+// to timeout for them to disconnect. It returns the networks that didn't.
+func (m *Multi) Quit(message string, timeout time.Duration) []string {
+	waiting := make(map[string]<-chan bool)
+	m.Each(func(network string, conn *Conn) {
+		waiting[network] = conn.Disconnected()
+		conn.Quit(message)
+	})
+	deadline := time.After(timeout)
+	expired := false
+	stuck := []string{}
+	for _, network := range m.Networks() {
+		d, ok := waiting[network]
+		if !ok {
+			continue
+		}
+		if !expired {
+			select {
+			case <-d:
+				continue
+			case <-deadline:
+				expired = true
+			}
+		}
+		select {
+		case <-d:
+		default:
+			stuck = append(stuck, network)
+		}
+	}
+	return stuck
+}
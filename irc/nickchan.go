@@ -6,6 +6,9 @@ package irc
 import (
 	"fmt"
 	"reflect"
+	"sort"
+	"strings"
+	"time"
 )
 
 // A struct representing an IRC channel
@@ -13,7 +16,30 @@ type Channel struct {
 	Name, Topic string
 	Modes       *ChanMode
 	Nicks       map[*Nick]*ChanPrivs
-	conn        *Conn
+
+	// When the channel was created and its URL, if the server tells us
+	Created time.Time
+	URL     string
+
+	// When someone last said something in the channel, or when we joined it
+	// if nobody has since. See idle.go.
+	Active time.Time
+	idle   bool
+
+	// Synced is true once we've had the whole NAMES list for the channel,
+	// i.e. Nicks is complete. See the "CHANNELSYNCED" event.
+	Synced bool
+	names  []string
+
+	// Ready is true once we've also had the replies to the queries we send
+	// about the channel after joining it: its modes, ban lists and a WHO.
+	// See the "CHANNELREADY" event and sync.go.
+	Ready    bool
+	unsynced map[string]bool
+
+	// The masks on list modes like +b, see ch.List()
+	lists map[byte][]string
+	conn  *Conn
 }
 
 // A struct representing an IRC nick
@@ -21,7 +47,12 @@ type Nick struct {
 	Nick, Ident, Host, Name string
 	Modes                   *NickMode
 	Channels                map[*Channel]*ChanPrivs
-	conn                    *Conn
+
+	// The services account the nick is logged in to, if we know, and
+	// whether they're away. These are kept up to date by WHO replies.
+	Account string
+	Away    bool
+	conn    *Conn
 }
 
 // A struct representing the modes of an IRC Channel
@@ -50,6 +81,9 @@ type ChanMode struct {
 type NickMode struct {
 	// MODE +i, +o, +w, +x, +z
 	Invisible, Oper, WallOps, HiddenHost, SSL bool
+
+	// Server notice masks set with MODE +s, by letter. See snomask.go.
+	Snomasks map[byte]bool
 }
 
 // A struct representing the modes a Nick can have on a Channel
@@ -58,22 +92,49 @@ type ChanPrivs struct {
 	Owner, Admin, Op, HalfOp, Voice bool
 }
 
+// Something that can be sent messages: a *Channel, a *Nick, or any other name
+// via conn.Target(). See PrivmsgTo() and friends.
+type Target interface {
+	Target() string
+	IsChannel() bool
+}
+
+// A Target for a name that we aren't tracking
+type rawTarget struct {
+	name    string
+	channel bool
+}
+
+func (t *rawTarget) Target() string  { return t.name }
+func (t *rawTarget) IsChannel() bool { return t.channel }
+
+func (ch *Channel) Target() string  { return ch.Name }
+func (ch *Channel) IsChannel() bool { return true }
+
+func (n *Nick) Target() string  { return n.Nick }
+func (n *Nick) IsChannel() bool { return false }
+
 /******************************************************************************\
  * Conn methods to create/look up nicks/channels
 \******************************************************************************/
 
 // Creates a new *irc.Nick, initialises it, and stores it in *irc.Conn so it
 // can be properly tracked for state management purposes.
-func (conn *Conn) NewNick(nick, ident, name, host string) *Nick {
+func (conn *Conn) newNick(nick, ident, name, host string) *Nick {
 	n := &Nick{Nick: nick, Ident: ident, Name: name, Host: host, conn: conn}
 	n.initialise()
-	conn.nicks[n.Nick] = n
+	conn.state.Lock()
+	defer conn.state.Unlock()
+	conn.nicks[conn.Fold(n.Nick)] = n
 	return n
 }
 
-// Returns an *irc.Nick for the nick n, if we're tracking it.
+// Returns an *irc.Nick for the nick n, if we're tracking it. Nicks are
+// looked up case-insensitively, see Fold().
 func (conn *Conn) GetNick(n string) *Nick {
-	if nick, ok := conn.nicks[n]; ok {
+	conn.state.RLock()
+	defer conn.state.RUnlock()
+	if nick, ok := conn.nicks[conn.Fold(n)]; ok {
 		return nick
 	}
 	return nil
@@ -81,21 +142,70 @@ func (conn *Conn) GetNick(n string) *Nick {
 
 // Creates a new *irc.Channel, initialises it, and stores it in *irc.Conn so it
 // can be properly tracked for state management purposes.
-func (conn *Conn) NewChannel(c string) *Channel {
-	ch := &Channel{Name: c, conn: conn}
+func (conn *Conn) newChannel(c string) *Channel {
+	ch := &Channel{Name: c, Active: time.Now(), conn: conn}
 	ch.initialise()
-	conn.chans[ch.Name] = ch
+	conn.state.Lock()
+	defer conn.state.Unlock()
+	conn.chans[conn.Fold(ch.Name)] = ch
 	return ch
 }
 
-// Returns an *irc.Channel for the channel c, if we're tracking it.
+// Returns all the channels we're on, sorted by name
+func (conn *Conn) Channels() []*Channel {
+	conn.state.RLock()
+	defer conn.state.RUnlock()
+	l := make([]*Channel, 0, len(conn.chans))
+	for _, ch := range conn.chans {
+		l = append(l, ch)
+	}
+	sortChannels(l)
+	return l
+}
+
+// Returns all the nicks we know about, ourselves included, sorted by nick
+func (conn *Conn) Nicks() []*Nick {
+	conn.state.RLock()
+	defer conn.state.RUnlock()
+	l := make([]*Nick, 0, len(conn.nicks))
+	for _, n := range conn.nicks {
+		l = append(l, n)
+	}
+	sort.Slice(l, func(i, j int) bool { return conn.Fold(l[i].Nick) < conn.Fold(l[j].Nick) })
+	return l
+}
+
+func sortChannels(l []*Channel) {
+	if len(l) == 0 {
+		return
+	}
+	conn := l[0].conn
+	sort.Slice(l, func(i, j int) bool { return conn.Fold(l[i].Name) < conn.Fold(l[j].Name) })
+}
+
+// Returns an *irc.Channel for the channel c, if we're tracking it. Channels
+// are looked up case-insensitively, see Fold().
 func (conn *Conn) GetChannel(c string) *Channel {
-	if ch, ok := conn.chans[c]; ok {
+	conn.state.RLock()
+	defer conn.state.RUnlock()
+	if ch, ok := conn.chans[conn.Fold(c)]; ok {
 		return ch
 	}
 	return nil
 }
 
+// Returns a Target for name: the *Channel or *Nick if we're tracking it, or a
+// Target that uses the server's CHANTYPES to work out if it's a channel.
+func (conn *Conn) Target(name string) Target {
+	if ch := conn.GetChannel(name); ch != nil {
+		return ch
+	}
+	if n := conn.GetNick(name); n != nil {
+		return n
+	}
+	return &rawTarget{name, conn.IsChannel(name)}
+}
+
 /******************************************************************************\
  * Channel methods for state management
 \******************************************************************************/
@@ -103,47 +213,145 @@ func (conn *Conn) GetChannel(c string) *Channel {
 func (ch *Channel) initialise() {
 	ch.Modes = new(ChanMode)
 	ch.Nicks = make(map[*Nick]*ChanPrivs)
+	ch.lists = make(map[byte][]string)
+}
+
+// Adds mask to or removes it from the channel's list mode m
+func (ch *Channel) setList(m byte, mask string, add bool) {
+	ch.conn.state.Lock()
+	defer ch.conn.state.Unlock()
+	l := ch.lists[m]
+	for i, s := range l {
+		if s == mask {
+			if !add {
+				ch.lists[m] = append(l[0:i:i], l[i+1:]...)
+			}
+			return
+		}
+	}
+	if add {
+		ch.lists[m] = append(l, mask)
+	}
+}
+
+// Returns the masks set on the channel's list mode m, e.g. 'b' for bans or
+// 'e' for ban exceptions, as far as we know. The ban list is asked for when
+// we join, but others are only filled in from MODE changes we see.
+func (ch *Channel) List(m byte) []string {
+	ch.conn.state.RLock()
+	defer ch.conn.state.RUnlock()
+	return append([]string{}, ch.lists[m]...)
+}
+
+// Returns the channel's ban list, see ch.List()
+func (ch *Channel) Bans() []string {
+	return ch.List('b')
+}
+
+// Returns the channel's quiets: the +q list on servers where +q is a list
+// mode, and bans using a quiet extban on servers that do quiets that way.
+func (ch *Channel) Quiets() []string {
+	list := ch.conn.modeTypes().list
+	ch.conn.state.RLock()
+	defer ch.conn.state.RUnlock()
+	q := []string{}
+	if strings.IndexByte(list, 'q') != -1 {
+		q = append(q, ch.lists['q']...)
+	}
+	for _, b := range ch.lists['b'] {
+		if e := ch.conn.ParseExtBan(b); e != nil && !e.Negate && quietExtBans[e.Type] {
+			q = append(q, e.Arg)
+		}
+	}
+	return q
 }
 
 // Associates an *irc.Nick with an *irc.Channel using a shared *irc.ChanPrivs
-func (ch *Channel) AddNick(n *Nick) {
-	if _, ok := ch.Nicks[n]; !ok {
+func (ch *Channel) addNick(n *Nick) {
+	ch.conn.state.Lock()
+	_, ok := ch.Nicks[n]
+	if !ok {
 		ch.Nicks[n] = new(ChanPrivs)
 		n.Channels[ch] = ch.Nicks[n]
-	} else {
-		ch.conn.error("irc.Channel.AddNick() warning: trying to add already-present nick %s to channel %s", n.Nick, ch.Name)
+	}
+	ch.conn.state.Unlock()
+	if ok {
+		ch.conn.error("irc.Channel.addNick() warning: trying to add already-present nick %s to channel %s", n.Nick, ch.Name)
 	}
 }
 
-// Disassociates an *irc.Nick from an *irc.Channel. Will call ch.Delete() if
+// Disassociates an *irc.Nick from an *irc.Channel. Will call ch.delete() if
 // the *irc.Nick being removed is the connection's nick. Will also call
-// n.DelChannel(ch) to remove the association from the perspective of *irc.Nick.
-func (ch *Channel) DelNick(n *Nick) {
-	if _, ok := ch.Nicks[n]; ok {
-		if n == n.conn.Me {
+// n.delChannel(ch) to remove the association from the perspective of *irc.Nick.
+func (ch *Channel) delNick(n *Nick) {
+	if n == n.conn.Me {
+		if ch.privs(n) != nil {
 			// we're leaving the channel, so remove all state we have about it
-			ch.Delete()
-		} else {
-			ch.Nicks[n] = nil, false
-			n.DelChannel(ch)
+			ch.delete()
 		}
+		return
+	}
+	ch.conn.state.Lock()
+	defer ch.conn.state.Unlock()
+	ch.delNickLocked(n)
+}
+
+// ch.delNick() for when ch.conn.state is already held
+func (ch *Channel) delNickLocked(n *Nick) {
+	if _, ok := ch.Nicks[n]; ok && n != n.conn.Me {
+		delete(ch.Nicks, n)
+		n.delChannelLocked(ch)
 	} // no else here ...
-	// we call Channel.DelNick() and Nick.DelChan() from each other to ensure
+	// we call Channel.delNick() and Nick.delChannel() from each other to ensure
 	// consistency, and this would mean spewing an error message every delete
 }
 
+// Returns the nicks on the channel in a predictable order: by privilege, from
+// owners down to those with no privileges at all, then by nick.
+func (ch *Channel) NickList() []*Nick {
+	ch.conn.state.RLock()
+	defer ch.conn.state.RUnlock()
+	return ch.nickList()
+}
+
+// ch.NickList() for when ch.conn.state is already held
+func (ch *Channel) nickList() []*Nick {
+	l := make([]*Nick, 0, len(ch.Nicks))
+	for n := range ch.Nicks {
+		l = append(l, n)
+	}
+	sort.Slice(l, func(i, j int) bool {
+		if ri, rj := ch.Nicks[l[i]].rank(), ch.Nicks[l[j]].rank(); ri != rj {
+			return ri > rj
+		}
+		return ch.conn.Fold(l[i].Nick) < ch.conn.Fold(l[j].Nick)
+	})
+	return l
+}
+
+// Returns n's privileges on the channel, or nil if they're not on it
+func (ch *Channel) privs(n *Nick) *ChanPrivs {
+	ch.conn.state.RLock()
+	defer ch.conn.state.RUnlock()
+	return ch.Nicks[n]
+}
+
 // Stops the channel from being tracked by state tracking handlers. Also calls
-// n.DelChannel(ch) for all nicks that are associated with the channel.
-func (ch *Channel) Delete() {
-	for n, _ := range ch.Nicks {
-		n.DelChannel(ch)
+// n.delChannel(ch) for all nicks that are associated with the channel.
+func (ch *Channel) delete() {
+	ch.conn.state.Lock()
+	for n := range ch.Nicks {
+		n.delChannelLocked(ch)
 	}
-	ch.conn.chans[ch.Name] = nil, false
+	delete(ch.conn.chans, ch.conn.Fold(ch.Name))
+	ch.conn.state.Unlock()
+	ch.conn.dropSync(ch)
 }
 
 /******************************************************************************\
  * Nick methods for state management
 \******************************************************************************/
+
 func (n *Nick) initialise() {
 	n.Modes = new(NickMode)
 	n.Channels = make(map[*Channel]*ChanPrivs)
@@ -151,50 +359,98 @@ func (n *Nick) initialise() {
 
 // Associates an *irc.Channel with an *irc.Nick using a shared *irc.ChanPrivs
 //
-// Very slightly different to irc.Channel.AddNick() in that it tests for a
+// Very slightly different to irc.Channel.addNick() in that it tests for a
 // pre-existing association within the *irc.Nick object rather than the
-// *irc.Channel object before associating the two. 
-func (n *Nick) AddChannel(ch *Channel) {
-	if _, ok := n.Channels[ch]; !ok {
+// *irc.Channel object before associating the two.
+func (n *Nick) addChannel(ch *Channel) {
+	n.conn.state.Lock()
+	_, ok := n.Channels[ch]
+	if !ok {
 		ch.Nicks[n] = new(ChanPrivs)
 		n.Channels[ch] = ch.Nicks[n]
-	} else {
-		n.conn.error("irc.Nick.AddChannel() warning: trying to add already-present channel %s to nick %s", ch.Name, n.Nick)
+	}
+	n.conn.state.Unlock()
+	if ok {
+		n.conn.error("irc.Nick.addChannel() warning: trying to add already-present channel %s to nick %s", ch.Name, n.Nick)
 	}
 }
 
-// Disassociates an *irc.Channel from an *irc.Nick. Will call n.Delete() if
+// Disassociates an *irc.Channel from an *irc.Nick. Will call n.delete() if
 // the *irc.Nick is no longer on any channels we are tracking. Will also call
-// ch.DelNick(n) to remove the association from the perspective of *irc.Channel.
-func (n *Nick) DelChannel(ch *Channel) {
+// ch.delNick(n) to remove the association from the perspective of *irc.Channel.
+func (n *Nick) delChannel(ch *Channel) {
+	if n == n.conn.Me {
+		ch.delNick(n)
+		return
+	}
+	n.conn.state.Lock()
+	defer n.conn.state.Unlock()
+	n.delChannelLocked(ch)
+}
+
+// n.delChannel() for when n.conn.state is already held
+func (n *Nick) delChannelLocked(ch *Channel) {
 	if _, ok := n.Channels[ch]; ok {
-		n.Channels[ch] = nil, false
-		ch.DelNick(n)
+		delete(n.Channels, ch)
+		delete(ch.Nicks, n)
 		if len(n.Channels) == 0 {
 			// nick is no longer in any channels we inhabit, stop tracking it
-			n.Delete()
+			n.deleteLocked()
 		}
 	}
 }
 
 // Signals to the tracking code that the *irc.Nick object should be tracked
 // under a "neu" nick rather than the old one.
-func (n *Nick) ReNick(neu string) {
-	n.conn.nicks[n.Nick] = nil, false
+func (n *Nick) reNick(neu string) {
+	n.conn.state.Lock()
+	defer n.conn.state.Unlock()
+	delete(n.conn.nicks, n.conn.Fold(n.Nick))
 	n.Nick = neu
-	n.conn.nicks[n.Nick] = n
+	n.conn.nicks[n.conn.Fold(n.Nick)] = n
 }
 
 // Stops the nick from being tracked by state tracking handlers. Also calls
-// ch.DelNick(n) for all nicks that are associated with the channel.
-func (n *Nick) Delete() {
+// ch.delNick(n) for all nicks that are associated with the channel.
+func (n *Nick) delete() {
+	n.conn.state.Lock()
+	defer n.conn.state.Unlock()
+	n.deleteLocked()
+}
+
+// n.delete() for when n.conn.state is already held
+func (n *Nick) deleteLocked() {
 	// we don't ever want to remove *our* nick from conn.nicks...
 	if n != n.conn.Me {
-		for ch, _ := range n.Channels {
-			ch.DelNick(n)
+		for ch := range n.Channels {
+			ch.delNickLocked(n)
 		}
-		n.conn.nicks[n.Nick] = nil, false
+		delete(n.conn.nicks, n.conn.Fold(n.Nick))
+	}
+}
+
+// Returns the channels the nick is on, sorted by name
+func (n *Nick) ChannelList() []*Channel {
+	n.conn.state.RLock()
+	defer n.conn.state.RUnlock()
+	return n.channelList()
+}
+
+// n.ChannelList() for when n.conn.state is already held
+func (n *Nick) channelList() []*Channel {
+	l := make([]*Channel, 0, len(n.Channels))
+	for ch := range n.Channels {
+		l = append(l, ch)
 	}
+	sortChannels(l)
+	return l
+}
+
+// Updates n from the flags in a WHO reply, like "G*@": H or G for here or
+// gone (away), * for an IRC operator, then channel privileges.
+func (n *Nick) whoFlags(flags string) {
+	n.Away = strings.Contains(flags, "G")
+	n.Modes.Oper = strings.Contains(flags, "*")
 }
 
 /******************************************************************************\
@@ -203,44 +459,44 @@ func (n *Nick) Delete() {
 
 // Map *irc.ChanMode fields to IRC mode characters
 var ChanModeToString = map[string]string{
-	"Private": "p",
-	"Secret": "s",
+	"Private":        "p",
+	"Secret":         "s",
 	"ProtectedTopic": "t",
-	"NoExternalMsg": "n",
-	"Moderated": "m",
-	"InviteOnly": "i",
-	"OperOnly": "O",
-	"SSLOnly": "z",
-	"Key": "k",
-	"Limit": "l",
+	"NoExternalMsg":  "n",
+	"Moderated":      "m",
+	"InviteOnly":     "i",
+	"OperOnly":       "O",
+	"SSLOnly":        "z",
+	"Key":            "k",
+	"Limit":          "l",
 }
 
 // Map *irc.NickMode fields to IRC mode characters
 var NickModeToString = map[string]string{
-	"Invisible": "i",
-	"Oper": "o",
-	"WallOps": "w",
+	"Invisible":  "i",
+	"Oper":       "o",
+	"WallOps":    "w",
 	"HiddenHost": "x",
-	"SSL": "z",
+	"SSL":        "z",
 }
 
 // Map *irc.ChanPrivs fields to IRC mode characters
 var ChanPrivToString = map[string]string{
-	"Owner": "q",
-	"Admin": "a",
-	"Op": "o",
+	"Owner":  "q",
+	"Admin":  "a",
+	"Op":     "o",
 	"HalfOp": "h",
-	"Voice": "v",
+	"Voice":  "v",
 }
 
 // Map *irc.ChanPrivs fields to the symbols used to represent these modes
 // in NAMES and WHOIS responses
 var ChanPrivToModeChar = map[string]byte{
-	"Owner": '~',
-	"Admin": '&',
-	"Op": '@',
+	"Owner":  '~',
+	"Admin":  '&',
+	"Op":     '@',
 	"HalfOp": '%',
-	"Voice": '+',
+	"Voice":  '+',
 }
 
 // Reverse mappings of the above datastructures
@@ -268,9 +524,12 @@ func init() {
 }
 
 // Returns a string representing the channel. Looks like:
+//
 //	Channel: <channel name> e.g. #moo
 //	Topic: <channel topic> e.g. Discussing the merits of cows!
 //	Mode: <channel modes> e.g. +nsti
+//	Created: <creation time> e.g. 2011-01-01 00:00:00 +0000 UTC
+//	URL: <channel url> e.g. http://cows.org/
 //	Nicks:
 //		<nick>: <privs> e.g. CowMaster: +o
 //		...
@@ -278,53 +537,70 @@ func (ch *Channel) String() string {
 	str := "Channel: " + ch.Name + "\n\t"
 	str += "Topic: " + ch.Topic + "\n\t"
 	str += "Modes: " + ch.Modes.String() + "\n\t"
+	if !ch.Created.IsZero() {
+		str += "Created: " + ch.Created.String() + "\n\t"
+	}
+	if ch.URL != "" {
+		str += "URL: " + ch.URL + "\n\t"
+	}
 	str += "Nicks: \n"
-	for n, p := range ch.Nicks {
-		str += "\t\t" + n.Nick + ": " + p.String() + "\n"
+	ch.conn.state.RLock()
+	defer ch.conn.state.RUnlock()
+	for _, n := range ch.nickList() {
+		str += "\t\t" + n.Nick + ": " + ch.Nicks[n].String() + "\n"
 	}
 	return str
 }
 
 // Returns a string representing the nick. Looks like:
+//
 //	Nick: <nick name> e.g. CowMaster
 //	Hostmask: <ident@host> e.g. moo@cows.org
 //	Real Name: <real name> e.g. Steve "CowMaster" Bush
+//	Account: <services account> e.g. CowMaster
 //	Modes: <nick modes> e.g. +z
 //	Channels:
 //		<channel>: <privs> e.g. #moo: +o
 //		...
 func (n *Nick) String() string {
+	n.conn.state.RLock()
+	defer n.conn.state.RUnlock()
 	str := "Nick: " + n.Nick + "\n\t"
 	str += "Hostmask: " + n.Ident + "@" + n.Host + "\n\t"
 	str += "Real Name: " + n.Name + "\n\t"
+	if n.Account != "" {
+		str += "Account: " + n.Account + "\n\t"
+	}
 	str += "Modes: " + n.Modes.String() + "\n\t"
 	str += "Channels: \n"
-	for ch, p := range n.Channels {
-		str += "\t\t" + ch.Name + ": " + p.String() + "\n"
+	for _, ch := range n.channelList() {
+		str += "\t\t" + ch.Name + ": " + n.Channels[ch].String() + "\n"
 	}
 	return str
 }
 
 // Returns a string representing the channel modes. Looks like:
+//
 //	+npk key
 func (cm *ChanMode) String() string {
 	str := "+"
 	a := make([]string, 2)
-	v := reflect.Indirect(reflect.NewValue(cm)).(*reflect.StructValue)
-	t := v.Type().(*reflect.StructType)
+	v := reflect.Indirect(reflect.ValueOf(cm))
+	t := v.Type()
 	for i := 0; i < v.NumField(); i++ {
-		switch f := v.Field(i).(type) {
-		case *reflect.BoolValue:
-			if f.Get() {
+		switch f := v.Field(i); f.Kind() {
+		case reflect.Bool:
+			if f.Bool() {
 				str += ChanModeToString[t.Field(i).Name]
 			}
-		case *reflect.StringValue:
-			if f.Get() != "" {
+		case reflect.String:
+			if f.String() != "" {
 				str += ChanModeToString[t.Field(i).Name]
-				a[0] = f.Get()
+				// don't leak channel keys into debug output
+				a[0] = "*"
 			}
-		case *reflect.IntValue:
-			if f.Get() != 0 {
+		case reflect.Int:
+			if f.Int() != 0 {
 				str += ChanModeToString[t.Field(i).Name]
 				a[1] = fmt.Sprintf("%d", cm.Limit)
 			}
@@ -342,37 +618,83 @@ func (cm *ChanMode) String() string {
 }
 
 // Returns a string representing the nick modes. Looks like:
+//
 //	+iwx
+//	+ios +Fck
 func (nm *NickMode) String() string {
 	str := "+"
-	v := reflect.Indirect(reflect.NewValue(nm)).(*reflect.StructValue)
-	t := v.Type().(*reflect.StructType)
+	v := reflect.Indirect(reflect.ValueOf(nm))
+	t := v.Type()
 	for i := 0; i < v.NumField(); i++ {
-		switch f := v.Field(i).(type) {
+		switch f := v.Field(i); f.Kind() {
 		// only bools here at the mo!
-		case *reflect.BoolValue:
-			if f.Get() {
+		case reflect.Bool:
+			if f.Bool() {
 				str += NickModeToString[t.Field(i).Name]
 			}
 		}
 	}
+	if sno := nm.snomaskString(); sno != "" {
+		str += "s " + sno
+	}
 	if str == "+" {
 		str = "No modes set"
 	}
 	return str
 }
 
+// Sets the privilege for the prefix mode m, e.g. 'o' for Op
+func (p *ChanPrivs) set(m byte, on bool) {
+	switch m {
+	case 'q':
+		p.Owner = on
+	case 'a':
+		p.Admin = on
+	case 'o':
+		p.Op = on
+	case 'h':
+		p.HalfOp = on
+	case 'v':
+		p.Voice = on
+	}
+}
+
+// Returns how privileged p is: 5 for Owner down to 1 for Voice, or 0
+func (p *ChanPrivs) rank() int {
+	for i, on := range []bool{p.Owner, p.Admin, p.Op, p.HalfOp, p.Voice} {
+		if on {
+			return 5 - i
+		}
+	}
+	return 0
+}
+
+// Returns the symbol for the highest privilege in p, as used in NAMES
+// replies, e.g. "@" for Op, or "" if there aren't any
+func (p *ChanPrivs) prefix() string {
+	for _, f := range []struct {
+		on   bool
+		name string
+	}{{p.Owner, "Owner"}, {p.Admin, "Admin"}, {p.Op, "Op"}, {p.HalfOp, "HalfOp"}, {p.Voice, "Voice"}} {
+		if f.on {
+			return string(ChanPrivToModeChar[f.name])
+		}
+	}
+	return ""
+}
+
 // Returns a string representing the channel privileges. Looks like:
+//
 //	+o
 func (p *ChanPrivs) String() string {
 	str := "+"
-	v := reflect.Indirect(reflect.NewValue(p)).(*reflect.StructValue)
-	t := v.Type().(*reflect.StructType)
+	v := reflect.Indirect(reflect.ValueOf(p))
+	t := v.Type()
 	for i := 0; i < v.NumField(); i++ {
-		switch f := v.Field(i).(type) {
+		switch f := v.Field(i); f.Kind() {
 		// only bools here at the mo too!
-		case *reflect.BoolValue:
-			if f.Get() {
+		case reflect.Bool:
+			if f.Bool() {
 				str += ChanPrivToString[t.Field(i).Name]
 			}
 		}
@@ -0,0 +1,244 @@
+package irc
+
+// Here you'll find ISON and USERHOST, the old ways of finding out whether
+// nicks are online and who they are without a WHOIS for each of them, and
+// WHOWAS for finding out who they were once they've gone.
+
+import (
+	"strings"
+)
+
+// A struct representing one nick from a USERHOST reply
+type UserHostReply struct {
+	Nick, Ident, Host string
+
+	// Whether the nick is an IRC operator, and whether they're away
+	Oper, Away bool
+}
+
+// A struct representing one entry from a WHOWAS reply, most recent first:
+// who was using the nick, which server they were on and when, as the server
+// put it, e.g. "Sat Oct 17 12:00:00 2026".
+type WhowasReply struct {
+	Nick, Ident, Host, Name string
+	Server, When            string
+}
+
+// A WHOWAS we're waiting for the end of
+type whowas struct {
+	c       chan []*WhowasReply
+	replies []*WhowasReply
+}
+
+func (conn *Conn) setupQueries() {
+	// Handle 303 ISON replies by handing the nicks that are on to whoever
+	// has been waiting longest, since replies come back in order
+	conn.AddHandler("303", func(conn *Conn, line *Line) {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		if len(conn.ison) == 0 {
+			return
+		}
+		conn.ison[0] <- strings.Fields(line.Text)
+		conn.ison = conn.ison[1:]
+	})
+
+	// Handle 302 USERHOST replies, which look like:
+	//	:server 302 me :nick*=+ident@host other=-ident@host
+	// where * means the nick is an oper and - means they're away
+	conn.AddHandler("302", func(conn *Conn, line *Line) {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		if len(conn.userhost) == 0 {
+			return
+		}
+		conn.userhost[0] <- parseUserHost(line.Text)
+		conn.userhost = conn.userhost[1:]
+	})
+
+	// Handle 461 ERR_NEEDMOREPARAMS and 421 ERR_UNKNOWNCOMMAND for the
+	// commands above, which come instead of a reply, so that the replies
+	// to later ones still go to the right place:
+	//	:server 421 me ISON :Unknown command
+	refused := func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			return
+		}
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		switch strings.ToUpper(line.Args[1]) {
+		case "ISON":
+			if len(conn.ison) > 0 {
+				close(conn.ison[0])
+				conn.ison = conn.ison[1:]
+			}
+		case "USERHOST":
+			if len(conn.userhost) > 0 {
+				close(conn.userhost[0])
+				conn.userhost = conn.userhost[1:]
+			}
+		case "WHOWAS":
+			// we never send a WHOWAS without a nick, so the server
+			// doesn't know the command at all and none will be answered
+			for _, l := range conn.whowas {
+				for _, w := range l {
+					close(w.c)
+				}
+			}
+			conn.whowas = make(map[string][]*whowas)
+		}
+	}
+	conn.AddHandler("461", refused)
+	conn.AddHandler("421", refused)
+
+	// Handle 314 RPL_WHOWASUSER, one for each time the nick was used:
+	//	:server 314 me nick ident host * :Real Name
+	conn.AddHandler("314", func(conn *Conn, line *Line) {
+		if len(line.Args) < 4 {
+			return
+		}
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		if w := conn.whowasFor(line.Args[1]); w != nil {
+			w.replies = append(w.replies, &WhowasReply{Nick: line.Args[1],
+				Ident: line.Args[2], Host: line.Args[3], Name: line.Text})
+		}
+	})
+
+	// Handle 312, which after a 314 says which server the nick was on and when:
+	//	:server 312 me nick irc.server :Sat Oct 17 12:00:00 2026
+	// WHOIS replies use it too, but won't be waited for by a WHOWAS.
+	conn.AddHandler("312", func(conn *Conn, line *Line) {
+		if len(line.Args) < 3 {
+			return
+		}
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		w := conn.whowasFor(line.Args[1])
+		if w == nil || len(w.replies) == 0 {
+			return
+		}
+		if r := w.replies[len(w.replies)-1]; r.Server == "" {
+			r.Server, r.When = line.Args[2], line.Text
+		}
+	})
+
+	// Handle 369 RPL_ENDOFWHOWAS by handing over what we've collected to
+	// whoever has been waiting longest for this nick. A 406 ERR_WASNOSUCHNICK
+	// comes before it when the server doesn't remember the nick at all.
+	conn.AddHandler("369", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			return
+		}
+		n := conn.Fold(line.Args[1])
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		if w := conn.whowasFor(line.Args[1]); w != nil {
+			w.c <- w.replies
+			if conn.whowas[n] = conn.whowas[n][1:]; len(conn.whowas[n]) == 0 {
+				delete(conn.whowas, n)
+			}
+		}
+	})
+}
+
+// Closes the channels of everyone still waiting for ISON, USERHOST and WHOWAS
+// replies, as they're not going to come now. Called from shutdown().
+func (conn *Conn) failQueries() {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for _, c := range conn.ison {
+		close(c)
+	}
+	for _, c := range conn.userhost {
+		close(c)
+	}
+	for _, l := range conn.whowas {
+		for _, w := range l {
+			close(w.c)
+		}
+	}
+	conn.ison, conn.userhost = nil, nil
+	conn.whowas = make(map[string][]*whowas)
+}
+
+// Returns the oldest WHOWAS waiting for nick, or nil. conn.mu must be held.
+func (conn *Conn) whowasFor(nick string) *whowas {
+	if l := conn.whowas[conn.Fold(nick)]; len(l) > 0 {
+		return l[0]
+	}
+	return nil
+}
+
+// parses the text of a 302 reply, skipping anything that doesn't make sense
+func parseUserHost(s string) []*UserHostReply {
+	replies := []*UserHostReply{}
+	for _, r := range strings.Fields(s) {
+		eq, at := strings.Index(r, "="), strings.LastIndex(r, "@")
+		if eq < 1 || at < eq+2 {
+			continue
+		}
+		u := &UserHostReply{Nick: r[0:eq], Ident: r[eq+2 : at], Host: r[at+1:]}
+		if strings.HasSuffix(u.Nick, "*") {
+			u.Nick, u.Oper = u.Nick[0:len(u.Nick)-1], true
+		}
+		u.Away = r[eq+1] == '-'
+		replies = append(replies, u)
+	}
+	return replies
+}
+
+// IsOn() sends an ISON for nicks, and sends the ones that are on IRC down
+// the returned channel when the server replies. This is handy for keeping an
+// eye on people on networks that don't support MONITOR. If there are no
+// nicks, the server refuses the ISON, or we disconnect first, the channel is
+// closed without anything being sent down it.
+func (conn *Conn) IsOn(nicks ...string) <-chan []string {
+	c := make(chan []string, 1)
+	if len(nicks) == 0 {
+		close(c)
+		return c
+	}
+	conn.mu.Lock()
+	conn.ison = append(conn.ison, c)
+	conn.mu.Unlock()
+	conn.writeMessage(NewMessage("ISON", nicks...))
+	return c
+}
+
+// UserHost() sends a USERHOST for nicks, and sends what the server tells us
+// about the ones that are on IRC down the returned channel. Servers only
+// answer for the first five nicks. As with IsOn(), the channel is closed
+// without anything being sent down it if there are no nicks, the server
+// refuses the USERHOST, or we disconnect first.
+func (conn *Conn) UserHost(nicks ...string) <-chan []*UserHostReply {
+	c := make(chan []*UserHostReply, 1)
+	if len(nicks) == 0 {
+		close(c)
+		return c
+	}
+	conn.mu.Lock()
+	conn.userhost = append(conn.userhost, c)
+	conn.mu.Unlock()
+	conn.writeMessage(NewMessage("USERHOST", nicks...))
+	return c
+}
+
+// Whowas() sends a WHOWAS for nick, and sends what the server remembers
+// about the people who used it down the returned channel, most recent first.
+// If it doesn't remember anything the slice is empty. As with IsOn(), the
+// channel is closed without anything being sent down it if nick is "", the
+// server refuses the WHOWAS, or we disconnect first.
+func (conn *Conn) Whowas(nick string) <-chan []*WhowasReply {
+	w := &whowas{c: make(chan []*WhowasReply, 1), replies: []*WhowasReply{}}
+	if nick == "" {
+		close(w.c)
+		return w.c
+	}
+	n := conn.Fold(nick)
+	conn.mu.Lock()
+	conn.whowas[n] = append(conn.whowas[n], w)
+	conn.mu.Unlock()
+	conn.writeMessage(NewMessage("WHOWAS", nick))
+	return w.c
+}
@@ -0,0 +1,209 @@
+package irc
+
+// Here you'll find the queue that lines wait in to be sent to the server. It
+// keeps a separate queue for each target we're sending messages to and takes
+// lines from them in turn, so that flooding one busy channel with output
+// doesn't hold up replies to everyone else.
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Errors returned by SendContext() and TrySend()
+var (
+	ErrQueueFull   = errors.New("irc: send queue full")
+	ErrQueueClosed = errors.New("irc: disconnected while waiting to send")
+)
+
+// A struct representing the queue of lines waiting for send()
+type sendQueue struct {
+	// Lines waiting to be sent, by target ("" for lines that aren't messages
+	// to anyone), and the targets with lines waiting, in the order they'll be
+	// taken from
+	lines map[string][]string
+	order []string
+	n     int
+
+	closed bool
+	mu     sync.Mutex
+	cond   *sync.Cond
+}
+
+func newSendQueue() *sendQueue {
+	q := &sendQueue{lines: make(map[string][]string)}
+	q.cond = sync.NewCond(&q.mu)
+	return q
+}
+
+// Adds line to the queue for target. If there are already limit lines in the
+// queue, overflow decides whether to wait for space, drop line, or drop the
+// oldest line queued for the busiest target. Returns false if line was
+// dropped, which it also is if the queue has been closed.
+func (q *sendQueue) push(target, line string, limit int, overflow Overflow) bool {
+	if limit < 1 {
+		limit = 1
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.n >= limit && !q.closed {
+		switch overflow {
+		case OverflowDrop:
+			return false
+		case OverflowDropOldest:
+			if !q.dropOldest() {
+				q.cond.Wait()
+			}
+		default:
+			q.cond.Wait()
+		}
+	}
+	if q.closed {
+		return false
+	}
+	q.add(target, line)
+	return true
+}
+
+// Adds line to the queue for target if there are fewer than limit lines
+// queued. If there aren't, it returns ErrQueueFull, or if block is true waits
+// until there are or ctx is done.
+func (q *sendQueue) wait(ctx context.Context, block bool, target, line string, limit int) error {
+	if limit < 1 {
+		limit = 1
+	}
+	// sync.Cond doesn't know about contexts, so wake everyone up
+	stop := context.AfterFunc(ctx, func() {
+		q.mu.Lock()
+		q.cond.Broadcast()
+		q.mu.Unlock()
+	})
+	defer stop()
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.n >= limit && !q.closed {
+		if !block {
+			return ErrQueueFull
+		} else if err := ctx.Err(); err != nil {
+			return err
+		}
+		q.cond.Wait()
+	}
+	if q.closed {
+		return ErrQueueClosed
+	}
+	q.add(target, line)
+	return nil
+}
+
+// Adds line to the end of the queue for target
+func (q *sendQueue) add(target, line string) {
+	if len(q.lines[target]) == 0 {
+		q.order = append(q.order, target)
+	}
+	q.lines[target] = append(q.lines[target], line)
+	q.n++
+	q.cond.Broadcast()
+}
+
+// Throws away the oldest line from the target with the most lines waiting,
+// as that's the one most likely to be flooding the queue. Lines that aren't
+// messages to anyone, like PONGs and registration, are never thrown away;
+// returns false if those are all there is.
+func (q *sendQueue) dropOldest() bool {
+	busiest, most := "", 0
+	for _, t := range q.order {
+		if t != "" && len(q.lines[t]) > most {
+			busiest, most = t, len(q.lines[t])
+		}
+	}
+	if most == 0 {
+		return false
+	}
+	q.take(busiest)
+	return true
+}
+
+// Removes and returns the first line queued for target
+func (q *sendQueue) take(target string) string {
+	l := q.lines[target]
+	line := l[0]
+	if len(l) == 1 {
+		delete(q.lines, target)
+		for i, t := range q.order {
+			if t == target {
+				q.order = append(q.order[0:i:i], q.order[i+1:]...)
+				break
+			}
+		}
+	} else {
+		q.lines[target] = l[1:]
+	}
+	q.n--
+	q.cond.Broadcast()
+	return line
+}
+
+// Waits for a line to send, taking one from each target in turn. Returns
+// false once the queue has been closed and everything in it has been taken.
+func (q *sendQueue) pop() (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.n == 0 {
+		if q.closed {
+			return "", false
+		}
+		q.cond.Wait()
+	}
+	t := q.order[0]
+	line := q.take(t)
+	// if there's more for t, it goes to the back of the line
+	if len(q.lines[t]) > 0 {
+		q.order = append(q.order[1:], t)
+	}
+	return line, true
+}
+
+// Returns the number of lines waiting to be sent
+func (q *sendQueue) len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.n
+}
+
+// Stops the queue taking any more lines, and wakes up anyone waiting on it
+func (q *sendQueue) close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Returns the number of lines waiting to be sent to target
+func (q *sendQueue) depth(target string) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.lines[target])
+}
+
+// Queued() returns the number of lines waiting to be sent to the server
+func (conn *Conn) Queued() int { return conn.out.len() }
+
+// QueuedTo() returns the number of messages waiting to be sent to target
+func (conn *Conn) QueuedTo(target string) int {
+	return conn.out.depth(conn.Fold(target))
+}
+
+// Returns the target of line for the queue, if it's a message to someone
+func (conn *Conn) lineTarget(line string) string {
+	l, err := ParseLine(line)
+	if err != nil || len(l.Args) == 0 {
+		return ""
+	}
+	switch l.Cmd {
+	case "PRIVMSG", "NOTICE", "TAGMSG":
+		return conn.Fold(l.Args[0])
+	}
+	return ""
+}
@@ -0,0 +1,117 @@
+package irc
+
+// Here you'll find the Recorder, which writes everything we send and receive
+// to a file, for when you need to show exactly what went on between us and a
+// server, e.g. in a bug report. Secrets added with AddSecret() are masked.
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// A Recorder writes lines to Path, one per line with when they were sent or
+// received and which way they went:
+//
+//	2026-10-17T12:00:00.000Z <- :srv 001 nick :Welcome
+//	2026-10-17T12:00:00.250Z -> JOIN #moo
+//
+// Once Path reaches MaxSize bytes it's renamed to Path.1, Path.1 to Path.2
+// and so on, keeping at most Keep old files, so it never takes up more than
+// about (Keep+1)*MaxSize bytes in all.
+type Recorder struct {
+	Path    string
+	MaxSize int64
+	Keep    int
+
+	f    *os.File
+	size int64
+	mu   sync.Mutex
+}
+
+// Creates a Recorder writing to path, with files of up to maxSize bytes and
+// keep old ones. Nothing is opened until the first line is written.
+func NewRecorder(path string, maxSize int64, keep int) *Recorder {
+	return &Recorder{Path: path, MaxSize: maxSize, Keep: keep}
+}
+
+// Record() starts writing everything sent and received to r, replacing any
+// Recorder that was already in use. Record(nil) stops recording.
+func (conn *Conn) Record(r *Recorder) {
+	conn.mu.Lock()
+	old := conn.recorder
+	conn.recorder = r
+	conn.mu.Unlock()
+	if old != nil && old != r {
+		old.Close()
+	}
+}
+
+// Writes a line to the recorder, if there is one. If that fails, recording
+// is stopped and the error sent down conn.Err.
+func (conn *Conn) record(dir, line string) {
+	conn.mu.Lock()
+	r := conn.recorder
+	conn.mu.Unlock()
+	if r == nil {
+		return
+	}
+	if err := r.Write(dir, conn.redact(line)); err != nil {
+		conn.Record(nil)
+		conn.error("irc.record(): %s, recording stopped", err)
+	}
+}
+
+// Write() writes line to the file, with the time and dir, "<-" or "->",
+// opening the file or moving on to a new one if needed.
+func (r *Recorder) Write(dir, line string) error {
+	s := fmt.Sprintf("%s %s %s\n", time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), dir, line)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f != nil && r.MaxSize > 0 && r.size+int64(len(s)) > r.MaxSize {
+		r.f.Close()
+		r.f = nil
+		r.rotate()
+	}
+	if r.f == nil {
+		f, err := os.OpenFile(r.Path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return err
+		}
+		st, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return err
+		}
+		r.f, r.size = f, st.Size()
+	}
+	n, err := r.f.WriteString(s)
+	r.size += int64(n)
+	return err
+}
+
+// Moves Path to Path.1 and so on, dropping the oldest
+func (r *Recorder) rotate() {
+	if r.Keep <= 0 {
+		os.Remove(r.Path)
+		return
+	}
+	os.Remove(fmt.Sprintf("%s.%d", r.Path, r.Keep))
+	for i := r.Keep - 1; i > 0; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", r.Path, i), fmt.Sprintf("%s.%d", r.Path, i+1))
+	}
+	os.Rename(r.Path, r.Path+".1")
+}
+
+// Close() closes the current file. Writing again will reopen it.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
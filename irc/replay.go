@@ -0,0 +1,71 @@
+package irc
+
+// Here you'll find Replay(), which feeds a log of raw IRC lines through the
+// same parsing, state tracking and handlers as a live connection. This makes
+// it possible to reproduce bugs from logs sent in with bug reports.
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Replay() reads raw lines from r and dispatches them as if they had just
+// been received from a server, then returns. r can either contain plain IRC
+// lines or the debug output printed by a *Conn, in which case only incoming
+// ("<- ") lines are replayed.
+//
+// Handlers are run one at a time, in order, so that replays are repeatable.
+// Anything they try to send is printed rather than sent. Errors go down
+// conn.Err as usual, which is closed when the replay finishes as if we had
+// disconnected, so make sure something is reading from it. Once Replay() has
+// returned conn's state can be inspected, but it shouldn't be connected.
+func (conn *Conn) Replay(r io.Reader) error {
+	if conn.connected {
+		return errors.New("irc.Replay(): can't replay while connected to " + conn.Host)
+	}
+	done := make(chan bool)
+	out := conn.out
+	go func() {
+		for {
+			line, ok := out.pop()
+			if !ok {
+				break
+			}
+			fmt.Println("-> (replay) " + conn.redact(line))
+		}
+		done <- true
+	}()
+	defer func() {
+		// wait for the goroutine above to print everything, then start afresh
+		out.close()
+		<-done
+		conn.out = newSendQueue()
+		conn.inline = false
+		conn.connected = false
+		close(conn.Err)
+		conn.Err = make(chan error, 4)
+	}()
+
+	conn.inline = true
+	in := bufio.NewReader(r)
+	for {
+		s, err := in.ReadString('\n')
+		if s = strings.TrimRight(s, "\r\n"); s != "" {
+			if strings.HasPrefix(s, "<- ") {
+				s = s[3:]
+			}
+			// lines we sent aren't replayed, of course
+			if !strings.HasPrefix(s, "-> ") && s != "" {
+				conn.dispatchEvent(lineOrError(s))
+			}
+		}
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
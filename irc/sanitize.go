@@ -0,0 +1,53 @@
+package irc
+
+// Here you'll find functions for cleaning up text people send us before it's
+// matched against anything, so that e.g. "!c\x02md", "!cmd\x07" and "！cmd"
+// can't be used to get around checks for "!cmd". Set Conn.Sanitize to one of
+// them, or your own, to have it done to every PRIVMSG, NOTICE and ACTION.
+
+import (
+	"strings"
+	"unicode"
+)
+
+// SanitizeText() returns s without formatting codes, control characters like
+// bells, or invisible characters like zero-width spaces and bidi overrides.
+// Tabs become spaces, and invalid UTF-8 is dropped.
+func SanitizeText(s string) string {
+	s = strings.ToValidUTF8(StripFormatting(s), "")
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\t':
+			return ' '
+		case unicode.IsControl(r), unicode.Is(unicode.Cf, r):
+			return -1
+		}
+		return r
+	}, s)
+}
+
+// Letters from other scripts that look just like latin ones
+var confusables = map[rune]rune{
+	'А': 'A', 'В': 'B', 'Е': 'E', 'К': 'K', 'М': 'M', 'Н': 'H', 'О': 'O',
+	'Р': 'P', 'С': 'C', 'Т': 'T', 'Х': 'X', 'а': 'a', 'е': 'e', 'о': 'o',
+	'р': 'p', 'с': 'c', 'у': 'y', 'х': 'x', 'і': 'i', 'ј': 'j', 'ѕ': 's',
+	'Α': 'A', 'Β': 'B', 'Ε': 'E', 'Ζ': 'Z', 'Η': 'H', 'Ι': 'I', 'Κ': 'K',
+	'Μ': 'M', 'Ν': 'N', 'Ο': 'O', 'Ρ': 'P', 'Τ': 'T', 'Υ': 'Y', 'Χ': 'X',
+	'ο': 'o', 'ν': 'v',
+}
+
+// FoldConfusables() returns s with fullwidth forms of ASCII characters, and
+// the commonest Cyrillic and Greek letters that look like latin ones, turned
+// into the ASCII they look like. Combine it with SanitizeText() to catch the
+// most tricks.
+func FoldConfusables(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '！' && r <= '～' {
+			return r - '！' + '!'
+		}
+		if c, ok := confusables[r]; ok {
+			return c
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,246 @@
+package irc
+
+// Here you'll find a thin layer over the network services (NickServ and
+// ChanServ as provided by Anope and Atheme) that most networks run.
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Given to WithOps() callbacks when we weren't opped in time
+var ErrNoOps = errors.New("irc: timed out waiting for ops")
+
+// A struct representing the network's services
+type Services struct {
+	// Nicks of the services bots, "NickServ" and "ChanServ" by default
+	NickServ, ChanServ string
+
+	// How long to wait for services to do things
+	Timeout time.Duration
+
+	// If set, this is called to ask for ops on a channel instead of asking
+	// ChanServ, e.g. for an oper bot to use SAMODE or OJOIN.
+	RequestOps func(channel string)
+
+	// How many more times WithOps() asks for ops, waiting Timeout each
+	// time, before giving up. 1 by default.
+	Retries int
+
+	// Set this to have WithOps() count halfops (+h) as enough, for actions
+	// halfops can do, like kicking. Owners (+q) and admins (+a) always are.
+	HalfOps bool
+
+	// Channels we're waiting to be opped on, see WithOps()
+	waiting map[string]*opWait
+	mu      sync.Mutex
+	conn    *Conn
+}
+
+// Things waiting for us to be opped on a channel, see WithOps()
+type opWait struct {
+	actions []func()
+	done    []func(error)
+	deop    bool
+	tries   int
+}
+
+// Phrases found in services notices, mapped to the kind of notice they are.
+// Both Anope and Atheme vary these between versions, so this errs on the side
+// of matching short fragments.
+var ServicesNotices = map[string]string{
+	"nickname is registered":    "IDENTIFY",
+	"please choose a different": "IDENTIFY",
+	"you are now identified":    "IDENTIFIED",
+	"password accepted":         "IDENTIFIED",
+	"invalid password":          "BADPASS",
+	"password incorrect":        "BADPASS",
+	"access denied":             "DENIED",
+	"you do not have access":    "DENIED",
+	"is not registered":         "NOTREGISTERED",
+}
+
+func (conn *Conn) setupServices() {
+	conn.Services = &Services{
+		NickServ: "NickServ",
+		ChanServ: "ChanServ",
+		Timeout:  10 * time.Second,
+		Retries:  1,
+		waiting:  make(map[string]*opWait),
+		conn:     conn,
+	}
+
+	// Turn NOTICEs from services into "SERVICES" events, with the nick of the
+	// service in Args[0] and the kind of notice (see ServicesNotices) in
+	// Args[1], or "" if we don't recognise it.
+	conn.AddHandler("NOTICE", func(conn *Conn, line *Line) {
+		s := conn.Services
+		if !conn.EqualFold(line.Nick, s.NickServ) && !conn.EqualFold(line.Nick, s.ChanServ) {
+			return
+		}
+		kind, text := "", strings.ToLower(line.Text)
+		for phrase, k := range ServicesNotices {
+			if strings.Index(text, phrase) != -1 {
+				kind = k
+				break
+			}
+		}
+		conn.dispatchEvent(&Line{Cmd: "SERVICES", Nick: line.Nick,
+			Src: line.Src, Args: []string{line.Nick, kind}, Text: line.Text})
+	})
+
+	// Watch for MODE +o, or another mode enough() accepts, on ourselves in
+	// channels we're waiting for ops in
+	conn.AddHandler("MODE", func(conn *Conn, line *Line) {
+		p := params(line, 1)
+		if len(line.Args) == 0 || len(p) < 2 {
+			return
+		}
+		s := conn.Services
+		s.mu.Lock()
+		w, ok := s.waiting[conn.Fold(line.Args[0])]
+		s.mu.Unlock()
+		if !ok {
+			return
+		}
+		// a truncated MODE is complained about by the main MODE handler
+		changes, _ := parseModeChange(p[0], p[1:], conn.modeTypes())
+		for _, m := range changes {
+			privs := new(ChanPrivs)
+			privs.set(m.mode, true)
+			if m.add && s.enough(privs) && conn.EqualFold(m.arg, conn.Me.Nick) {
+				s.opped(line.Args[0], w, m.mode)
+				return
+			}
+		}
+	})
+}
+
+// Identify() sends our password to NickServ
+func (s *Services) Identify(password string) {
+	s.conn.AddSecret(password)
+	s.conn.Privmsg(s.NickServ, "IDENTIFY "+password)
+}
+
+// Op() asks ChanServ to op us on channel, then waits for this to happen, see
+// WithOps(). It returns true if we have ops on the channel.
+func (s *Services) Op(channel string) bool {
+	c := make(chan error, 1)
+	s.WithOps(channel, nil, false, func(err error) { c <- err })
+	return <-c == nil
+}
+
+// WithOps() calls action once we have ops on channel, asking for them first
+// if we haven't. Actions waiting for ops on the same channel are called in
+// the order they were asked for, as soon as we're opped, and we give up the
+// mode we were given afterwards if any of them asked for it with deop. If we
+// already had ops, we keep them whatever deop says. If we haven't been opped
+// within s.Timeout, we ask again, up to s.Retries times. If done isn't nil,
+// it's called after action, or with ErrNoOps and without calling action if
+// we weren't opped after all that.
+func (s *Services) WithOps(channel string, action func(), deop bool, done func(error)) {
+	if ch := s.conn.GetChannel(channel); ch != nil {
+		if s.enough(ch.privs(s.conn.Me)) {
+			w := &opWait{}
+			if action != nil {
+				w.actions = append(w.actions, action)
+			}
+			if done != nil {
+				w.done = append(w.done, done)
+			}
+			s.run(channel, w, 0)
+			return
+		}
+	}
+	c := s.conn.Fold(channel)
+	s.mu.Lock()
+	w, ok := s.waiting[c]
+	if !ok {
+		w = &opWait{}
+		s.waiting[c] = w
+	}
+	if action != nil {
+		w.actions = append(w.actions, action)
+	}
+	if done != nil {
+		w.done = append(w.done, done)
+	}
+	w.deop = w.deop || deop
+	s.mu.Unlock()
+	if ok {
+		// we've already asked
+		return
+	}
+	s.requestOps(channel)
+	var expire func()
+	expire = func() {
+		s.mu.Lock()
+		if s.waiting[c] != w {
+			s.mu.Unlock()
+			return
+		}
+		if w.tries < s.Retries {
+			w.tries++
+			s.mu.Unlock()
+			s.requestOps(channel)
+			time.AfterFunc(s.Timeout, expire)
+			return
+		}
+		delete(s.waiting, c)
+		s.mu.Unlock()
+		for _, f := range w.done {
+			f(ErrNoOps)
+		}
+	}
+	time.AfterFunc(s.Timeout, expire)
+}
+
+// Asks for ops on channel, with s.RequestOps if it's set or from ChanServ
+func (s *Services) requestOps(channel string) {
+	if s.RequestOps != nil {
+		s.RequestOps(channel)
+	} else {
+		s.conn.Privmsg(s.ChanServ, "OP "+channel+" "+s.conn.Me.Nick)
+	}
+}
+
+// Returns true if p is privileged enough for WithOps()
+func (s *Services) enough(p *ChanPrivs) bool {
+	return p != nil && (p.Op || p.Admin || p.Owner || s.HalfOps && p.HalfOp)
+}
+
+// Called when we've been given mode, e.g. 'o', on channel, to run what's
+// waiting in w
+func (s *Services) opped(channel string, w *opWait, mode byte) {
+	c := s.conn.Fold(channel)
+	s.mu.Lock()
+	if s.waiting[c] != w {
+		// timed out, or someone else got here first
+		s.mu.Unlock()
+		return
+	}
+	delete(s.waiting, c)
+	s.mu.Unlock()
+	s.run(channel, w, mode)
+}
+
+// Runs the actions in w, and takes mode, the one we were given for them,
+// away from us afterwards if they wanted
+func (s *Services) run(channel string, w *opWait, mode byte) {
+	for _, f := range w.actions {
+		f()
+	}
+	for _, f := range w.done {
+		f(nil)
+	}
+	if w.deop && mode != 0 {
+		s.conn.Mode(channel, "-"+string(mode)+" "+s.conn.Me.Nick)
+	}
+}
+
+// Deop() asks ChanServ to remove our ops on channel
+func (s *Services) Deop(channel string) {
+	s.conn.Privmsg(s.ChanServ, "DEOP "+channel+" "+s.conn.Me.Nick)
+}
@@ -0,0 +1,117 @@
+package irc
+
+// Here you'll find server notice masks, which opers set with user mode +s to
+// choose which server notices they get, e.g. "MODE me +s +cF" for client
+// connections and far connections, and the sorting of the notices that then
+// turn up into "SNOTICE" events with the kind of notice in Args[0].
+
+import (
+	"sort"
+	"strings"
+)
+
+// The kinds of server notice given in "SNOTICE" events, by what's in the
+// notices. Letters for snomasks vary from ircd to ircd, so these go by the
+// text instead. Notices like InspIRCd's "CONNECT: Client connecting..." that
+// start with their kind don't need to be in here. Add to it as you need.
+var SnoticeKinds = map[string]string{
+	"Client connecting":     "CONNECT",
+	"Client exiting":        "QUIT",
+	"Received KILL message": "KILL",
+	"Nick change":           "NICK",
+	"is now an operator":    "OPER",
+	"Possible Flooder":      "FLOOD",
+	"added K-Line":          "KLINE",
+	"added temporary":       "KLINE",
+	"Netsplit":              "NETSPLIT",
+	"Netjoin":               "NETJOIN",
+}
+
+func (conn *Conn) setupSnomasks() {
+	// Handle 008 RPL_SNOMASK, which tells us our whole snomask:
+	//	:server 008 me +cFk :Server notice mask
+	conn.AddHandler("008", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 {
+			return
+		}
+		conn.state.Lock()
+		defer conn.state.Unlock()
+		conn.Me.Modes.Snomasks = nil
+		conn.Me.Modes.setSnomasks(line.Args[1])
+	})
+
+	// Sort server notices that look like they're down to our snomask into
+	// "SNOTICE" events, with the kind of notice in Args[0] ("OTHER" if we
+	// can't tell) and the rest of it in Text.
+	conn.AddHandler("SERVERNOTICE", func(conn *Conn, line *Line) {
+		kind, text := classifySnotice(line.Text)
+		if kind == "" {
+			return
+		}
+		conn.dispatchEvent(&Line{Cmd: "SNOTICE", Src: line.Src, Host: line.Host,
+			Args: []string{kind}, Text: text, Tags: line.Tags})
+	})
+}
+
+// Works out what kind of server notice s is, returning "" if it doesn't look
+// like one that's down to a snomask, e.g. "Looking up your hostname...".
+func classifySnotice(s string) (kind, text string) {
+	// charybdis and friends say "Notice -- Client connecting: ..."
+	if t := strings.TrimPrefix(s, "Notice -- "); t != s {
+		return snoticeKind(t), t
+	}
+	// InspIRCd and friends say "CONNECT: Client connecting ..."
+	if idx := strings.Index(s, ": "); idx > 0 && strings.ToUpper(s[0:idx]) == s[0:idx] &&
+		strings.IndexAny(s[0:idx], " *") == -1 {
+		return s[0:idx], s[idx+2:]
+	}
+	if k := snoticeKind(s); k != "OTHER" {
+		return k, s
+	}
+	return "", s
+}
+
+// Looks s up in SnoticeKinds, going by the longest match if there's more
+// than one, or returns "OTHER"
+func snoticeKind(s string) string {
+	kind, match := "OTHER", ""
+	for k, v := range SnoticeKinds {
+		if len(k) > len(match) && strings.Contains(s, k) {
+			kind, match = v, k
+		}
+	}
+	return kind
+}
+
+// Applies changes to a snomask like "+cF-k", or just "cF", to nm's
+func (nm *NickMode) setSnomasks(changes string) {
+	if nm.Snomasks == nil {
+		nm.Snomasks = make(map[byte]bool)
+	}
+	add := true
+	for i := 0; i < len(changes); i++ {
+		switch c := changes[i]; c {
+		case '+', '-':
+			add = c == '+'
+		default:
+			if add {
+				nm.Snomasks[c] = true
+			} else {
+				delete(nm.Snomasks, c)
+			}
+		}
+	}
+}
+
+// Returns the snomask in nm as a string like "+Fck", or "" if it's empty
+func (nm *NickMode) snomaskString() string {
+	if len(nm.Snomasks) == 0 {
+		return ""
+	}
+	s := []byte{}
+	for c := range nm.Snomasks {
+		s = append(s, c)
+	}
+	sort.Slice(s, func(i, j int) bool { return s[i] < s[j] })
+	return "+" + string(s)
+}
@@ -0,0 +1,145 @@
+package irc
+
+// Here you'll find support for IRCv3 strict transport security (STS), where
+// servers tell us to only ever connect to them using SSL.
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A struct representing the STS policy for a host. Policies received over a
+// plain-text connection only upgrade the next connection to that host, so
+// they don't expire or get saved, and are forgotten once used; these have
+// Expires == 0.
+type STSPolicy struct {
+	Port    string
+	Expires int64 // seconds since the epoch
+}
+
+func (p *STSPolicy) valid() bool {
+	return p.Expires == 0 || p.Expires > time.Now().Unix()
+}
+
+func (conn *Conn) setupSTS() {
+	conn.sts = make(map[string]*STSPolicy)
+
+	// Look for the sts capability's value in CAP LS and NEW replies
+	conn.AddHandler("CAP", func(conn *Conn, line *Line) {
+		if len(line.Args) < 2 || (line.Args[1] != "LS" && line.Args[1] != "NEW") {
+			return
+		}
+		for _, c := range strings.Fields(line.Text) {
+			if strings.HasPrefix(c, "sts=") {
+				conn.stsCap(c[4:])
+			}
+		}
+	})
+}
+
+// Handles a "port=6697,duration=2592000" sts value. Over plain text we need
+// to reconnect using SSL on the given port; over SSL we save the policy.
+func (conn *Conn) stsCap(value string) {
+	var port, duration string
+	for _, kv := range strings.Split(value, ",") {
+		if strings.HasPrefix(kv, "port=") {
+			port = kv[5:]
+		} else if strings.HasPrefix(kv, "duration=") {
+			duration = kv[9:]
+		}
+	}
+	host, hport := splitHost(conn.Host)
+	if !conn.secure {
+		if port == "" {
+			conn.error("irc.stsCap(): buh? no port in STS policy %s", value)
+			return
+		}
+		conn.mu.Lock()
+		conn.sts[host] = &STSPolicy{Port: port}
+		sock := conn.sock
+		conn.mu.Unlock()
+		// closing the socket makes recv() shut the connection down for us
+		conn.error("irc.stsCap(): STS policy found, reconnect to %s to use SSL on port %s", host, port)
+		if sock != nil {
+			sock.Close()
+		}
+		return
+	}
+	if duration == "" {
+		return
+	}
+	d, err := strconv.ParseInt(duration, 10, 64)
+	if err != nil {
+		conn.error("irc.stsCap(): buh? bad duration in STS policy %s", value)
+		return
+	}
+	conn.mu.Lock()
+	if d == 0 {
+		// a zero duration removes the policy
+		delete(conn.sts, host)
+	} else {
+		conn.sts[host] = &STSPolicy{Port: hport, Expires: time.Now().Unix() + d}
+	}
+	conn.mu.Unlock()
+	conn.saveSTS()
+}
+
+// Returns the STS policy for host, if there is a valid one, using up any
+// plain-text upgrade. Reads in the policies saved to conn.STSFile the first
+// time it's called.
+func (conn *Conn) stsPolicy(host string) *STSPolicy {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if !conn.stsLoaded && conn.STSFile != "" {
+		conn.stsLoaded = true
+		// NOTE: it's fine for the file not to exist (yet)
+		if data, err := os.ReadFile(conn.STSFile); err == nil {
+			for _, l := range strings.Split(string(data), "\n") {
+				f := strings.Fields(l)
+				if len(f) != 3 {
+					continue
+				}
+				if e, err := strconv.ParseInt(f[2], 10, 64); err == nil {
+					conn.sts[f[0]] = &STSPolicy{Port: f[1], Expires: e}
+				}
+			}
+		}
+	}
+	if p, ok := conn.sts[host]; ok && p.valid() {
+		if p.Expires == 0 {
+			delete(conn.sts, host)
+		}
+		return p
+	}
+	return nil
+}
+
+// Writes out all the STS policies we want to keep to conn.STSFile
+func (conn *Conn) saveSTS() {
+	if conn.STSFile == "" {
+		return
+	}
+	str := ""
+	conn.mu.Lock()
+	for host, p := range conn.sts {
+		if p.Expires != 0 && p.valid() {
+			str += fmt.Sprintf("%s %s %d\n", host, p.Port, p.Expires)
+		}
+	}
+	conn.mu.Unlock()
+	if err := os.WriteFile(conn.STSFile, []byte(str), 0600); err != nil {
+		conn.error("irc.saveSTS(): %s", err.Error())
+	}
+}
+
+// splits "host:port" into host and port
+func splitHost(s string) (string, string) {
+	if !hasPort(s) {
+		return s, ""
+	}
+	idx := strings.LastIndex(s, ":")
+	return s[0:idx], s[idx+1:]
+}
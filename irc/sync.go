@@ -0,0 +1,126 @@
+package irc
+
+// Here you'll find the queue that staggers the WHO, MODE and ban list queries
+// we send to find out about channels we've just joined, so that joining lots
+// of channels at once doesn't get us disconnected for flooding.
+
+import (
+	"strings"
+	"time"
+)
+
+func (conn *Conn) setupSync() {
+	// Handle the end of each reply we asked for in syncChannel(), triggering
+	// a "CHANNELREADY" event with the channel in Args[0] once we've had them
+	// all. 324 is a single line, the rest end their lists.
+	for _, num := range []string{"315", "324", "368", "729"} {
+		conn.AddHandler(num, func(conn *Conn, line *Line) {
+			if len(line.Args) < 2 {
+				return
+			}
+			if ch := conn.GetChannel(line.Args[1]); ch != nil && conn.synced(ch, line.Cmd) {
+				conn.dispatchEvent(&Line{Cmd: "CHANNELREADY", Src: line.Src,
+					Host: line.Host, Args: []string{ch.Name}})
+			}
+		})
+	}
+}
+
+// Queues up the queries that find out about a channel we've just joined. If
+// conn.SyncDelay is zero they're sent straight away.
+func (conn *Conn) queueSync(ch *Channel) {
+	conn.mu.Lock()
+	ch.unsynced = map[string]bool{"315": true, "324": true, "368": true}
+	if conn.quietList() {
+		ch.unsynced["729"] = true
+	}
+	if conn.SyncDelay > 0 {
+		conn.syncq = append(conn.syncq, ch)
+		conn.mu.Unlock()
+		return
+	}
+	conn.mu.Unlock()
+	conn.syncChannel(ch)
+}
+
+// Takes ch out of the sync queue, e.g. because we've left it
+func (conn *Conn) dropSync(ch *Channel) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	for i, c := range conn.syncq {
+		if c == ch {
+			conn.syncq = append(conn.syncq[0:i:i], conn.syncq[i+1:]...)
+			return
+		}
+	}
+}
+
+// Sends the queries for a channel: we get the channel users automatically in
+// 353 and the topic in 332 on join, so we just need the modes, the bans (and
+// quiets, on servers that keep them in a list) and a WHO. Sending a WHO for
+// the channel is MUCH more efficient than a WHOIS on every nick.
+func (conn *Conn) syncChannel(ch *Channel) {
+	conn.Mode(ch.Name, "")
+	conn.Mode(ch.Name, "+b")
+	if conn.quietList() {
+		conn.Mode(ch.Name, "+q")
+	}
+	conn.who(ch.Name)
+}
+
+// Returns true if the server keeps quiets in a +q list
+func (conn *Conn) quietList() bool {
+	return strings.IndexByte(conn.modeTypes().list, 'q') != -1
+}
+
+// Marks the reply num as received for ch, returning true if it was the last
+// one we were waiting for.
+func (conn *Conn) synced(ch *Channel, num string) bool {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	if !ch.unsynced[num] {
+		return false
+	}
+	delete(ch.unsynced, num)
+	if len(ch.unsynced) > 0 {
+		return false
+	}
+	ch.unsynced = nil
+	ch.Ready = true
+	return true
+}
+
+// Sends the queries for the next channel in the queue every conn.SyncDelay,
+// but only while there's nothing else waiting to be sent, so that they don't
+// hold up more important things like PONGs. Runs until done is closed.
+func (conn *Conn) syncLoop(done <-chan bool) {
+	t := time.NewTicker(conn.SyncDelay)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		if conn.out.len() > 0 {
+			continue
+		}
+		conn.mu.Lock()
+		var ch *Channel
+		if len(conn.syncq) > 0 {
+			ch, conn.syncq = conn.syncq[0], conn.syncq[1:]
+		}
+		conn.mu.Unlock()
+		if ch != nil {
+			conn.syncChannel(ch)
+		}
+	}
+}
+
+// Returns the number of channels still waiting for their queries to be sent.
+// Channels that have had all their replies are marked Ready.
+func (conn *Conn) SyncQueue() int {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	return len(conn.syncq)
+}
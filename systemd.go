@@ -0,0 +1,39 @@
+package main
+
+// Just enough of systemd's sd_notify protocol to tell systemd when we're up
+// and, if the unit has WatchdogSec set, that we haven't hung.
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sends state, e.g. "READY=1", to systemd if we were started by it
+func sdNotify(state string) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return
+	}
+	sock, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return
+	}
+	defer sock.Close()
+	sock.Write([]byte(state))
+}
+
+// pings systemd's watchdog at half the interval it asked for, as long as
+// alive() says things are OK
+func sdWatchdog(alive func() bool) {
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return
+	}
+	for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+		if alive() {
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}